@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// Only the fields of admission.k8s.io/v1 that kapparmor needs are modelled here,
+// keeping the binary free of the Kubernetes client libraries.
+const (
+	admissionAPIVersion   = "admission.k8s.io/v1"
+	admissionKind         = "AdmissionReview"
+	maxAdmissionBodyBytes = 4 << 20 // the API server caps requests at 3MiB
+)
+
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type groupVersionKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+type admissionRequest struct {
+	UID       string           `json:"uid"`
+	Kind      groupVersionKind `json:"kind"`
+	Name      string           `json:"name,omitempty"`
+	Namespace string           `json:"namespace,omitempty"`
+	Operation string           `json:"operation"`
+	Object    json.RawMessage  `json:"object,omitempty"`
+}
+
+type admissionStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type admissionResponse struct {
+	UID      string           `json:"uid"`
+	Allowed  bool             `json:"allowed"`
+	Status   *admissionStatus `json:"status,omitempty"`
+	Warnings []string         `json:"warnings,omitempty"`
+}
+
+// admissionReviewer decides on a single admission request.
+// The UID of the returned response is filled in by serveAdmission.
+type admissionReviewer func(ctx context.Context, req *admissionRequest) *admissionResponse
+
+// serveAdmission decodes an AdmissionReview, hands the request to review and
+// writes back the resulting AdmissionReview.
+func serveAdmission(review admissionReviewer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdmissionBodyBytes))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("reading request body: %v", err), http.StatusBadRequest)
+
+			return
+		}
+
+		var in admissionReview
+		if err := json.Unmarshal(body, &in); err != nil {
+			http.Error(w, fmt.Sprintf("decoding AdmissionReview: %v", err), http.StatusBadRequest)
+
+			return
+		}
+
+		if in.Request == nil {
+			http.Error(w, "AdmissionReview has no request", http.StatusBadRequest)
+
+			return
+		}
+
+		resp := review(r.Context(), in.Request)
+		resp.UID = in.Request.UID
+
+		out := admissionReview{APIVersion: admissionAPIVersion, Kind: admissionKind, Response: resp}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			loggerFromContext(r.Context()).Error("writing AdmissionReview response", slog.Any("error", err))
+		}
+	}
+}
+
+func admissionAllowed(warnings ...string) *admissionResponse {
+	return &admissionResponse{Allowed: true, Warnings: warnings}
+}
+
+func admissionDenied(code int, message string) *admissionResponse {
+	return &admissionResponse{Allowed: false, Status: &admissionStatus{Code: code, Message: message}}
+}
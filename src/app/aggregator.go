@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The aggregator publishes a summary of the fleet view in the status
+// subresource of a cluster scoped ClusterProfileStatus object (see the chart CRD).
+const (
+	clusterStatusAPIVersion = "kapparmor.io/v1alpha1"
+	clusterStatusKind       = "ClusterProfileStatus"
+	clusterStatusPath       = "/apis/kapparmor.io/v1alpha1/clusterprofilestatuses"
+	clusterStatusName       = "cluster"
+)
+
+// clusterStatus is the fleet view served by the aggregator.
+type clusterStatus struct {
+	GeneratedAt time.Time            `json:"generatedAt"`
+	DesiredHash string               `json:"desiredHash"`
+	Summary     clusterSummary       `json:"summary"`
+	Nodes       []clusterNodeStatus  `json:"nodes"`
+	Profiles    []profileFleetStatus `json:"profiles"`
+}
+
+type clusterSummary struct {
+	Nodes     int `json:"nodes"`
+	InSync    int `json:"inSync"`
+	OutOfSync int `json:"outOfSync"`
+	Stale     int `json:"stale"`
+}
+
+type clusterNodeStatus struct {
+	reportedNodeStatus
+
+	InSync bool `json:"inSync"`
+	// Stale is true when the node did not report for longer than the stale threshold.
+	Stale bool `json:"stale"`
+}
+
+// profileFleetStatus tells which nodes run which version of a profile.
+type profileFleetStatus struct {
+	Name string `json:"name"`
+	// DesiredSHA256 is the sha256 of the ConfigMap source, empty for profiles no longer in the ConfigMap.
+	DesiredSHA256 string   `json:"desiredSha256,omitempty"`
+	UpToDateNodes []string `json:"upToDateNodes"`
+	// OutdatedNodes maps installed sha256 to the nodes running that version.
+	OutdatedNodes    map[string][]string `json:"outdatedNodes,omitempty"`
+	MissingNodes     []string            `json:"missingNodes,omitempty"`
+	QuarantinedNodes []string            `json:"quarantinedNodes,omitempty"`
+}
+
+// statusAggregator periodically collects the node status Leases into a clusterStatus.
+type statusAggregator struct {
+	cfg        *AppConfig
+	client     *kubeClient
+	namespace  string
+	staleAfter time.Duration
+	now        func() time.Time
+
+	view atomic.Pointer[clusterStatus]
+}
+
+// runAggregator serves the cluster view over HTTP and keeps the
+// ClusterProfileStatus object updated until a stop signal is received.
+func runAggregator(ctx context.Context, cfg *AppConfig) error {
+	pollTime, err := strconv.Atoi(cfg.PollTimeArg)
+	if err != nil || pollTime < 1 {
+		return fmt.Errorf("invalid POLL_TIME %q", cfg.PollTimeArg)
+	}
+
+	if cfg.PodNamespace == "" {
+		return errors.New("POD_NAMESPACE must be set to read the node status reports")
+	}
+
+	client, err := newInClusterKubeClient()
+	if err != nil {
+		return err
+	}
+
+	// The desired hash depends on the policy and the template variables, as on the nodes.
+	if err := loadClusterRendering(ctx, cfg); err != nil {
+		return err
+	}
+
+	agg := &statusAggregator{
+		cfg:        cfg,
+		client:     client,
+		namespace:  cfg.PodNamespace,
+		staleAfter: 3 * time.Duration(pollTime) * time.Second,
+		now:        cfg.clock().Now,
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go agg.run(ctx, time.Duration(pollTime)*time.Second)
+
+	srv := newModeServer(cfg.AggregatorAddr, agg.handler())
+
+	cfg.Logger.Info("Starting status aggregator",
+		slog.String("addr", cfg.AggregatorAddr),
+		slog.String("namespace", agg.namespace))
+
+	return serveUntilStopped(ctx, "aggregator", srv, srv.ListenAndServe)
+}
+
+func (a *statusAggregator) run(ctx context.Context, interval time.Duration) {
+	ticks, stop := a.cfg.clock().NewTicker(interval)
+	defer stop()
+
+	for {
+		if err := a.refresh(ctx); err != nil {
+			slog.Default().Error("cluster status refresh failed", slog.Any("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+		}
+	}
+}
+
+// refresh rebuilds the cluster view and publishes its summary in the ClusterProfileStatus.
+func (a *statusAggregator) refresh(ctx context.Context) error {
+	statuses, err := listNodeStatuses(ctx, a.client, a.namespace)
+	if err != nil {
+		return err
+	}
+
+	desired, err := desiredProfileDigests(a.cfg)
+	if err != nil {
+		return fmt.Errorf("reading desired profiles: %w", err)
+	}
+
+	a.cfg.Templater.refresh(ctx)
+
+	desiredHash, err := profileSetDigest(a.cfg)
+	if err != nil {
+		return fmt.Errorf("hashing desired profiles: %w", err)
+	}
+
+	view := buildClusterStatus(desiredHash, desired, statuses, a.now(), a.staleAfter)
+	a.view.Store(view)
+
+	return a.publishStatus(ctx, view)
+}
+
+// desiredProfileDigests returns the sha256 of every profile in the ConfigMap volume,
+// computed on the source bytes, before each node renders them. They are compared
+// with the source digests of the node reports.
+func desiredProfileDigests(cfg *AppConfig) (map[string]string, error) {
+	var (
+		entries []fs.DirEntry
+		err     error
+	)
+
+	if cfg.ConfigmapRoot != nil {
+		entries, err = fs.ReadDir(cfg.ConfigmapRoot.FS(), ".")
+	} else {
+		entries, err = os.ReadDir(cfg.ConfigmapPath)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	digests := map[string]string{}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !isProfileEntry(entry.Name()) {
+			continue
+		}
+
+		data, err := readProfileBytes(cfg.filesystem(), cfg.ConfigmapRoot, cfg.ConfigmapPath, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		digests[entry.Name()], _ = profileDigest(data, nil)
+	}
+
+	return digests, nil
+}
+
+// buildClusterStatus compares every node report with the desired profiles.
+func buildClusterStatus(
+	desiredHash string,
+	desired map[string]string,
+	statuses []reportedNodeStatus,
+	now time.Time,
+	staleAfter time.Duration,
+) *clusterStatus {
+	view := &clusterStatus{
+		GeneratedAt: now.UTC(),
+		DesiredHash: desiredHash,
+		Nodes:       make([]clusterNodeStatus, 0, len(statuses)),
+	}
+
+	profiles := map[string]*profileFleetStatus{}
+	profile := func(name string) *profileFleetStatus {
+		if profiles[name] == nil {
+			profiles[name] = &profileFleetStatus{Name: name, DesiredSHA256: desired[name], UpToDateNodes: []string{}}
+		}
+
+		return profiles[name]
+	}
+
+	for name := range desired {
+		profile(name)
+	}
+
+	for _, status := range statuses {
+		node := clusterNodeStatus{
+			reportedNodeStatus: status,
+			Stale:              now.Sub(status.ReportedAt) > staleAfter,
+			InSync:             status.ReconcileOK && len(status.LoadedProfiles) == len(desired),
+		}
+
+		for name, installed := range status.LoadedProfiles {
+			p := profile(name)
+			if p.DesiredSHA256 != "" && nodeSourceDigest(status.nodeStatus, name) == p.DesiredSHA256 {
+				p.UpToDateNodes = append(p.UpToDateNodes, status.Node)
+
+				continue
+			}
+
+			node.InSync = false
+
+			if p.OutdatedNodes == nil {
+				p.OutdatedNodes = map[string][]string{}
+			}
+
+			p.OutdatedNodes[installed] = append(p.OutdatedNodes[installed], status.Node)
+		}
+
+		for name := range desired {
+			if _, loaded := status.LoadedProfiles[name]; !loaded {
+				profile(name).MissingNodes = append(profile(name).MissingNodes, status.Node)
+			}
+		}
+
+		for name := range status.QuarantinedProfiles {
+			profile(name).QuarantinedNodes = append(profile(name).QuarantinedNodes, status.Node)
+		}
+
+		node.InSync = node.InSync && !node.Stale
+
+		switch {
+		case node.Stale:
+			view.Summary.Stale++
+		case node.InSync:
+			view.Summary.InSync++
+		default:
+			view.Summary.OutOfSync++
+		}
+
+		view.Nodes = append(view.Nodes, node)
+	}
+
+	view.Summary.Nodes = len(view.Nodes)
+
+	for _, name := range slices.Sorted(maps.Keys(profiles)) {
+		view.Profiles = append(view.Profiles, *profiles[name])
+	}
+
+	return view
+}
+
+// nodeSourceDigest returns the sha256 of the source of the profile name loaded on
+// the node. Agents without source digests only install their source unchanged,
+// so the installed digest is used.
+func nodeSourceDigest(status nodeStatus, name string) string {
+	if status.SourceProfiles == nil {
+		return status.LoadedProfiles[name]
+	}
+
+	return status.SourceProfiles[name]
+}
+
+func (a *statusAggregator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", writeHealthz)
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, _ *http.Request) {
+		view := a.view.Load()
+		if view == nil {
+			http.Error(w, "cluster status not collected yet", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		writeJSON(w, view)
+	})
+	mux.HandleFunc("GET /status/profiles/{name}", func(w http.ResponseWriter, r *http.Request) {
+		view := a.view.Load()
+		if view == nil {
+			http.Error(w, "cluster status not collected yet", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		name := r.PathValue("name")
+		i := sort.Search(len(view.Profiles), func(i int) bool { return view.Profiles[i].Name >= name })
+
+		if i == len(view.Profiles) || view.Profiles[i].Name != name {
+			http.Error(w, fmt.Sprintf("profile %q is neither desired nor loaded on any node", name), http.StatusNotFound)
+
+			return
+		}
+
+		writeJSON(w, view.Profiles[i])
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Default().Error("writing JSON response", slog.Any("error", err))
+	}
+}
+
+// clusterStatusSummary is what goes into the ClusterProfileStatus status subresource:
+// the per-node details stay on the HTTP endpoint to keep the object small.
+type clusterStatusSummary struct {
+	DesiredHash      string              `json:"desiredHash"`
+	LastUpdateTime   string              `json:"lastUpdateTime"`
+	Summary          clusterSummary      `json:"summary"`
+	OutOfSyncNodes   []string            `json:"outOfSyncNodes,omitempty"`
+	StaleNodes       []string            `json:"staleNodes,omitempty"`
+	OutdatedProfiles map[string][]string `json:"outdatedProfiles,omitempty"`
+}
+
+type clusterStatusObject struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Status *clusterStatusSummary `json:"status,omitempty"`
+}
+
+func summarizeClusterStatus(view *clusterStatus) *clusterStatusSummary {
+	summary := &clusterStatusSummary{
+		DesiredHash:    view.DesiredHash,
+		LastUpdateTime: view.GeneratedAt.Format(time.RFC3339),
+		Summary:        view.Summary,
+	}
+
+	for _, node := range view.Nodes {
+		switch {
+		case node.Stale:
+			summary.StaleNodes = append(summary.StaleNodes, node.Node)
+		case !node.InSync:
+			summary.OutOfSyncNodes = append(summary.OutOfSyncNodes, node.Node)
+		}
+	}
+
+	for _, p := range view.Profiles {
+		var nodes []string
+		for _, outdated := range p.OutdatedNodes {
+			nodes = append(nodes, outdated...)
+		}
+
+		nodes = append(nodes, p.MissingNodes...)
+		if len(nodes) == 0 {
+			continue
+		}
+
+		if summary.OutdatedProfiles == nil {
+			summary.OutdatedProfiles = map[string][]string{}
+		}
+
+		sort.Strings(nodes)
+		summary.OutdatedProfiles[p.Name] = nodes
+	}
+
+	return summary
+}
+
+// publishStatus writes the view summary in the status subresource, creating the object when missing.
+func (a *statusAggregator) publishStatus(ctx context.Context, view *clusterStatus) error {
+	objectPath := clusterStatusPath + "/" + clusterStatusName
+
+	var obj clusterStatusObject
+
+	err := a.client.do(ctx, http.MethodGet, objectPath, "", nil, &obj)
+	if isKubeStatus(err, http.StatusNotFound) {
+		obj = clusterStatusObject{APIVersion: clusterStatusAPIVersion, Kind: clusterStatusKind}
+		obj.Metadata.Name = clusterStatusName
+		err = a.client.do(ctx, http.MethodPost, clusterStatusPath, "application/json", &obj, &obj)
+	}
+
+	if err != nil {
+		return fmt.Errorf("reading %s %s: %w", clusterStatusKind, clusterStatusName, err)
+	}
+
+	obj.Status = summarizeClusterStatus(view)
+	if err := a.client.do(ctx, http.MethodPut, objectPath+"/status", "application/json", &obj, nil); err != nil {
+		return fmt.Errorf("updating %s status: %w", clusterStatusKind, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// profileAllowlist pins the profile contents approved out-of-band: a YAML or JSON
+// file mapping profile names to their permitted sha256 digests, as computed by
+// profileDigest (sha256sum of the file).
+//
+//	custom.web:
+//	  - 3d8584a0924e572fdfd6ec421e8195b32ba837309d95b1e3be037481c9ca9ad8
+//
+// The file is read again when it changes, so approvals need no restart.
+type profileAllowlist struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	digests map[string][]string
+}
+
+// loadProfileAllowlist reads the allowlist at path. An invalid file is an error
+// at startup; later, the last valid version is kept.
+func loadProfileAllowlist(path string) (*profileAllowlist, error) {
+	a := &profileAllowlist{path: path}
+
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *profileAllowlist) reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(a.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.path) // #nosec G304 -- operator-configured PROFILE_ALLOWLIST
+	if err != nil {
+		return err
+	}
+
+	digests := map[string][]string{}
+	if err := yaml.UnmarshalStrict(data, &digests); err != nil {
+		return fmt.Errorf("allowlist %s: %w", a.path, err)
+	}
+
+	for name, list := range digests {
+		for _, digest := range list {
+			if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != 32 || digest != fmt.Sprintf("%x", decoded) {
+				return fmt.Errorf("allowlist %s: %s: %q is not a lowercase hex sha256", a.path, name, digest)
+			}
+		}
+	}
+
+	a.digests, a.modTime = digests, info.ModTime()
+
+	return nil
+}
+
+// refresh reloads the allowlist when the file changed, keeping the previous
+// version when the new one cannot be read. A nil allowlist does nothing.
+func (a *profileAllowlist) refresh(ctx context.Context) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.reload(); err != nil {
+		loggerFromContext(ctx).Error("Cannot reload the profile allowlist, keeping the previous one",
+			slog.String("path", a.path), slog.Any("error", err))
+	}
+}
+
+// blockReason explains why content is not a permitted version of the profile
+// name, empty when it is. A nil allowlist permits everything.
+func (a *profileAllowlist) blockReason(name string, content []byte) string {
+	if a == nil {
+		return ""
+	}
+
+	digest, _ := profileDigest(content, nil)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if slices.Contains(a.digests[name], digest) {
+		return ""
+	}
+
+	return fmt.Sprintf("sha256 %s is not in the allowlist", digest)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Audit operations and results.
+const (
+	auditLoad    = "load"
+	auditUnload  = "unload"
+	auditSuccess = "success"
+	auditFailure = "failure"
+	// auditPartialLine marks the line before it as a partial write, e.g. of a node
+	// crash, whose sha256 is in OldSHA256. The chain continues from the entry before it.
+	auditPartialLine = "partial-line"
+)
+
+// auditMaxLine bounds the length of an audit log line.
+const auditMaxLine = 1024 * 1024
+
+var errAuditPathMissing = errors.New("no audit log path: pass it as argument or set AUDIT_LOG_PATH")
+
+// auditEntry is one line of the audit log. Hash is the sha256 of the entry
+// encoded without it, and PrevHash links it to the previous line: editing,
+// removing or reordering lines breaks the chain (see verifyAuditLog).
+type auditEntry struct {
+	Time      string `json:"time"`
+	Node      string `json:"node"`
+	Profile   string `json:"profile"`
+	Operation string `json:"operation"`
+	OldSHA256 string `json:"oldSha256"`
+	NewSHA256 string `json:"newSha256"`
+	// SourceVersion is the version directory of the mounted ConfigMap, when available.
+	SourceVersion string `json:"sourceVersion"`
+	Result        string `json:"result"`
+	Error         string `json:"error,omitempty"`
+	PrevHash      string `json:"prevHash"`
+	Hash          string `json:"hash,omitempty"`
+}
+
+// computeHash returns the chain hash of e, ignoring its Hash field.
+func (e auditEntry) computeHash() (string, error) {
+	e.Hash = ""
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditLog appends hash-chained entries to a JSON-lines file on the host.
+// A nil *auditLog records nothing.
+type auditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	lastHash string
+}
+
+// openAuditLog opens cfg.AuditLogPath for appending, creating it and its directory
+// when missing, and resumes the hash chain from its last entry. A partial last
+// line, left by an interrupted write, is terminated and marked with an entry.
+func openAuditLog(ctx context.Context, cfg *AppConfig) (*auditLog, error) {
+	path := cfg.AuditLogPath
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("creating the audit log directory: %w", err)
+	}
+
+	// #nosec G304 -- path is the operator-configured AUDIT_LOG_PATH
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening the audit log: %w", err)
+	}
+
+	lastHash, entries, partial, err := readAuditChain(file)
+	if err != nil {
+		_ = file.Close()
+
+		return nil, fmt.Errorf("audit log %s is not a valid chain, run 'kapparmor verify-audit': %w", path, err)
+	}
+
+	log := &auditLog{file: file, lastHash: lastHash}
+
+	switch {
+	case partial != nil:
+		if err := log.markPartialLine(cfg, partial); err != nil {
+			_ = file.Close()
+
+			return nil, err
+		}
+
+		loggerFromContext(ctx).Warn("The audit log ended with a partial line, marked it and resumed the chain",
+			slog.String("path", path),
+			slog.Int("entries", entries),
+			slog.Int("bytes", len(partial)))
+	case !endsWithNewline(file):
+		// The last entry is complete, only its newline is missing.
+		if _, err := file.Write([]byte("\n")); err != nil {
+			_ = file.Close()
+
+			return nil, fmt.Errorf("writing the audit log: %w", err)
+		}
+	}
+
+	return log, nil
+}
+
+// endsWithNewline reports whether file is empty or ends with a newline.
+func endsWithNewline(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return true
+	}
+
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return true
+	}
+
+	return last[0] == '\n'
+}
+
+// markPartialLine terminates the partial last line of the file and records an
+// auditPartialLine entry with its digest, in a single write.
+func (a *auditLog) markPartialLine(cfg *AppConfig, partial []byte) error {
+	digest, _ := profileDigest(partial, nil)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.append([]byte("\n"), auditEntry{
+		Time:      cfg.clock().Now().UTC().Format(time.RFC3339Nano),
+		Node:      cfg.NodeName,
+		Operation: auditPartialLine,
+		OldSHA256: digest,
+		Result:    auditFailure,
+		Error:     fmt.Sprintf("ignored a partial line of %d bytes", len(partial)),
+	})
+}
+
+// record appends entry to the chain. The file is synced before returning.
+func (a *auditLog) record(entry auditEntry) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.append(nil, entry)
+}
+
+// append writes prefix and entry, chained to the last one. a.mu must be held.
+func (a *auditLog) append(prefix []byte, entry auditEntry) error {
+	entry.PrevHash = a.lastHash
+
+	hash, err := entry.computeHash()
+	if err != nil {
+		return err
+	}
+
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.file.Write(append(append(prefix, line...), '\n')); err != nil {
+		return fmt.Errorf("writing the audit log: %w", err)
+	}
+
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("syncing the audit log: %w", err)
+	}
+
+	a.lastHash = hash
+
+	return nil
+}
+
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+
+	return a.file.Close()
+}
+
+// readAuditChain checks every entry of r against the previous one and returns
+// the hash of the last entry and the number of entries. A line that is not an
+// entry is only accepted when an auditPartialLine entry with its digest follows,
+// or when it is the last line and lacks its newline: it is returned as partial.
+func readAuditChain(r io.Reader) (lastHash string, entries int, partial []byte, err error) {
+	reader := bufio.NewReader(r)
+
+	var pending []byte // the previous line, when it is not an entry
+
+	for line := 1; ; line++ {
+		data, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return "", entries, nil, readErr
+		}
+
+		if len(data) == 0 {
+			if bytes.HasSuffix(pending, []byte("\n")) {
+				return "", entries, nil, fmt.Errorf("line %d: not an audit entry", line-1)
+			}
+
+			return lastHash, entries, pending, nil
+		}
+
+		if len(data) > auditMaxLine {
+			return "", entries, nil, fmt.Errorf("line %d: longer than %d bytes", line, auditMaxLine)
+		}
+
+		if pending != nil {
+			if err := checkPartialLineMark(data, pending, lastHash); err != nil {
+				return "", entries, nil, fmt.Errorf("line %d: %w", line-1, err)
+			}
+
+			pending = nil
+		}
+
+		var entry auditEntry
+
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(&entry); err != nil {
+			pending = data
+
+			continue
+		}
+
+		entries++
+
+		if entry.PrevHash != lastHash {
+			return "", entries, nil, fmt.Errorf("line %d: previous hash %q does not match %q", line, entry.PrevHash, lastHash)
+		}
+
+		hash, err := entry.computeHash()
+		if err != nil {
+			return "", entries, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if hash != entry.Hash {
+			return "", entries, nil, fmt.Errorf("line %d: content does not match its hash", line)
+		}
+
+		lastHash = hash
+	}
+}
+
+// checkPartialLineMark verifies that the line following the partial line is its mark.
+func checkPartialLineMark(line, partial []byte, lastHash string) error {
+	var mark auditEntry
+	if err := json.Unmarshal(line, &mark); err != nil || mark.Operation != auditPartialLine || mark.PrevHash != lastHash {
+		return errors.New("not an audit entry")
+	}
+
+	if digest, _ := profileDigest(bytes.TrimSuffix(partial, []byte("\n")), nil); digest != mark.OldSHA256 {
+		return errors.New("does not match the digest of its partial line mark")
+	}
+
+	return nil
+}
+
+// verifyAuditLog checks the hash chain of the audit log at path.
+func verifyAuditLog(ctx context.Context, path string) error {
+	file, err := os.Open(path) // #nosec G304 -- path given by the operator
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	lastHash, entries, partial, err := readAuditChain(file)
+	if err != nil {
+		return fmt.Errorf("audit log %s: %w", path, err)
+	}
+
+	if partial != nil {
+		loggerFromContext(ctx).Warn("The audit log ends with a partial line, the agent marks it when it starts",
+			slog.String("path", path),
+			slog.Int("bytes", len(partial)))
+	}
+
+	loggerFromContext(ctx).Info("Audit log chain verified",
+		slog.String("path", path),
+		slog.Int("entries", entries),
+		slog.String("last_hash", lastHash))
+
+	return nil
+}
+
+// auditProfileChange records a profile operation. Failures to write the audit log
+// are logged and do not stop the profile operation.
+func auditProfileChange(ctx context.Context, cfg *AppConfig, operation, profile, oldSHA, newSHA string, opErr error) {
+	if cfg.Audit == nil {
+		return
+	}
+
+	entry := auditEntry{
+		Time:          cfg.clock().Now().UTC().Format(time.RFC3339Nano),
+		Node:          cfg.NodeName,
+		Profile:       profile,
+		Operation:     operation,
+		OldSHA256:     oldSHA,
+		NewSHA256:     newSHA,
+		SourceVersion: configMapVersion(cfg),
+		Result:        auditSuccess,
+	}
+
+	if opErr != nil {
+		entry.Result = auditFailure
+		entry.Error = opErr.Error()
+	}
+
+	if err := cfg.Audit.record(entry); err != nil {
+		loggerFromContext(ctx).Error("audit log write failed", slog.String("profile", profile), slog.Any("error", err))
+	}
+}
+
+// configMapVersion returns the version directory the kubelet links as "..data"
+// in a mounted ConfigMap, or an empty string outside a ConfigMap volume.
+func configMapVersion(cfg *AppConfig) string {
+	target, err := os.Readlink(filepath.Join(cfg.ConfigmapPath, "..data"))
+	if err != nil {
+		return ""
+	}
+
+	return target
+}
+
+// installedDigest returns the sha256 of the installed profile name, empty when missing.
+func installedDigest(cfg *AppConfig, name string) string {
+	data, err := readProfileBytes(cfg.filesystem(), cfg.EtcRoot, cfg.EtcApparmord, name)
+
+	return digestOrEmpty(data, err)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// offlineCommands run without the node agent configuration or any cluster access,
+// e.g. in CI. They print their results on stdout and only log warnings on stderr.
+var offlineCommands = map[string]func(args []string, stdout io.Writer) error{
+	"validate": runValidate,
+	"diff":     runDiff,
+	"render":   runRender,
+	"spo":      runSPO,
+	"learn":    runLearn,
+}
+
+// runCommand dispatches the optional modes of the kapparmor binary.
+// Without arguments the binary runs the node agent (see RunApp).
+func runCommand(ctx context.Context, cfg *AppConfig, args []string) error {
+	switch args[0] {
+	case "webhook":
+		return runWebhookServer(ctx, cfg)
+	case "aggregator":
+		return runAggregator(ctx, cfg)
+	case "verify-audit":
+		path := cfg.AuditLogPath
+		if len(args) > 1 {
+			path = args[1]
+		}
+
+		if path == "" {
+			return errAuditPathMissing
+		}
+
+		return verifyAuditLog(contextWithLogger(ctx, cfg.Logger), path)
+	default:
+		return fmt.Errorf("unknown command %q (available: webhook, aggregator, verify-audit, validate, diff, render, spo, learn)", args[0])
+	}
+}
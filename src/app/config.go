@@ -4,6 +4,7 @@ import (
 	"log/slog"
 	"os"
 	"path"
+	"strconv"
 	"sync"
 )
 
@@ -22,6 +23,83 @@ type AppConfig struct {
 	KernelPath        string
 	Logger            *slog.Logger
 
+	// Injected dependencies, defaulting to the host ones when nil (see loader.go).
+	Loader ProfileLoader
+	Clock  Clock
+	FS     FileSystem
+
+	// Node agent HTTP server (see newAgentServer). No server is started when HTTPPort is empty.
+	HTTPBindAddress     string
+	HTTPPort            string
+	HTTPReadTimeoutArg  string // seconds
+	HTTPWriteTimeoutArg string // seconds
+	HTTPTLSCert         string // reloaded when the file changes
+	HTTPTLSKey          string
+	HTTPMetricsClientCA string // when set, /metrics requires a client certificate signed by this CA
+
+	// Admission webhook mode (see runWebhookServer).
+	WebhookAddr    string
+	WebhookTLSCert string
+	WebhookTLSKey  string
+	WebhookPolicy  string // "deny" or "warn"
+	// Name of the ConfigMap validated by /validate/configmaps.
+	WebhookProfilesConfigMap string
+
+	// Node readiness taint (see nodeTaintManager).
+	NodeName          string
+	NodeTaintEnabled  bool
+	NodeTaintKey      string
+	NodeTaintGraceArg string // seconds out of sync before re-tainting the node
+	NodeTaint         *nodeTaintManager
+
+	// Staged rollout of profile changes (see rolloutManager).
+	PodNamespace            string
+	RolloutEnabled          bool
+	RolloutCanaryPercentArg string
+	RolloutSoakArg          string // seconds canaries must stay healthy before promotion
+	Rollout                 *rolloutManager
+
+	// Node status reports read by the aggregator (see nodeStatusReporter).
+	StatusReportEnabled bool
+	NodeStatus          *nodeStatusReporter
+	AggregatorAddr      string
+
+	// OTLP endpoint of the trace exporter (see setupTracing). Tracing is a no-op when empty.
+	OTLPEndpoint string
+
+	// Outcome of the last profile operations, served by /status.
+	History *reconcileHistory
+
+	// Hash-chained audit log of the profile changes (see auditLog). Disabled when AuditLogPath is empty.
+	AuditLogPath string
+	Audit        *auditLog
+
+	// Kernel audit log tailed for AppArmor denials (see denialCollector). Disabled when DenialLogPath is empty.
+	DenialLogPath     string
+	DenialLogLimitArg string // denial log lines per profile and minute
+
+	// Public keys the profile signatures are verified against (see profileVerifier).
+	// Signatures are not checked when SigningKeysPath is empty.
+	SigningKeysPath string
+	Verifier        *profileVerifier
+
+	// Permitted profile digests (see profileAllowlist). Every digest is allowed when AllowlistPath is empty.
+	AllowlistPath string
+	Allowlist     *profileAllowlist
+
+	// Organization rules of every profile (see profilePolicy): comma separated
+	// required includes and a snippet injected before loading. Off when both are empty.
+	RequiredIncludes  string
+	PolicySnippetPath string
+	Policy            *profilePolicy
+
+	// Profile sources are Go templates when TemplatesEnabled (see profileTemplater), with
+	// the variables of TemplateVarsPath and, when TemplateNodeLabels, the node labels.
+	TemplatesEnabled   bool
+	TemplateVarsPath   string
+	TemplateNodeLabels bool
+	Templater          *profileTemplater
+
 	// Do not use a os.Signals: RunApp() manages signals and context locally.
 }
 
@@ -41,13 +119,48 @@ func NewConfigFromEnv(logger *slog.Logger) *AppConfig {
 	profilerFullPath := path.Join(profilerBinFolder, ProfilerBin)
 
 	config := &AppConfig{
-		ConfigmapPath:     configmapPath,
-		EtcApparmord:      "/etc/apparmor.d/custom",
-		PollTimeArg:       pollTimeArg,
-		ProfilerBinFolder: profilerBinFolder,
-		ProfilerFullPath:  profilerFullPath,
-		KernelPath:        "/sys/kernel/security/apparmor/profiles",
-		Logger:            logger,
+		ConfigmapPath:            configmapPath,
+		EtcApparmord:             "/etc/apparmor.d/custom",
+		PollTimeArg:              pollTimeArg,
+		ProfilerBinFolder:        profilerBinFolder,
+		ProfilerFullPath:         profilerFullPath,
+		KernelPath:               "/sys/kernel/security/apparmor/profiles",
+		Logger:                   logger,
+		HTTPBindAddress:          os.Getenv("HTTP_BIND_ADDRESS"),
+		HTTPPort:                 getEnvOrDefault("HTTP_PORT", strconv.Itoa(HealthzPort)),
+		HTTPReadTimeoutArg:       getEnvOrDefault("HTTP_READ_TIMEOUT", "10"),
+		HTTPWriteTimeoutArg:      getEnvOrDefault("HTTP_WRITE_TIMEOUT", "10"),
+		HTTPTLSCert:              os.Getenv("HTTP_TLS_CERT"),
+		HTTPTLSKey:               os.Getenv("HTTP_TLS_KEY"),
+		HTTPMetricsClientCA:      os.Getenv("HTTP_METRICS_CLIENT_CA"),
+		WebhookAddr:              getEnvOrDefault("WEBHOOK_ADDR", ":8443"),
+		WebhookTLSCert:           getEnvOrDefault("WEBHOOK_TLS_CERT", "/etc/kapparmor/tls/tls.crt"),
+		WebhookTLSKey:            getEnvOrDefault("WEBHOOK_TLS_KEY", "/etc/kapparmor/tls/tls.key"),
+		WebhookPolicy:            getEnvOrDefault("WEBHOOK_POLICY", "deny"),
+		WebhookProfilesConfigMap: getEnvOrDefault("WEBHOOK_PROFILES_CONFIGMAP", "kapparmor-profiles"),
+		NodeName:                 os.Getenv("NODE_NAME"),
+		NodeTaintEnabled:         os.Getenv("NODE_TAINT_ENABLED") == "true",
+		NodeTaintKey:             getEnvOrDefault("NODE_TAINT_KEY", defaultNodeTaintKey),
+		NodeTaintGraceArg:        getEnvOrDefault("NODE_TAINT_GRACE", "120"),
+		PodNamespace:             os.Getenv("POD_NAMESPACE"),
+		RolloutEnabled:           os.Getenv("ROLLOUT_ENABLED") == "true",
+		RolloutCanaryPercentArg:  getEnvOrDefault("ROLLOUT_CANARY_PERCENT", "10"),
+		RolloutSoakArg:           getEnvOrDefault("ROLLOUT_SOAK", "600"),
+		StatusReportEnabled:      os.Getenv("STATUS_REPORT_ENABLED") == "true",
+		AggregatorAddr:           getEnvOrDefault("AGGREGATOR_ADDR", ":8080"),
+		OTLPEndpoint: getEnvOrDefault("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+			os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")),
+		AuditLogPath:       os.Getenv("AUDIT_LOG_PATH"),
+		DenialLogPath:      os.Getenv("DENIAL_LOG_PATH"),
+		DenialLogLimitArg:  getEnvOrDefault("DENIAL_LOG_LIMIT", "10"),
+		SigningKeysPath:    os.Getenv("PROFILE_SIGNING_KEYS"),
+		AllowlistPath:      os.Getenv("PROFILE_ALLOWLIST"),
+		RequiredIncludes:   os.Getenv("PROFILE_REQUIRED_INCLUDES"),
+		PolicySnippetPath:  os.Getenv("PROFILE_POLICY_SNIPPET"),
+		TemplatesEnabled:   os.Getenv("PROFILE_TEMPLATES") == "true",
+		TemplateVarsPath:   os.Getenv("PROFILE_TEMPLATE_VARS"),
+		TemplateNodeLabels: os.Getenv("PROFILE_TEMPLATE_NODE_LABELS") == "true",
+		History:            newReconcileHistory(),
 	}
 
 	logger.Info("Configuration initialized",
@@ -56,7 +169,18 @@ func NewConfigFromEnv(logger *slog.Logger) *AppConfig {
 		slog.String("poll_time", config.PollTimeArg),
 		slog.String("profiler_path", config.ProfilerFullPath),
 		slog.String("kernel_path", config.KernelPath),
+		slog.Bool("node_taint_enabled", config.NodeTaintEnabled),
+		slog.Bool("rollout_enabled", config.RolloutEnabled),
 	)
 
 	return config
 }
+
+// getEnvOrDefault returns the value of the environment variable key, or def when unset or empty.
+func getEnvOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+
+	return def
+}
@@ -7,4 +7,6 @@ const (
 	maximumLinuxFilenameLen = 255
 	rwx_rx_no               = 0o750
 	HealthzPort             = 8080
+	MaxProfileSizeBytes     = 128 * 1024 // a whole ConfigMap is capped at 1MiB
+	SignatureSuffix         = ".sig"     // detached profile signatures (see signatures.go)
 )
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tuxerrante/kapparmor/src/app/metrics"
+)
+
+// denialPollInterval is how often the collector reads new audit records.
+const denialPollInterval = time.Second
+
+// denialCollector tails the kernel audit log (audit.log, kern.log...) and turns
+// the apparmor="DENIED" records of custom profiles into the kapparmor_denials_total
+// counter and structured log lines, at most logLimit lines per profile and minute.
+type denialCollector struct {
+	cfg      *AppConfig
+	path     string
+	logLimit int
+
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64
+	partial string // last line, until its newline is written
+
+	window     time.Time
+	logged     map[string]int // log lines per profile in the current window
+	suppressed map[string]int
+}
+
+// newDenialCollector opens the audit log at its end: records written before the
+// agent started are not counted again after a restart.
+func newDenialCollector(cfg *AppConfig) (*denialCollector, error) {
+	logLimit, err := strconv.Atoi(cfg.DenialLogLimitArg)
+	if err != nil || logLimit < 0 {
+		return nil, fmt.Errorf("invalid DENIAL_LOG_LIMIT %q", cfg.DenialLogLimitArg)
+	}
+
+	c := &denialCollector{
+		cfg:        cfg,
+		path:       cfg.DenialLogPath,
+		logLimit:   logLimit,
+		logged:     map[string]int{},
+		suppressed: map[string]int{},
+	}
+
+	if err := c.open(io.SeekEnd); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *denialCollector) open(whence int) error {
+	file, err := os.Open(c.path) // #nosec G304 -- operator-configured DENIAL_LOG_PATH
+	if err != nil {
+		return fmt.Errorf("opening the denial log: %w", err)
+	}
+
+	offset, err := file.Seek(0, whence)
+	if err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	c.file, c.reader, c.offset, c.partial = file, bufio.NewReader(file), offset, ""
+
+	return nil
+}
+
+// run reads new records until ctx is canceled.
+func (c *denialCollector) run(ctx context.Context) {
+	logger := c.cfg.Logger
+	logger.Info("Collecting AppArmor denials", slog.String("path", c.path))
+
+	ticks, stop := c.cfg.clock().NewTicker(denialPollInterval)
+	defer stop()
+
+	defer func() { _ = c.file.Close() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+			if err := c.poll(); err != nil {
+				logger.Error("reading the denial log failed", slog.String("path", c.path), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// poll reads the records appended since the last call. A rotated or truncated
+// file is reopened from its beginning.
+func (c *denialCollector) poll() error {
+	c.rotateWindow()
+
+	if err := c.reopenIfRotated(); err != nil {
+		return err
+	}
+
+	for {
+		chunk, err := c.reader.ReadString('\n')
+		c.offset += int64(len(chunk))
+
+		if errors.Is(err, io.EOF) {
+			c.partial += chunk
+
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		c.handle(c.partial + chunk)
+		c.partial = ""
+	}
+}
+
+func (c *denialCollector) reopenIfRotated() error {
+	current, err := c.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	latest, err := os.Stat(c.path)
+	if err != nil {
+		// The new file is not created yet: keep reading the old one.
+		return nil //nolint:nilerr
+	}
+
+	if os.SameFile(current, latest) && latest.Size() >= c.offset {
+		return nil
+	}
+
+	_ = c.file.Close()
+
+	return c.open(io.SeekStart)
+}
+
+// handle counts and logs one audit record. Child profiles and hats are counted
+// under their custom profile.
+func (c *denialCollector) handle(line string) {
+	fields := parseAuditFields(line)
+	if fields["apparmor"] != "DENIED" {
+		return
+	}
+
+	profile, _, _ := strings.Cut(fields["profile"], "//")
+	if !strings.HasPrefix(profile, ProfileNamePrefix) {
+		return
+	}
+
+	class := fields["class"]
+	if class == "" {
+		class = "unknown"
+	}
+
+	metrics.DenialObserved(profile, fields["operation"], class)
+
+	if !c.allowLog(profile) {
+		return
+	}
+
+	c.cfg.Logger.Warn("AppArmor denial",
+		slog.String("profile", fields["profile"]),
+		slog.String("operation", fields["operation"]),
+		slog.String("class", class),
+		slog.String("name", fields["name"]),
+		slog.String("requested_mask", fields["requested_mask"]),
+		slog.String("comm", fields["comm"]),
+		slog.String("pid", fields["pid"]))
+}
+
+// rotateWindow starts a new log limit window every minute and logs the number
+// of lines suppressed in the previous one.
+func (c *denialCollector) rotateWindow() {
+	now := c.cfg.clock().Now()
+	if now.Sub(c.window) < time.Minute {
+		return
+	}
+
+	for profile, count := range c.suppressed {
+		c.cfg.Logger.Warn("AppArmor denial logs suppressed",
+			slog.String("profile", profile),
+			slog.Int("count", count))
+	}
+
+	c.window = now
+	clear(c.logged)
+	clear(c.suppressed)
+}
+
+// allowLog applies the per profile log limit.
+func (c *denialCollector) allowLog(profile string) bool {
+	c.rotateWindow()
+
+	if c.logged[profile] >= c.logLimit {
+		c.suppressed[profile]++
+
+		return false
+	}
+
+	c.logged[profile]++
+
+	return true
+}
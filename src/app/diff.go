@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// diffContextRules is the number of unchanged rules shown around each change.
+	diffContextRules = 3
+	// diffMaxCells bounds the LCS table of diffOps (8 bytes per cell, 32MiB):
+	// beyond it, the changed rules are shown as removed then added.
+	diffMaxCells = 4 << 20
+)
+
+// runDiff previews what the node agent would do on a node: the profiles it would
+// load, replace, remove and block, and a rule-aware unified diff of each replacement.
+// The installed files carry the profile policy and the templates of the node, so
+// the proposed profiles are rendered the same way before they are compared.
+//
+//	kapparmor diff [-installed dir] [-kernel file] [-configmap name] [-required-includes list] [-policy-snippet file]
+//	    [-template-vars dir] <directory|manifest.yaml>
+func runDiff(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	installed := flags.String("installed", "/etc/apparmor.d/custom", "directory of the profiles installed on the node")
+	kernel := flags.String("kernel", "/sys/kernel/security/apparmor/profiles", "profiles loaded in the kernel, in the apparmorfs format")
+	configMap := flags.String("configmap", "kapparmor-profiles", "name of the profiles ConfigMap in manifest files")
+	requiredIncludes := flags.String("required-includes", "", "comma separated includes required in every profile, as PROFILE_REQUIRED_INCLUDES")
+	policySnippet := flags.String("policy-snippet", "", "file of the snippet injected in every profile, as PROFILE_POLICY_SNIPPET")
+	templateVars := flags.String("template-vars", "", "render the profiles as templates with the variables of this directory, as PROFILE_TEMPLATE_VARS")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: kapparmor diff [-installed dir] [-kernel file] [-configmap name] " +
+			"[-required-includes list] [-policy-snippet file] [-template-vars dir] <directory|manifest.yaml>")
+	}
+
+	sources, err := loadProfileSources(flags.Arg(0), *configMap)
+	if err != nil {
+		return err
+	}
+
+	if len(sources) != 1 {
+		return fmt.Errorf("%s: %d ConfigMaps match, select one with -configmap", flags.Arg(0), len(sources))
+	}
+
+	// calculateProfileChanges reads the proposed profiles from a directory, as mounted on the node.
+	proposedDir, err := os.MkdirTemp("", "kapparmor-diff-")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.RemoveAll(proposedDir) }()
+
+	proposed := map[string]bool{}
+
+	for name, data := range sources[0].profiles {
+		if !isProfileEntry(name) {
+			continue
+		}
+
+		if ok, err := isValidFilename(name); !ok {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		if err := os.WriteFile(filepath.Join(proposedDir, name), data, 0o600); err != nil {
+			return err
+		}
+
+		proposed[name] = true
+	}
+
+	ctx := contextWithLogger(context.Background(), slog.New(slog.DiscardHandler))
+
+	_, loaded, err := getProfilesNamesFromFile(ctx, hostFileSystem{}, *kernel, ProfileNamePrefix)
+	if err != nil {
+		return err
+	}
+
+	cfg := &AppConfig{
+		ConfigmapPath:     proposedDir,
+		EtcApparmord:      *installed,
+		History:           newReconcileHistory(),
+		RequiredIncludes:  *requiredIncludes,
+		PolicySnippetPath: *policySnippet,
+		TemplatesEnabled:  *templateVars != "",
+		TemplateVarsPath:  *templateVars,
+	}
+
+	if err := loadClusterRendering(ctx, cfg); err != nil {
+		return err
+	}
+
+	toApply, toUnload, err := calculateProfileChanges(ctx, cfg, proposed, loaded)
+	if err != nil {
+		return err
+	}
+
+	var added, replaced, blocked []string
+
+	for name := range proposed {
+		if cfg.History.profile(name).blockedReason != "" {
+			blocked = append(blocked, name)
+		}
+	}
+
+	for _, profilePath := range toApply {
+		name := filepath.Base(profilePath)
+		if loaded[name] {
+			replaced = append(replaced, name)
+		} else {
+			added = append(added, name)
+		}
+	}
+
+	slices.Sort(added)
+	slices.Sort(replaced)
+	slices.Sort(toUnload)
+	slices.Sort(blocked)
+
+	for _, list := range []struct {
+		title string
+		names []string
+	}{{"load", added}, {"replace", replaced}, {"remove", toUnload}, {"block", blocked}} {
+		if _, err := fmt.Fprintf(stdout, "Profiles to %s: %s\n", list.title, strings.Join(list.names, " ")); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range blocked {
+		if _, err := fmt.Fprintf(stdout, "%s: %s\n", name, cfg.History.profile(name).blockedReason); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range replaced {
+		before, err := readProfileBytes(cfg.filesystem(), nil, *installed, name)
+		if err != nil {
+			return err
+		}
+
+		after, err := renderProfile(ctx, cfg, name, sources[0].profiles[name])
+		if err != nil {
+			return err
+		}
+
+		diff := unifiedDiff(profileRules(before), profileRules(after),
+			filepath.Join(*installed, name), sources[0].source+"/"+name)
+		if diff == "" {
+			diff = fmt.Sprintf("%s: formatting or comment changes only\n", name)
+		}
+
+		if _, err := fmt.Fprint(stdout, "\n"+diff); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// profileRules normalizes a profile for diffing: one rule per line, without
+// comments, blank lines and indentation, so only policy changes show up.
+// "#include" lines are directives, not comments, and are kept.
+func profileRules(data []byte) []string {
+	var rules []string
+
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#include") {
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = strings.TrimSpace(line[:i])
+			}
+		}
+
+		if line != "" {
+			rules = append(rules, strings.Join(strings.Fields(line), " "))
+		}
+	}
+
+	return rules
+}
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// unifiedDiff returns the unified diff of a and b, empty when they are equal.
+// Hunk positions count normalized rules, not file lines.
+func unifiedDiff(a, b []string, nameA, nameB string) string {
+	ops := diffOps(a, b)
+	if !slices.ContainsFunc(ops, func(op diffOp) bool { return op.kind != ' ' }) {
+		return ""
+	}
+
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+
+	// lineA and lineB are the 1-based positions in a and b of ops[i].
+	for i, lineA, lineB := 0, 1, 1; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i, lineA, lineB = i+1, lineA+1, lineB+1
+
+			continue
+		}
+
+		// Extend the hunk while changes are closer than twice the context.
+		start := max(0, i-diffContextRules)
+		end := i
+
+		for end < len(ops) {
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+
+			if next == len(ops) || next-end > 2*diffContextRules {
+				break
+			}
+
+			for next < len(ops) && ops[next].kind != ' ' {
+				next++
+			}
+
+			end = next
+		}
+
+		end = min(len(ops), end+diffContextRules)
+
+		hunkA, hunkB := lineA-(i-start), lineB-(i-start)
+		countA, countB := 0, 0
+
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				countA++
+			}
+
+			if op.kind != '-' {
+				countB++
+			}
+		}
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", hunkA, countA, hunkB, countB)
+
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", op.kind, op.text)
+		}
+
+		for _, op := range ops[i:end] {
+			if op.kind != '+' {
+				lineA++
+			}
+
+			if op.kind != '-' {
+				lineB++
+			}
+		}
+
+		i = end
+	}
+
+	return out.String()
+}
+
+// diffOps returns the edit script from a to b along a longest common subsequence
+// of the rules between their common prefix and suffix.
+func diffOps(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, rule := range a[:prefix] {
+		ops = append(ops, diffOp{' ', rule})
+	}
+
+	ops = append(ops, lcsOps(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+
+	for _, rule := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', rule})
+	}
+
+	return ops
+}
+
+// lcsOps returns the edit script from a to b along a longest common subsequence,
+// or removes a and adds b when the table would exceed diffMaxCells.
+func lcsOps(a, b []string) []diffOp {
+	ops := make([]diffOp, 0, len(a)+len(b))
+
+	if (len(a)+1)*(len(b)+1) > diffMaxCells {
+		for _, rule := range a {
+			ops = append(ops, diffOp{'-', rule})
+		}
+
+		for _, rule := range b {
+			ops = append(ops, diffOp{'+', rule})
+		}
+
+		return ops
+	}
+
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+
+	return ops
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -16,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // isSafePath checks for path traversal and absolute path issues.
@@ -69,8 +71,8 @@ func preFlightChecks(cfg *AppConfig) (pollTime int, cleanup func(), err error) {
 			MaxAllowedPollingTime)
 	}
 
-	// Check profiler binary (support /usr/sbin and /sbin)
-	if _, err := os.Stat(cfg.ProfilerFullPath); os.IsNotExist(err) {
+	// Check profiler binary (support /usr/sbin and /sbin), unless a loader is injected
+	if _, err := os.Stat(cfg.ProfilerFullPath); cfg.Loader == nil && os.IsNotExist(err) {
 		candidates := []string{"/usr/sbin/" + ProfilerBin, "/sbin/" + ProfilerBin}
 
 		var found string
@@ -112,28 +114,28 @@ func preFlightChecks(cfg *AppConfig) (pollTime int, cleanup func(), err error) {
 
 // HasTheSameContent compares the byte content of two given files.
 // It supports both local filesystem (nil fsys) and virtual fs.FS systems.
-func HasTheSameContent(fsys fs.FS, filePath1, filePath2 string) (bool, error) {
+func HasTheSameContent(ctx context.Context, fsys fs.FS, filePath1, filePath2 string) (bool, error) {
 	if fsys == nil {
-		return compareLocalFiles(filePath1, filePath2)
+		return compareLocalFiles(ctx, filePath1, filePath2)
 	}
 
-	return compareFSFiles(fsys, filePath1, filePath2)
+	return compareFSFiles(ctx, fsys, filePath1, filePath2)
 }
 
-func compareLocalFiles(filePath1, filePath2 string) (bool, error) {
+func compareLocalFiles(ctx context.Context, filePath1, filePath2 string) (bool, error) {
 	if !isSafePath(filePath1) || !isSafePath(filePath2) {
 		return false, errors.New("unsafe file path detected")
 	}
 
 	fileBytes1, err := os.ReadFile(filePath1) // #nosec G304 -- path validated
 	if err != nil {
-		slog.Default().Error("read file error", slog.Any("error", err))
+		loggerFromContext(ctx).Error("read file error", slog.Any("error", err))
 		os.Exit(1)
 	}
 
 	fileBytes2, err := os.ReadFile(filePath2) // #nosec G304 -- path validated
 	if err != nil {
-		slog.Default().Error("read file error", slog.Any("error", err))
+		loggerFromContext(ctx).Error("read file error", slog.Any("error", err))
 		os.Exit(1)
 	}
 
@@ -143,10 +145,10 @@ func compareLocalFiles(filePath1, filePath2 string) (bool, error) {
 	return bytes.Equal(trimmedBytes1, trimmedBytes2), nil
 }
 
-func compareFSFiles(fsys fs.FS, filePath1, filePath2 string) (bool, error) {
+func compareFSFiles(ctx context.Context, fsys fs.FS, filePath1, filePath2 string) (bool, error) {
 	dir, err := fs.ReadDir(fsys, ".")
 	if err != nil {
-		slog.Default().Error("ERROR opening directory", slog.Any("fs", fsys))
+		loggerFromContext(ctx).Error("ERROR opening directory", slog.Any("fs", fsys))
 
 		return false, err
 	}
@@ -170,13 +172,13 @@ func compareFSFiles(fsys fs.FS, filePath1, filePath2 string) (bool, error) {
 		return false, nil
 	}
 
-	f1, err := openFSFileSafely(fsys, f1Info.Name(), "file1")
+	f1, err := openFSFileSafely(ctx, fsys, f1Info.Name(), "file1")
 	if err != nil {
 		return false, err
 	}
 	defer f1.Close()
 
-	f2, err := openFSFileSafely(fsys, f2Info.Name(), "file2")
+	f2, err := openFSFileSafely(ctx, fsys, f2Info.Name(), "file2")
 	if err != nil {
 		return false, err
 	}
@@ -185,10 +187,10 @@ func compareFSFiles(fsys fs.FS, filePath1, filePath2 string) (bool, error) {
 	return compareBytes(f1, f2)
 }
 
-func openFSFileSafely(fsys fs.FS, name, label string) (fs.File, error) {
+func openFSFileSafely(ctx context.Context, fsys fs.FS, name, label string) (fs.File, error) {
 	f, err := fsys.Open(name)
 	if err != nil {
-		slog.Default().Error("open file error", slog.String("label", label), slog.Any("error", err))
+		loggerFromContext(ctx).Error("open file error", slog.String("label", label), slog.Any("error", err))
 
 		return nil, err
 	}
@@ -215,7 +217,8 @@ func compareBytes(f1, f2 fs.File) (bool, error) {
 }
 
 // areProfilesReadable checks if all files in the given folder are readable AppArmor profiles.
-func areProfilesReadable(cfg *AppConfig) (bool, map[string]bool) {
+func areProfilesReadable(ctx context.Context, cfg *AppConfig) (bool, map[string]bool) {
+	logger := loggerFromContext(ctx)
 	folderName := cfg.ConfigmapPath
 	filenames := map[string]bool{}
 
@@ -229,33 +232,37 @@ func areProfilesReadable(cfg *AppConfig) (bool, map[string]bool) {
 	}
 
 	if err != nil {
-		slog.Default().Error("readdir error", slog.Any("error", err))
+		logger.Error("readdir error", slog.Any("error", err))
 		os.Exit(1)
 	}
 
 	if len(files) == 0 {
-		slog.Default().Info("No files were found in the given folder")
+		logger.Info("No files were found in the given folder")
 
 		return false, nil
 	}
 
-	slog.Default().Info("Found files", slog.String("dir", folderName))
+	logger.Info("Found files", slog.String("dir", folderName))
 
 	for _, file := range files {
 		filename := file.Name()
 		if file.IsDir() {
-			slog.Default().Info("Directory will be skipped", slog.String("name", filename))
+			logger.Info("Directory will be skipped", slog.String("name", filename))
 
 			continue
 		} else if strings.HasPrefix(filename, ".") {
-			slog.Default().Info("Hidden file will be skipped", slog.String("name", filename))
+			logger.Info("Hidden file will be skipped", slog.String("name", filename))
+
+			continue
+		} else if !isProfileEntry(filename) {
+			logger.Info("Signature file will be skipped", slog.String("name", filename))
 
 			continue
 		}
 
-		err := IsProfileNameCorrect(folderName, filename)
+		err := IsProfileNameCorrect(ctx, folderName, filename)
 		if err != nil {
-			slog.Default().Error(
+			logger.Error(
 				"Found a file issue",
 				slog.String("folder", folderName),
 				slog.String("filename", filename),
@@ -263,7 +270,7 @@ func areProfilesReadable(cfg *AppConfig) (bool, map[string]bool) {
 			os.Exit(1)
 		}
 
-		slog.Default().Info("profile candidate", slog.String("name", filename))
+		logger.Info("profile candidate", slog.String("name", filename))
 
 		filenames[filename] = true
 	}
@@ -271,21 +278,42 @@ func areProfilesReadable(cfg *AppConfig) (bool, map[string]bool) {
 	return true, filenames
 }
 
+// isProfileEntry reports whether a ConfigMap key or file holds a profile:
+// hidden files and detached signatures do not.
+func isProfileEntry(name string) bool {
+	return !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, SignatureSuffix)
+}
+
 // IsProfileNameCorrect ensures that the filename matches the AppArmor profile name defined in the file.
-func IsProfileNameCorrect(directory, filename string) error {
+func IsProfileNameCorrect(ctx context.Context, directory, filename string) error {
 	// Validate inputs and file presence
 	profilePath, err := validateProfileInputs(directory, filename)
 	if err != nil {
 		return err
 	}
 
+	fileBytes, err := os.ReadFile(profilePath) // #nosec G304 -- validated path
+	if err != nil {
+		return err
+	}
+
+	return validateProfileContent(ctx, filename, fileBytes)
+}
+
+// validateProfileContent runs the content checks shared by the node agent and the
+// admission webhooks: size limit, syntax, declared name and lint rules.
+func validateProfileContent(ctx context.Context, filename string, data []byte) error {
+	if len(data) > MaxProfileSizeBytes {
+		return fmt.Errorf("profile '%s' is %d bytes long, the limit is %d bytes", filename, len(data), MaxProfileSizeBytes)
+	}
+
 	// Ensure syntax has "profile" before "{"
-	if err := validateProfileSyntax(profilePath); err != nil {
+	if err := validateProfileSyntax(data); err != nil {
 		return err
 	}
 
 	// Extract the declared profile name
-	fileProfileName, err := extractProfileName(profilePath)
+	fileProfileName, err := extractProfileName(ctx, data)
 	if err != nil {
 		return err
 	}
@@ -295,7 +323,7 @@ func IsProfileNameCorrect(directory, filename string) error {
 		return fmt.Errorf("filename '%s' and profile name '%s' seems to be different", filename, fileProfileName)
 	}
 
-	return nil
+	return lintProfile(data)
 }
 
 // --- helper functions below ---
@@ -323,15 +351,10 @@ func validateProfileInputs(directory, filename string) (string, error) {
 }
 
 // validateProfileSyntax ensures "profile" appears before the opening '{'.
-func validateProfileSyntax(profilePath string) error {
-	fileBytes, err := os.ReadFile(profilePath) // #nosec G304 -- validated path
-	if err != nil {
-		return err
-	}
-
-	profileIndex := bytes.Index(fileBytes, []byte("profile"))
+func validateProfileSyntax(data []byte) error {
+	profileIndex := bytes.Index(data, []byte("profile"))
 
-	curlyIndex := bytes.Index(fileBytes, []byte("{"))
+	curlyIndex := bytes.Index(data, []byte("{"))
 
 	if curlyIndex < 0 || curlyIndex < profileIndex {
 		return errors.New("couldn't find a { after 'profile' keyword")
@@ -340,23 +363,11 @@ func validateProfileSyntax(profilePath string) error {
 	return nil
 }
 
-// extractProfileName scans the file and returns the declared profile name.
-func extractProfileName(profilePath string) (string, error) {
+// extractProfileName scans the profile and returns the declared profile name.
+func extractProfileName(ctx context.Context, data []byte) (string, error) {
 	const minTokensExpectedInProfileNameLine = 2
 
-	f, err := os.Open(profilePath) // #nosec G304 -- validated path
-	if err != nil {
-		return "", err
-	}
-
-	defer func() {
-		cerr := f.Close()
-		if cerr != nil {
-			slog.Default().Warn("error closing fileReader", slog.Any("error", cerr))
-		}
-	}()
-
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		// Only lines that begin with "profile "
@@ -370,7 +381,7 @@ func extractProfileName(profilePath string) (string, error) {
 		}
 
 		name := strings.TrimSpace(tokens[1])
-		slog.Default().Info("Found profile name", slog.String("name", name))
+		loggerFromContext(ctx).Info("Found profile name", slog.String("name", name))
 
 		return name, nil
 	}
@@ -385,6 +396,38 @@ func extractProfileName(profilePath string) (string, error) {
 	)
 }
 
+// lintProfile rejects content that apparmor_parser would choke on or that has
+// no business in a policy file: invalid UTF-8, NUL bytes and unbalanced braces.
+// Comments are ignored when counting braces.
+func lintProfile(data []byte) error {
+	if !utf8.Valid(data) {
+		return errors.New("profile is not valid UTF-8")
+	}
+
+	if bytes.IndexByte(data, 0) >= 0 {
+		return errors.New("profile contains NUL bytes")
+	}
+
+	depth := 0
+
+	for lineNumber, line := range bytes.Split(data, []byte("\n")) {
+		if i := bytes.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		depth += bytes.Count(line, []byte("{")) - bytes.Count(line, []byte("}"))
+		if depth < 0 {
+			return fmt.Errorf("unexpected '}' at line %d", lineNumber+1)
+		}
+	}
+
+	if depth != 0 {
+		return fmt.Errorf("%d unclosed '{' at end of profile", depth)
+	}
+
+	return nil
+}
+
 func isValidPath(path string) (bool, error) {
 	if len(path) == 0 {
 		return false, errors.New("empty directory name")
@@ -478,14 +521,15 @@ func isCharInSlice(char rune, slice []rune) bool {
 // the same, then return success. Otherwise, attempt to create a hard link
 // between the two files. If that fail, copy the file contents from src to dst.
 // Credits: https://stackoverflow.com/a/21067803/3673430
-func CopyFile(src, dst string) error {
+func CopyFile(ctx context.Context, fsys FileSystem, src, dst string) error {
+	logger := loggerFromContext(ctx)
 	// dst is the destination directory
 	srcFileName := filepath.Base(src)
 	dstCompleteFileName := path.Join(dst, srcFileName)
 
-	sfi, err := os.Stat(src)
+	sfi, err := fsys.Stat(src)
 	if err != nil {
-		slog.Default().Error("stat src error", slog.Any("error", err))
+		logger.Error("stat src error", slog.Any("error", err))
 		os.Exit(1)
 	}
 
@@ -494,46 +538,48 @@ func CopyFile(src, dst string) error {
 		return fmt.Errorf("CopyFile: non-regular source file %s (%q)", sfi.Name(), sfi.Mode().String())
 	}
 
-	dfi, err := os.Stat(dstCompleteFileName)
+	dfi, err := fsys.Stat(dstCompleteFileName)
 	if err != nil {
-		slog.Default().Warn("stat dst error", slog.Any("error", err))
+		logger.Warn("stat dst error", slog.Any("error", err))
 	} else {
 		if !(dfi.Mode().IsRegular()) {
 			return fmt.Errorf("CopyFile: non-regular destination file %s (%q)", dfi.Name(), dfi.Mode().String())
 		}
 
 		if os.SameFile(sfi, dfi) {
-			slog.Default().Info("File already present", slog.String("path", dstCompleteFileName))
+			logger.Info("File already present", slog.String("path", dstCompleteFileName))
 
 			return nil
 		}
 	}
 
-	if err = os.Link(src, dstCompleteFileName); err == nil {
-		slog.Default().Info("Hard link created", slog.String("path", dstCompleteFileName))
+	if err = fsys.Link(src, dstCompleteFileName); err == nil {
+		logger.Info("Hard link created", slog.String("path", dstCompleteFileName))
 
 		return nil
 	}
 
-	slog.Default().Info("Copying file", slog.String("src", src), slog.String("dst", dstCompleteFileName))
+	logger.Info("Copying file", slog.String("src", src), slog.String("dst", dstCompleteFileName))
 
-	return copyFileContents(src, dstCompleteFileName)
+	return copyFileContents(ctx, fsys, src, dstCompleteFileName)
 }
 
 // copyFileContents copies the contents of the file named src to the file named
 // by dst. The file will be created if it does not already exist. If the
 // destination file exists, all it's contents will be replaced by the contents
 // of the source file.
-func copyFileContents(src, dst string) (err error) {
+func copyFileContents(ctx context.Context, fsys FileSystem, src, dst string) (err error) {
+	logger := loggerFromContext(ctx)
+
 	if !isSafePath(src) || !isSafePath(dst) {
-		slog.Default().Warn("unsafe file path detected in copyFileContents")
+		logger.Warn("unsafe file path detected in copyFileContents")
 
 		return errors.New("unsafe file path detected")
 	}
 
-	in, err := os.Open(src) // #nosec G304 -- path validated by isSafePath
+	in, err := fsys.Open(src)
 	if err != nil {
-		slog.Default().Error("open src error", slog.Any("error", err))
+		logger.Error("open src error", slog.Any("error", err))
 
 		return err
 	}
@@ -541,13 +587,13 @@ func copyFileContents(src, dst string) (err error) {
 	defer func() {
 		err := in.Close()
 		if err != nil {
-			slog.Default().Warn("error closing input file", slog.Any("error", err))
+			logger.Warn("error closing input file", slog.Any("error", err))
 		}
 	}()
 
-	out, err := os.Create(dst) // #nosec G304 -- path validated by isSafePath
+	out, err := fsys.Create(dst)
 	if err != nil {
-		slog.Default().Error("create dst error", slog.Any("error", err))
+		logger.Error("create dst error", slog.Any("error", err))
 
 		return err
 	}
@@ -560,12 +606,14 @@ func copyFileContents(src, dst string) (err error) {
 	}()
 
 	if _, err = io.Copy(out, in); err != nil {
-		slog.Default().Error("copy error", slog.Any("error", err))
+		logger.Error("copy error", slog.Any("error", err))
 
 		return err
 	}
 
-	err = out.Sync()
+	if syncer, ok := out.(interface{ Sync() error }); ok {
+		err = syncer.Sync()
+	}
 
 	return err
 }
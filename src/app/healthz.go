@@ -1,56 +1,118 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func startHealthzServer(cfg *AppConfig) {
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	})
-
-	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-		_, desired := getNewProfiles(cfg)
-		_, loaded, _ := getLoadedProfiles(cfg)
-
-		inSync := true
-
-		if len(desired) == len(loaded) {
-			for profile := range desired {
-				if !loaded[profile] {
-					inSync = false
-
-					break
-				}
-			}
-
-			if inSync {
-				w.WriteHeader(http.StatusOK)
-				w.Write([]byte("READY"))
-			} else {
-				w.WriteHeader(http.StatusServiceUnavailable)
-				w.Write([]byte("NOT_READY"))
-			}
+// newAgentServer builds the node agent HTTP server (probes, /status and /metrics) from cfg.
+func newAgentServer(cfg *AppConfig) (*http.Server, error) {
+	const maxPort = 65535
+
+	port, err := strconv.Atoi(cfg.HTTPPort)
+	if err != nil || port < 1 || port > maxPort {
+		return nil, fmt.Errorf("invalid HTTP_PORT %q", cfg.HTTPPort)
+	}
+
+	readTimeout, err := strconv.Atoi(cfg.HTTPReadTimeoutArg)
+	if err != nil || readTimeout < 1 {
+		return nil, fmt.Errorf("invalid HTTP_READ_TIMEOUT %q: expected a number of seconds", cfg.HTTPReadTimeoutArg)
+	}
+
+	writeTimeout, err := strconv.Atoi(cfg.HTTPWriteTimeoutArg)
+	if err != nil || writeTimeout < 1 {
+		return nil, fmt.Errorf("invalid HTTP_WRITE_TIMEOUT %q: expected a number of seconds", cfg.HTTPWriteTimeoutArg)
+	}
+
+	var metricsHandler http.Handler = promhttp.Handler()
+
+	srv := &http.Server{
+		Addr:              net.JoinHostPort(cfg.HTTPBindAddress, cfg.HTTPPort),
+		ReadHeaderTimeout: time.Duration(readTimeout) * time.Second,
+		ReadTimeout:       time.Duration(readTimeout) * time.Second,
+		WriteTimeout:      time.Duration(writeTimeout) * time.Second,
+	}
+
+	if (cfg.HTTPTLSCert == "") != (cfg.HTTPTLSKey == "") {
+		return nil, errors.New("HTTP_TLS_CERT and HTTP_TLS_KEY must be set together")
+	}
+
+	if cfg.HTTPTLSCert != "" {
+		reloader, err := newCertReloader(cfg.HTTPTLSCert, cfg.HTTPTLSKey)
+		if err != nil {
+			return nil, err
+		}
+
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.getCertificate,
+		}
+	}
+
+	if cfg.HTTPMetricsClientCA != "" {
+		if srv.TLSConfig == nil {
+			return nil, errors.New("HTTP_METRICS_CLIENT_CA requires HTTP_TLS_CERT and HTTP_TLS_KEY")
+		}
+
+		pool, err := loadCertPool(cfg.HTTPMetricsClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("metrics client CA: %w", err)
 		}
-	})
 
-	http.Handle("/metrics", promhttp.Handler())
+		// Probes come without a client certificate: only /metrics requires one.
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		metricsHandler = requireClientCert(metricsHandler)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", writeHealthz)
+	mux.HandleFunc("/readyz", writeReadiness(cfg))
+	mux.HandleFunc("/status", writeStatus(cfg))
+	mux.Handle("/metrics", metricsHandler)
+	srv.Handler = mux
+
+	return srv, nil
+}
+
+// startAgentServer starts the agent HTTP server in the background.
+// Stop it with Shutdown; serving errors are logged.
+func startAgentServer(cfg *AppConfig) (*http.Server, error) {
+	srv, err := newAgentServer(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	go func() {
 		slog.Default().Info("Starting healthz server",
-			slog.Int("port", HealthzPort),
+			slog.String("addr", srv.Addr),
+			slog.Bool("tls", srv.TLSConfig != nil),
+			slog.Bool("metrics_mtls", cfg.HTTPMetricsClientCA != ""),
 			slog.String("health_endpoint", "/healthz"),
 			slog.String("ready_endpoint", "/readyz"),
+			slog.String("status_endpoint", "/status"),
 			slog.String("metrics_endpoint", "/metrics"),
 		)
 
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", HealthzPort), nil); err != nil {
-			slog.Default().Error("Healthz server failed", slog.Any("error", err))
+		var serveErr error
+		if srv.TLSConfig != nil {
+			serveErr = srv.ListenAndServeTLS("", "")
+		} else {
+			serveErr = srv.ListenAndServe()
+		}
+
+		if !errors.Is(serveErr, http.ErrServerClosed) {
+			slog.Default().Error("Healthz server failed", slog.Any("error", serveErr))
 		}
 	}()
+
+	return srv, nil
 }
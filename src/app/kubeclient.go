@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir is where the kubelet projects the pod service account credentials.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal Kubernetes API client built on net/http.
+// It only covers the few calls kapparmor needs, so the agent does not pull in client-go.
+type kubeClient struct {
+	baseURL   string
+	tokenFile string // re-read on every call: bound tokens are rotated by the kubelet
+	http      *http.Client
+}
+
+// kubeAPIError is returned for non-2xx answers of the API server.
+type kubeAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *kubeAPIError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %d: %s", e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// newInClusterKubeClient configures a client from the pod service account.
+func newInClusterKubeClient() (*kubeClient, error) {
+	const timeout = 10 * time.Second
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is unset")
+	}
+
+	caPEM, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no valid certificate found in the service account CA")
+	}
+
+	return &kubeClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		http: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+			},
+		},
+	}, nil
+}
+
+// do sends in (JSON encoded, when not nil) to apiPath and decodes the answer into out (when not nil).
+func (c *kubeClient) do(ctx context.Context, method, apiPath, contentType string, in, out any) error {
+	var body io.Reader
+
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("encoding %s %s: %w", method, apiPath, err)
+		}
+
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+apiPath, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return fmt.Errorf("reading service account token: %w", err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, apiPath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+		return &kubeAPIError{StatusCode: resp.StatusCode, Body: string(msg)}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s %s: %w", method, apiPath, err)
+	}
+
+	return nil
+}
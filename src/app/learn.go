@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	// auditField matches the key=value and key="value" fields of kernel audit records.
+	auditField = regexp.MustCompile(`(\w+)=("[^"]*"|\S+)`)
+	// learnedNetwork matches the "family sock_type" pairs written as network rules.
+	learnedNetwork = regexp.MustCompile(`^[a-z0-9_]+ [a-z0-9_]+$`)
+	// learnedGlobChars escapes the AppArmor glob characters of a logged path.
+	learnedGlobChars = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+)
+
+// filePermissionOrder is the order of file permissions in the proposed rules.
+const filePermissionOrder = "rwlkm"
+
+// runLearn reads the AppArmor records of a profile in kernel audit logs, such as
+// /var/log/audit/audit.log or dmesg output, and prints the profile with the rules
+// needed to allow what was logged. It is meant for profiles in complain mode,
+// whose ALLOWED records list what enforce mode would deny.
+//
+//	kapparmor learn <profile file> <audit log>...
+func runLearn(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("learn", flag.ContinueOnError)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() < 2 {
+		return errors.New("usage: kapparmor learn <profile file> <audit log>...")
+	}
+
+	current, err := os.ReadFile(flags.Arg(0)) // #nosec G304 -- path given by the operator
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	name, err := extractProfileName(ctx, current)
+	if err != nil {
+		return err
+	}
+
+	learned := newLearnedRules()
+
+	for _, path := range flags.Args()[1:] {
+		if err := learned.readAuditLog(path, name); err != nil {
+			return err
+		}
+	}
+
+	updated, err := learned.apply(current)
+	if err != nil {
+		return err
+	}
+
+	if err := validateProfileEntry(ctx, name, updated); err != nil {
+		return fmt.Errorf("the updated profile does not pass validation: %w", err)
+	}
+
+	_, err = stdout.Write(updated)
+
+	return err
+}
+
+// learnedRules collects the accesses logged for one profile.
+type learnedRules struct {
+	files        map[string]string // path to requested file permissions
+	network      map[string]bool
+	capabilities map[string]bool
+	// skipped counts the records of operations without a rule proposal.
+	skipped map[string]int
+}
+
+func newLearnedRules() *learnedRules {
+	return &learnedRules{
+		files:        map[string]string{},
+		network:      map[string]bool{},
+		capabilities: map[string]bool{},
+		skipped:      map[string]int{},
+	}
+}
+
+func (l *learnedRules) readAuditLog(path, profile string) error {
+	file, err := os.Open(path) // #nosec G304 -- path given by the operator
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		l.add(profile, parseAuditFields(scanner.Text()))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for operation, count := range l.skipped {
+		slog.Default().Warn("No rule proposed for these records, add the rules by hand",
+			slog.String("operation", operation),
+			slog.Int("records", count))
+	}
+
+	clear(l.skipped)
+
+	return nil
+}
+
+// parseAuditFields returns the fields of an audit record, unquoted. The kernel
+// hex-encodes values with spaces or special characters instead of quoting them.
+func parseAuditFields(line string) map[string]string {
+	fields := map[string]string{}
+
+	for _, match := range auditField.FindAllStringSubmatch(line, -1) {
+		value := match[2]
+
+		if unquoted, found := strings.CutPrefix(value, `"`); found {
+			value = strings.TrimSuffix(unquoted, `"`)
+		} else if decoded, err := hex.DecodeString(value); (match[1] == "name" || match[1] == "comm") && err == nil {
+			value = string(decoded)
+		}
+
+		fields[match[1]] = value
+	}
+
+	return fields
+}
+
+// add records an ALLOWED or DENIED record of profile. Records of child profiles
+// and hats ("profile//child") are ignored.
+func (l *learnedRules) add(profile string, fields map[string]string) {
+	if fields["profile"] != profile || (fields["apparmor"] != "ALLOWED" && fields["apparmor"] != "DENIED") {
+		return
+	}
+
+	switch {
+	case fields["capname"] != "":
+		l.capabilities[fields["capname"]] = true
+	case fields["family"] != "" && fields["sock_type"] != "":
+		l.network[fields["family"]+" "+fields["sock_type"]] = true
+	case fields["name"] != "" && fields["requested_mask"] != "":
+		if permissions := filePermissions(fields["requested_mask"]); permissions != "" {
+			l.files[fields["name"]] = mergePermissions(l.files[fields["name"]], permissions)
+
+			return
+		}
+
+		l.skipped[fields["operation"]]++
+	default:
+		l.skipped[fields["operation"]]++
+	}
+}
+
+// filePermissions maps a requested_mask to rule permissions: appending, creating
+// and deleting files need write access, and executables are inherited (ix).
+func filePermissions(mask string) string {
+	var permissions string
+
+	for _, c := range mask {
+		switch c {
+		case 'r', 'w', 'l', 'k', 'm':
+			permissions += string(c)
+		case 'a', 'c', 'd':
+			permissions += "w"
+		case 'x':
+			permissions += "x"
+		}
+	}
+
+	return permissions
+}
+
+func mergePermissions(a, b string) string {
+	var merged string
+
+	for _, c := range filePermissionOrder + "x" {
+		if strings.ContainsRune(a, c) || strings.ContainsRune(b, c) {
+			merged += string(c)
+		}
+	}
+
+	return strings.Replace(merged, "x", "ix", 1)
+}
+
+// rules returns the proposed rules missing from existing, sorted by kind and
+// name. The logged names are literal paths, so the AppArmor glob characters in
+// them are escaped. Paths the profile syntax cannot express unquoted are quoted,
+// paths that cannot be quoted are skipped.
+func (l *learnedRules) rules(existing []string) []string {
+	var proposed []string
+
+	for _, path := range slices.Sorted(maps.Keys(l.files)) {
+		rulePath := learnedGlobChars.Replace(path)
+
+		switch {
+		case !strings.HasPrefix(path, "/") || strings.ContainsAny(path, "\"\n\x00{}#"):
+			slog.Default().Warn("Path skipped, it cannot be written in a profile", slog.String("path", path))
+
+			continue
+		case !abstractPath.MatchString(rulePath):
+			rulePath = `"` + rulePath + `"`
+		}
+
+		proposed = append(proposed, fmt.Sprintf("%s %s,", rulePath, l.files[path]))
+	}
+
+	for _, network := range slices.Sorted(maps.Keys(l.network)) {
+		if learnedNetwork.MatchString(network) {
+			proposed = append(proposed, fmt.Sprintf("network %s,", network))
+		}
+	}
+
+	for _, capability := range slices.Sorted(maps.Keys(l.capabilities)) {
+		if abstractCapability.MatchString(capability) {
+			proposed = append(proposed, fmt.Sprintf("capability %s,", capability))
+		}
+	}
+
+	return slices.DeleteFunc(proposed, func(rule string) bool { return slices.Contains(existing, rule) })
+}
+
+// apply inserts the proposed rules before the closing brace of the first
+// top-level profile block, the one named by extractProfileName.
+func (l *learnedRules) apply(profile []byte) ([]byte, error) {
+	proposed := l.rules(profileRules(profile))
+	if len(proposed) == 0 {
+		return profile, nil
+	}
+
+	blocks := profileBlocks(profile)
+	if len(blocks) == 0 {
+		return nil, errors.New("no profile block found to add the rules to")
+	}
+
+	var b strings.Builder
+
+	b.WriteString("\n  # Proposed by kapparmor learn: review before enforcing.\n")
+
+	for _, rule := range proposed {
+		b.WriteString("  " + rule + "\n")
+	}
+
+	return insertBeforeBlockEnd(profile, blocks[0], []byte(b.String())), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// leaseTimeFormat is the MicroTime layout used by coordination.k8s.io/v1 Lease fields.
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// Subset of coordination.k8s.io/v1 Lease. kapparmor stores its state in annotations.
+type leaseObject struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+}
+
+type leaseList struct {
+	Items []leaseObject `json:"items"`
+}
+
+func newLease(namespace, name string) *leaseObject {
+	return &leaseObject{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata: leaseMetadata{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      map[string]string{},
+			Annotations: map[string]string{},
+		},
+	}
+}
+
+// renewedAt parses spec.renewTime, returning the zero time when unset or invalid.
+func (l *leaseObject) renewedAt() time.Time {
+	t, err := time.Parse(leaseTimeFormat, l.Spec.RenewTime)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
+
+// isKubeStatus reports whether err is a kubeAPIError with the given HTTP status.
+func isKubeStatus(err error, status int) bool {
+	var apiErr *kubeAPIError
+
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+func leasesPath(namespace string) string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(namespace) + "/leases"
+}
+
+// getLease returns (nil, nil) when the Lease does not exist.
+func (c *kubeClient) getLease(ctx context.Context, namespace, name string) (*leaseObject, error) {
+	var lease leaseObject
+
+	err := c.do(ctx, http.MethodGet, leasesPath(namespace)+"/"+url.PathEscape(name), "", nil, &lease)
+	if isKubeStatus(err, http.StatusNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &lease, nil
+}
+
+func (c *kubeClient) createLease(ctx context.Context, lease *leaseObject) (*leaseObject, error) {
+	var created leaseObject
+	if err := c.do(ctx, http.MethodPost, leasesPath(lease.Metadata.Namespace), "application/json", lease, &created); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// updateLease replaces the Lease. The API server rejects the call with 409
+// when lease.Metadata.ResourceVersion is stale.
+func (c *kubeClient) updateLease(ctx context.Context, lease *leaseObject) (*leaseObject, error) {
+	var updated leaseObject
+
+	apiPath := leasesPath(lease.Metadata.Namespace) + "/" + url.PathEscape(lease.Metadata.Name)
+	if err := c.do(ctx, http.MethodPut, apiPath, "application/json", lease, &updated); err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+func (c *kubeClient) listLeases(ctx context.Context, namespace, labelSelector string) ([]leaseObject, error) {
+	var list leaseList
+
+	apiPath := leasesPath(namespace) + "?labelSelector=" + url.QueryEscape(labelSelector)
+	if err := c.do(ctx, http.MethodGet, apiPath, "", nil, &list); err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+func configMapPath(namespace, name string) string {
+	return "/api/v1/namespaces/" + url.PathEscape(namespace) + "/configmaps/" + url.PathEscape(name)
+}
+
+// getConfigMap returns (nil, nil) when the ConfigMap does not exist.
+func (c *kubeClient) getConfigMap(ctx context.Context, namespace, name string) (*configMapObject, error) {
+	var cm configMapObject
+
+	err := c.do(ctx, http.MethodGet, configMapPath(namespace, name), "", nil, &cm)
+	if isKubeStatus(err, http.StatusNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &cm, nil
+}
+
+// updateConfigMap replaces the ConfigMap, failing with 409 when its resourceVersion is stale.
+func (c *kubeClient) updateConfigMap(ctx context.Context, cm *configMapObject) error {
+	return c.do(ctx, http.MethodPut, configMapPath(cm.Metadata.Namespace, cm.Metadata.Name), "application/json", cm, nil)
+}
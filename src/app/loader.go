@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// ProfileLoader runs apparmor_parser. Tests inject a fake through AppConfig.Loader.
+type ProfileLoader interface {
+	// Run executes apparmor_parser with args and returns its standard output and error.
+	Run(ctx context.Context, args ...string) (stdout, stderr []byte, err error)
+}
+
+// execProfileLoader runs the apparmor_parser binary found by preFlightChecks.
+type execProfileLoader struct {
+	binary string
+}
+
+func (l execProfileLoader) Run(ctx context.Context, args ...string) (stdout, stderr []byte, err error) {
+	cmd := exec.CommandContext(ctx, l.binary, args...) // #nosec G204 -- profilename validated before
+	errBuf := &bytes.Buffer{}
+	cmd.Stderr = errBuf
+
+	stdout, err = cmd.Output()
+
+	return stdout, errBuf.Bytes(), err
+}
+
+// loader returns the injected ProfileLoader, or one running cfg.ProfilerFullPath.
+func (cfg *AppConfig) loader() ProfileLoader {
+	if cfg.Loader != nil {
+		return cfg.Loader
+	}
+
+	return execProfileLoader{binary: cfg.ProfilerFullPath}
+}
+
+// FileSystem is the host file access by path: the kernel profile list, the copy
+// of the profiles into EtcApparmord, and the profile files when no os.Root is
+// open (see readProfileBytes). Tests inject a fake through AppConfig.FS.
+type FileSystem interface {
+	Open(name string) (fs.File, error)
+	Stat(name string) (fs.FileInfo, error)
+	Create(name string) (io.WriteCloser, error)
+	Link(oldname, newname string) error
+}
+
+type hostFileSystem struct{}
+
+func (hostFileSystem) Open(name string) (fs.File, error) {
+	return os.Open(name) // #nosec G304 -- callers pass configured paths and validated names
+}
+
+func (hostFileSystem) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (hostFileSystem) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name) // #nosec G304 -- callers pass configured paths and validated names
+}
+
+func (hostFileSystem) Link(oldname, newname string) error { return os.Link(oldname, newname) }
+
+// filesystem returns the injected FileSystem, or the host one.
+func (cfg *AppConfig) filesystem() FileSystem {
+	if cfg.FS != nil {
+		return cfg.FS
+	}
+
+	return hostFileSystem{}
+}
+
+// readFile reads the whole file name of fsys.
+func readFile(fsys FileSystem, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	return io.ReadAll(f)
+}
+
+// Clock abstracts time for the poller, the status history, the reporters and the
+// aggregator. Tests inject a fake through AppConfig.Clock.
+type Clock interface {
+	Now() time.Time
+	// NewTicker returns a channel receiving a tick every d and a function stopping it.
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+
+	return ticker.C, ticker.Stop
+}
+
+// clock returns the injected Clock, or the system clock.
+func (cfg *AppConfig) clock() Clock {
+	if cfg.Clock != nil {
+		return cfg.Clock
+	}
+
+	return systemClock{}
+}
@@ -1,15 +1,87 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
 )
 
-// newDefaultLogger returns a sane default slog logger used across the app.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// newDefaultLogger returns the app logger configured by LOG_FORMAT (text, json) and
+// LOG_LEVEL (debug, info, warn, error). Invalid values fall back to text at Info level.
 func newDefaultLogger() *slog.Logger {
-	return slog.New(
-		slog.NewTextHandler(
-			os.Stdout,
-			&slog.HandlerOptions{Level: slog.LevelInfo, ReplaceAttr: nil, AddSource: false},
-		))
+	format := getEnvOrDefault("LOG_FORMAT", logFormatText)
+	level := getEnvOrDefault("LOG_LEVEL", "info")
+
+	logger, err := newLogger(os.Stdout, format, level)
+	if err != nil {
+		logger, _ = newLogger(os.Stdout, logFormatText, "info")
+		logger.Warn("Invalid logging settings, using text at info level",
+			slog.String("LOG_FORMAT", format),
+			slog.String("LOG_LEVEL", level),
+			slog.Any("error", err))
+	}
+
+	return logger
+}
+
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: nil, AddSource: false}
+
+	switch strings.ToLower(format) {
+	case logFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("LOG_FORMAT %q: must be %s or %s", format, logFormatText, logFormatJSON)
+	}
+}
+
+type loggerContextKey struct{}
+
+// contextWithLogger returns a copy of ctx carrying logger.
+func contextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// loggerFromContext returns the logger carried by ctx, or the default logger.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// withReconcileID attaches a new reconcile_id to every record logged through the returned context.
+func withReconcileID(ctx context.Context) context.Context {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id) // never fails, see crypto/rand.Read
+
+	return contextWithLogger(ctx, loggerFromContext(ctx).With(slog.String("reconcile_id", hex.EncodeToString(id))))
+}
+
+// A line separator to simplify reading text logs; JSON logs are meant for machines and skip it.
+func printLogSeparator(ctx context.Context) {
+	logger := loggerFromContext(ctx)
+	if _, isJSON := logger.Handler().(*slog.JSONHandler); isJSON {
+		return
+	}
+
+	logger.Info("============================================================")
 }
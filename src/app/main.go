@@ -6,25 +6,47 @@ import (
 	"fmt"
 	"io/fs"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/tuxerrante/kapparmor/src/app/metrics"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, found := offlineCommands[os.Args[1]]; found {
+			slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+			if err := command(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			return
+		}
+	}
+
 	logger := newDefaultLogger()
 	cfg := NewConfigFromEnv(logger)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	startHealthzServer(cfg)
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, cfg, os.Args[1:]); err != nil {
+			logger.Error("command error", slog.String("command", os.Args[1]), slog.Any("error", err))
+			cancel()
+			os.Exit(1)
+		}
+
+		return
+	}
 
 	if err := RunApp(ctx, cfg); err != nil {
 		logger.Error("application error", slog.Any("error", err))
@@ -52,6 +74,89 @@ func RunApp(parentCtx context.Context, cfg *AppConfig) error {
 	}
 	defer cleanup()
 
+	if cfg.AuditLogPath != "" {
+		cfg.Audit, err = openAuditLog(parentCtx, cfg)
+		if err != nil {
+			return err
+		}
+
+		defer func() { _ = cfg.Audit.close() }()
+	}
+
+	if cfg.SigningKeysPath != "" {
+		cfg.Verifier, err = loadProfileVerifier(cfg.SigningKeysPath)
+		if err != nil {
+			return fmt.Errorf("profile signing keys: %w", err)
+		}
+	}
+
+	if cfg.AllowlistPath != "" {
+		cfg.Allowlist, err = loadProfileAllowlist(cfg.AllowlistPath)
+		if err != nil {
+			return fmt.Errorf("profile allowlist: %w", err)
+		}
+	}
+
+	if cfg.RequiredIncludes != "" || cfg.PolicySnippetPath != "" {
+		cfg.Policy, err = loadProfilePolicy(cfg.RequiredIncludes, cfg.PolicySnippetPath)
+		if err != nil {
+			return fmt.Errorf("profile policy: %w", err)
+		}
+	}
+
+	if cfg.TemplatesEnabled {
+		cfg.Templater, err = newProfileTemplater(parentCtx, cfg)
+		if err != nil {
+			return fmt.Errorf("profile templates: %w", err)
+		}
+	}
+
+	var denials *denialCollector
+	if cfg.DenialLogPath != "" {
+		denials, err = newDenialCollector(cfg)
+		if err != nil {
+			return fmt.Errorf("denial collector: %w", err)
+		}
+	}
+
+	if cfg.NodeTaintEnabled {
+		cfg.NodeTaint, err = newNodeTaintManager(cfg)
+		if err != nil {
+			return fmt.Errorf("node readiness taint: %w", err)
+		}
+	}
+
+	// The staged rollout reads canary health from the node status reports.
+	if cfg.StatusReportEnabled || cfg.RolloutEnabled {
+		cfg.NodeStatus, err = newNodeStatusReporter(cfg)
+		if err != nil {
+			return fmt.Errorf("node status report: %w", err)
+		}
+	}
+
+	if cfg.RolloutEnabled {
+		cfg.Rollout, err = newRolloutManager(cfg, pollTime)
+		if err != nil {
+			return fmt.Errorf("staged rollout: %w", err)
+		}
+	}
+
+	shutdownTracing, err := setupTracing(parentCtx, cfg)
+	if err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+
+	// Probes answer from this snapshot until the first reconcile cycle ends.
+	refreshAgentStatus(parentCtx, cfg)
+
+	var srv *http.Server
+	if cfg.HTTPPort != "" {
+		srv, err = startAgentServer(cfg)
+		if err != nil {
+			return fmt.Errorf("http server: %w", err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
 
@@ -65,6 +170,12 @@ func RunApp(parentCtx context.Context, cfg *AppConfig) error {
 		pollProfiles(ctx, cfg, pollTime)
 	})
 
+	if denials != nil {
+		wg.Go(func() {
+			denials.run(ctx)
+		})
+	}
+
 	// Separate signal handling - no shared channel confusion
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, os.Interrupt)
@@ -98,11 +209,22 @@ func RunApp(parentCtx context.Context, cfg *AppConfig) error {
 		cfg.Logger.Warn("Poller shutdown timeout exceeded")
 	}
 
-	if err := unloadAllProfiles(cfg); err != nil {
+	if srv != nil {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			cfg.Logger.Warn("HTTP server shutdown", slog.Any("error", err))
+		}
+	}
+
+	if err := unloadAllProfiles(shutdownCtx, cfg); err != nil {
 		cfg.Logger.Error("failed to unload all profiles during shutdown", slog.Any("error", err))
 		// Don't return error - attempt best-effort cleanup
 	}
 
+	// Flush the spans of the last cycle and of the shutdown itself.
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		cfg.Logger.Warn("tracing shutdown", slog.Any("error", err))
+	}
+
 	cfg.Logger.Info("The eagle has landed. Over and out.")
 
 	return nil
@@ -112,149 +234,297 @@ func RunApp(parentCtx context.Context, cfg *AppConfig) error {
 // it will call loadNewProfiles() then to check if they are new ones or not.
 // Executed as go-routine it will run forever until a cancel() is called on the given context.
 func pollProfiles(ctx context.Context, cfg *AppConfig, pollTime int) {
-	slog.Default().Info("Polling started.")
-
-	if os.Getenv("TESTING") == "true" { //nolint:nestif
-		defer func() {
-			if r := recover(); r != nil {
-				if r, ok := r.(error); ok {
-					slog.Default().Warn("panic during test", slog.String("error", r.Error()))
-
-					if strings.Contains(r.Error(), "You need root privileges") {
-						slog.Default().Warn("Recovered panic for missing privileges during tests", slog.String("error", r.Error()))
-
-						ctx.Done()
-					} else if strings.Contains(r.Error(), "executable file not found") {
-						slog.Default().Warn("Recovered panic for missing apparmor binary during tests", slog.String("error", r.Error()))
-
-						ctx.Done()
-					}
-				}
-			}
-		}()
+	if cfg.Logger != nil {
+		ctx = contextWithLogger(ctx, cfg.Logger)
 	}
 
-	ticker := time.NewTicker(time.Duration(pollTime) * time.Second)
-	defer ticker.Stop()
+	logger := loggerFromContext(ctx)
+	logger.Info("Polling started.")
+
+	ticks, stop := cfg.clock().NewTicker(time.Duration(pollTime) * time.Second)
+	defer stop()
 
 	pollNow := func() {
 		// Wrap in recover to prevent single poll failure from killing poller
 		defer func() {
 			if r := recover(); r != nil {
-				slog.Default().Error("panic during profile polling", slog.Any("panic", r))
+				logger.Error("panic during profile polling", slog.Any("panic", r))
 			}
 		}()
 
-		newProfiles, err := loadNewProfiles(cfg)
-		slog.Default().Info("retrieving profiles", slog.Any("profiles", newProfiles))
-		if err != nil {
-			slog.Default().Warn("Failed to load/unload profiles this cycle", slog.Any("error", err))
-
-			return
-		}
+		reconcileOnce(ctx, cfg)
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			slog.Default().Info("Polling stopped by context cancellation")
+			logger.Info("Polling stopped by context cancellation")
 
 			return
-		case <-ticker.C:
+		case <-ticks:
 			pollNow()
 		}
 	}
 }
 
+// reconcileOnce runs one poll cycle: the optional staged rollout gate, the
+// profiles reconcile and the optional node status and taint updates.
+func reconcileOnce(ctx context.Context, cfg *AppConfig) {
+	ctx = withReconcileID(ctx)
+
+	var (
+		desiredHash string
+		err         error
+	)
+
+	if cfg.Rollout != nil {
+		// The hash covers the template variables: read their current values first.
+		cfg.Templater.refresh(ctx)
+
+		desiredHash, err = profileSetDigest(cfg)
+		if err != nil {
+			loggerFromContext(ctx).Warn("Cannot hash the desired profiles", slog.Any("error", err))
+
+			return
+		}
+
+		held := !cfg.Rollout.beforeReconcile(ctx, cfg, desiredHash)
+		cfg.History.setHeld(held)
+
+		if held {
+			if cfg.NodeStatus != nil {
+				cfg.NodeStatus.report(ctx, cfg, "", nil)
+			}
+
+			status := refreshAgentStatus(ctx, cfg)
+
+			if cfg.NodeTaint != nil {
+				cfg.NodeTaint.observe(ctx, status.Ready)
+			}
+
+			return
+		}
+	}
+
+	newProfiles, err := loadNewProfiles(ctx, cfg)
+	loggerFromContext(ctx).Info("retrieving profiles", slog.Any("profiles", newProfiles))
+	if err != nil {
+		loggerFromContext(ctx).Warn("Failed to load/unload profiles this cycle", slog.Any("error", err))
+	}
+
+	cfg.History.reconciled(cfg.clock().Now(), err)
+	status := refreshAgentStatus(ctx, cfg)
+
+	if cfg.NodeStatus != nil {
+		if desiredHash == "" {
+			desiredHash, _ = profileSetDigest(cfg)
+		}
+
+		cfg.NodeStatus.report(ctx, cfg, desiredHash, err)
+	}
+
+	if cfg.NodeTaint != nil {
+		cfg.NodeTaint.observe(ctx, err == nil && status.Ready)
+	}
+}
+
 // calculateProfileChanges compares desired state (newProfiles) vs current state (customLoadedProfiles).
 // Check if the current profiles are really new and loads them after verifying some conditions.
-func loadNewProfiles(cfg *AppConfig) ([]string, error) {
+func loadNewProfiles(ctx context.Context, cfg *AppConfig) (applied []string, err error) {
 	profileOperationsMutex.Lock()
 	defer profileOperationsMutex.Unlock()
 
+	ctx, span := startSpan(ctx, "loadNewProfiles")
+	start := cfg.clock().Now()
+	outcome := metrics.ReconcileFailed
+
+	defer func() {
+		metrics.ReconcileFinished(outcome, cfg.clock().Now().Sub(start))
+		span.SetAttributes(attribute.String("outcome", outcome), attribute.Int("profiles.applied", len(applied)))
+		endSpan(span, err)
+	}()
+
 	// 1. Get desired state from ConfigMap
-	profilesAreReadable, newProfiles := getNewProfiles(cfg)
+	_, readSpan := startSpan(ctx, "getNewProfiles")
+	profilesAreReadable, newProfiles := getNewProfiles(ctx, cfg)
+	readSpan.SetAttributes(attribute.Int("profiles.desired", len(newProfiles)))
+	readSpan.End()
+
 	if !profilesAreReadable {
 		return nil, fmt.Errorf("error accessing the files in %s", cfg.ConfigmapPath)
 	}
 
+	metrics.SetDesiredProfiles(len(newProfiles))
+
+	// Profiles whose signature is missing or invalid are blocked by calculateProfileChanges.
+	_, verifySpan := startSpan(ctx, "verifyProfileSignatures")
+	verified, rejected := verifyProfileSignatures(ctx, cfg, newProfiles)
+	verifySpan.SetAttributes(attribute.Int("profiles.rejected", len(rejected)))
+	verifySpan.End()
+
+	ctx = withVerifiedSources(ctx, verified, rejected)
+
 	// 2. Get current state from the node
 	// 	`loadedProfiles` contains all the profiles loaded in the kernel
 	// 	`customLoadedProfiles` contains only the profiles loaded from our EtcApparmord folder
-	loadedProfiles, customLoadedProfiles, err := getLoadedProfiles(cfg)
+	_, kernelSpan := startSpan(ctx, "getLoadedProfiles")
+	loadedProfiles, customLoadedProfiles, err := getLoadedProfiles(ctx, cfg)
+	endSpan(kernelSpan, err)
+
 	if err != nil {
 		return nil, fmt.Errorf("error reading existing profiles: %w", err)
 	}
 	delete(customLoadedProfiles, "")
 
-	if os.Getenv("TESTING") == "true" {
-		printLoadedProfiles(loadedProfiles)
-	}
+	printLoadedProfiles(ctx, loadedProfiles)
 
 	// 3. DIFF desired VS current state
-	newProfilesToApply, loadedProfilesToUnload, err := calculateProfileChanges(cfg, newProfiles, customLoadedProfiles)
+	_, diffSpan := startSpan(ctx, "calculateProfileChanges")
+	newProfilesToApply, loadedProfilesToUnload, err := calculateProfileChanges(ctx, cfg, newProfiles, customLoadedProfiles)
+	diffSpan.SetAttributes(
+		attribute.Int("profiles.to_apply", len(newProfilesToApply)),
+		attribute.Int("profiles.to_unload", len(loadedProfilesToUnload)))
+	endSpan(diffSpan, err)
+
 	if err != nil {
 		return nil, fmt.Errorf("error calculating profile changes: %w", err)
 	}
 
 	// 4. Execute apparmor_parser --replace
-	printLogSeparator()
-	slog.Default().Info("Apparmor REPLACE and apply new profiles..")
+	printLogSeparator(ctx)
+	loggerFromContext(ctx).Info("Apparmor REPLACE and apply new profiles..")
 
 	// Collect errors.
 	var applyErrors []error
 	for _, profilePath := range newProfilesToApply {
-		if err := loadProfile(cfg, profilePath); err != nil {
-			slog.Default().Error("apply profile error", slog.Any("error", err))
+		if err := loadProfile(ctx, cfg, profilePath); err != nil {
+			loggerFromContext(ctx).Error("apply profile error", slog.Any("error", err))
 			applyErrors = append(applyErrors, err)
 		}
 	}
 
 	// 5. Execute apparmor_parser --remove
 	if len(loadedProfilesToUnload) > 0 {
-		printLogSeparator()
-		slog.Default().Info("AppArmor REMOVE orphans profiles..")
+		printLogSeparator(ctx)
+		loggerFromContext(ctx).Info("AppArmor REMOVE orphans profiles..")
 
 		for _, profileFileName := range loadedProfilesToUnload {
-			if err := unloadProfile(cfg, profileFileName); err != nil {
-				slog.Default().Error("remove orphan profile error", slog.Any("error", err))
+			if err := unloadProfile(ctx, cfg, profileFileName); err != nil {
+				loggerFromContext(ctx).Error("remove orphan profile error", slog.Any("error", err))
 				applyErrors = append(applyErrors, err)
 			}
 		}
 	}
 
-	slog.Default().Info("> Done! > Waiting next poll..")
-	printLogSeparator()
+	loggerFromContext(ctx).Info("> Done! > Waiting next poll..")
+	printLogSeparator(ctx)
 
 	if len(applyErrors) > 0 {
+		outcome = metrics.ReconcilePartial
+
 		return newProfilesToApply, fmt.Errorf("encountered %d errors during profile operations", len(applyErrors))
 	}
 
+	outcome = metrics.ReconcileSuccess
+
 	return newProfilesToApply, nil
 }
 
 // Load an apparmor profile into the kernel.
-func loadProfile(cfg *AppConfig, profilePath string) error {
-	if err := execApparmor(cfg, "--verbose", "--replace", profilePath); err != nil {
-		return fmt.Errorf("failed to load profile into kernel: %w", err)
+func loadProfile(ctx context.Context, cfg *AppConfig, profilePath string) (err error) {
+	// Extract profile name from path for metrics
+	profileName := path.Base(profilePath)
+
+	ctx, span := startSpan(ctx, "loadProfile", attribute.String("profile", profileName))
+	defer func() { endSpan(span, err) }()
+
+	if cfg.Audit != nil {
+		oldSHA := installedDigest(cfg, profileName)
+
+		// The digest of the file installed once the load is over, the old one when it failed.
+		defer func() {
+			auditProfileChange(ctx, cfg, auditLoad, profileName, oldSHA, installedDigest(cfg, profileName), err)
+		}()
+	}
+
+	if cfg.Policy != nil || cfg.Templater != nil || verifiedSources(ctx) != nil {
+		return loadRenderedProfile(ctx, cfg, profileName)
 	}
 
-	slog.Default().Info("Copying profile", slog.String("dest", cfg.EtcApparmord))
+	if err := execApparmor(ctx, cfg, "--verbose", "--replace", profilePath); err != nil {
+		err = fmt.Errorf("failed to load profile into kernel: %w", err)
+		cfg.History.applied(profileName, cfg.clock().Now(), err)
 
-	if err := CopyFile(profilePath, cfg.EtcApparmord); err != nil {
-		return fmt.Errorf("failed to copy profile to destination: %w", err)
+		return err
 	}
 
-	// Extract profile name from path for metrics
-	profileName := path.Base(profilePath)
+	loggerFromContext(ctx).Info("Copying profile", slog.String("dest", cfg.EtcApparmord))
+
+	if err := CopyFile(ctx, cfg.filesystem(), profilePath, cfg.EtcApparmord); err != nil {
+		err = fmt.Errorf("failed to copy profile to destination: %w", err)
+		cfg.History.applied(profileName, cfg.clock().Now(), err)
+
+		return err
+	}
+
+	cfg.History.applied(profileName, cfg.clock().Now(), nil)
+	metrics.ProfileCreated(profileName)
+
+	return nil
+}
+
+// loadRenderedProfile loads the rendered version of a profile, or its verified
+// content, from a staged copy, which replaces the installed file once the kernel
+// accepted it.
+func loadRenderedProfile(ctx context.Context, cfg *AppConfig, profileName string) error {
+	staged, err := stageRenderedProfile(ctx, cfg, profileName)
+	if err != nil {
+		err = fmt.Errorf("failed to render profile: %w", err)
+		cfg.History.applied(profileName, cfg.clock().Now(), err)
+
+		return err
+	}
+
+	// Left behind only when the profile was not installed.
+	defer func() {
+		if cfg.EtcRoot != nil {
+			_ = cfg.EtcRoot.Remove(path.Base(staged))
+		} else {
+			_ = os.Remove(staged)
+		}
+	}()
+
+	if err := execApparmor(ctx, cfg, "--verbose", "--replace", staged); err != nil {
+		err = fmt.Errorf("failed to load profile into kernel: %w", err)
+		cfg.History.applied(profileName, cfg.clock().Now(), err)
+
+		return err
+	}
+
+	loggerFromContext(ctx).Info("Installing rendered profile", slog.String("dest", cfg.EtcApparmord))
+
+	if cfg.EtcRoot != nil {
+		err = cfg.EtcRoot.Rename(path.Base(staged), profileName)
+	} else {
+		err = os.Rename(staged, path.Join(cfg.EtcApparmord, profileName))
+	}
+
+	if err != nil {
+		err = fmt.Errorf("failed to install profile: %w", err)
+		cfg.History.applied(profileName, cfg.clock().Now(), err)
+
+		return err
+	}
+
+	cfg.History.applied(profileName, cfg.clock().Now(), nil)
 	metrics.ProfileCreated(profileName)
 
 	return nil
 }
 
 // Remove all custom profiles from the kernel, reading from ETC_APPARMORD folder.
-func unloadAllProfiles(cfg *AppConfig) error {
-	slog.Default().Info("Unloading all custom profiles from kernel and filesystem...")
+func unloadAllProfiles(ctx context.Context, cfg *AppConfig) error {
+	loggerFromContext(ctx).Info("Unloading all custom profiles from kernel and filesystem...")
 	var dirEntries []fs.DirEntry
 	var err error
 
@@ -266,12 +536,12 @@ func unloadAllProfiles(cfg *AppConfig) error {
 
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			slog.Default().Warn("Custom profile directory does not exist, nothing to unload",
+			loggerFromContext(ctx).Warn("Custom profile directory does not exist, nothing to unload",
 				slog.String("path", cfg.EtcApparmord))
 
 			return nil // Nothing to do
 		}
-		slog.Default().Error(
+		loggerFromContext(ctx).Error(
 			"Cannot read custom profile directory",
 			slog.String("path", cfg.EtcApparmord),
 			slog.Any("error", err),
@@ -283,8 +553,8 @@ func unloadAllProfiles(cfg *AppConfig) error {
 	var errs []error
 	for _, entry := range dirEntries {
 		if !entry.IsDir() && entry.Type().IsRegular() {
-			if err := unloadProfile(cfg, entry.Name()); err != nil {
-				slog.Default().Error("failed to unload profile",
+			if err := unloadProfile(ctx, cfg, entry.Name()); err != nil {
+				loggerFromContext(ctx).Error("failed to unload profile",
 					slog.String("profile", entry.Name()),
 					slog.Any("error", err))
 				errs = append(errs, err)
@@ -301,9 +571,23 @@ func unloadAllProfiles(cfg *AppConfig) error {
 }
 
 // Remove an apparmor profile from the kernel.
-func unloadProfile(cfg *AppConfig, fileName string) error {
+func unloadProfile(ctx context.Context, cfg *AppConfig, fileName string) (err error) {
 	// Use path.Base for security, consistent with fuzz test fix
 	safeFileName := path.Base(fileName)
+
+	ctx, span := startSpan(ctx, "unloadProfile", attribute.String("profile", safeFileName))
+	defer func() { endSpan(span, err) }()
+
+	if cfg.Audit != nil {
+		oldSHA := installedDigest(cfg, safeFileName)
+
+		defer func() {
+			if oldSHA != "" {
+				auditProfileChange(ctx, cfg, auditUnload, safeFileName, oldSHA, "", err)
+			}
+		}()
+	}
+
 	filePath := path.Join(cfg.EtcApparmord, safeFileName)
 
 	// Check if the file exists first.
@@ -315,7 +599,7 @@ func unloadProfile(cfg *AppConfig, fileName string) error {
 	}
 
 	if errors.Is(statErr, os.ErrNotExist) {
-		slog.Default().Info("Profile file does not exist, skipping unload", slog.String("profile", filePath))
+		loggerFromContext(ctx).Info("Profile file does not exist, skipping unload", slog.String("profile", filePath))
 
 		return nil // Nothing to do
 	}
@@ -323,17 +607,16 @@ func unloadProfile(cfg *AppConfig, fileName string) error {
 	var errs []error
 
 	// 1. Try to remove from kernel first
-	if err := execApparmor(cfg, "--verbose", "--remove", filePath); err != nil {
+	if err := execApparmor(ctx, cfg, "--verbose", "--remove", filePath); err != nil {
 		// Log the error but don't panic or stop.
 		// It might fail if the profile isn't loaded, which is fine during cleanup.
-		slog.Default().Warn("failed to remove profile from kernel (might be expected on cleanup)",
+		loggerFromContext(ctx).Warn("failed to remove profile from kernel (might be expected on cleanup)",
 			slog.String("profile", filePath),
 			slog.Any("error", err))
 		errs = append(errs, fmt.Errorf("parser removal: %w", err))
 	}
 
 	// 2. Now try to remove the file, even if kernel removal failed
-	var err error
 	if cfg.EtcRoot != nil {
 		err = cfg.EtcRoot.Remove(safeFileName)
 	} else {
@@ -343,7 +626,7 @@ func unloadProfile(cfg *AppConfig, fileName string) error {
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		// Log any error *except* "not found".
 		// If it's not found, that's fine.
-		slog.Default().Error("failed to remove profile file from disk",
+		loggerFromContext(ctx).Error("failed to remove profile file from disk",
 			slog.String("profile", filePath),
 			slog.Any("error", err))
 		errs = append(errs, fmt.Errorf("file removal: %w", err))
@@ -353,8 +636,8 @@ func unloadProfile(cfg *AppConfig, fileName string) error {
 
 	// 3. Reload AppArmor to ensure it picks up the changes
 	if len(errs) == 0 {
-		if err := execApparmor(cfg, "--reload", cfg.EtcApparmord); err != nil {
-			slog.Default().Warn("failed to reload AppArmor after profile removal",
+		if err := execApparmor(ctx, cfg, "--reload", cfg.EtcApparmord); err != nil {
+			loggerFromContext(ctx).Warn("failed to reload AppArmor after profile removal",
 				slog.String("profile", filePath),
 				slog.Any("error", err))
 			errs = append(errs, fmt.Errorf("apparmor reload: %w", err))
@@ -365,11 +648,12 @@ func unloadProfile(cfg *AppConfig, fileName string) error {
 		return errors.Join(errs...)
 	}
 	// If we get here, it either worked, or the errors were expected (not found)
-	slog.Default().Info("Successfully unloaded and removed profile", slog.String("profile", filePath))
+	loggerFromContext(ctx).Info("Successfully unloaded and removed profile", slog.String("profile", filePath))
 
 	// Extract profile name from path for metrics
 	profileName := path.Base(fileName)
 	metrics.ProfileDeleted(profileName)
+	cfg.History.removed(profileName)
 
 	return nil
 }
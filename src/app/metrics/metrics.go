@@ -3,6 +3,7 @@ package metrics
 
 import (
 	"os"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -22,13 +23,121 @@ var (
 		[]string{"operation", "profile_name"},
 	)
 
-	// currentProfiles tracks how many profiles are currently managed.
+	// currentProfiles tracks how many profiles are currently managed,
+	// as observed at the end of the last reconcile cycle.
 	currentProfiles = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace:   "kapparmor",
 		Name:        "profiles_managed",
 		Help:        "Numero totale di profili AppArmor attualmente gestiti.",
 		ConstLabels: prometheus.Labels{"node_name": nodeName},
 	})
+
+	// reconcileDuration measures whole reconcile cycles.
+	reconcileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   "kapparmor",
+		Name:        "reconcile_duration_seconds",
+		Help:        "Durata dei cicli di riconciliazione dei profili.",
+		ConstLabels: prometheus.Labels{"node_name": nodeName},
+		Buckets:     []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	})
+
+	// reconcileCycles counts reconcile cycles by outcome.
+	reconcileCycles = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   "kapparmor",
+			Name:        "reconcile_total",
+			Help:        "Numero totale di cicli di riconciliazione per esito (success, partial, failed).",
+			ConstLabels: prometheus.Labels{"node_name": nodeName},
+		},
+		[]string{"outcome"},
+	)
+
+	// lastSuccessfulReconcile is the Unix time of the last cycle without errors.
+	lastSuccessfulReconcile = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "kapparmor",
+		Name:        "last_successful_reconcile_timestamp_seconds",
+		Help:        "Timestamp Unix dell'ultimo ciclo di riconciliazione senza errori.",
+		ConstLabels: prometheus.Labels{"node_name": nodeName},
+	})
+
+	// parserDuration measures each apparmor_parser invocation.
+	parserDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   "kapparmor",
+			Name:        "apparmor_parser_duration_seconds",
+			Help:        "Durata delle invocazioni di apparmor_parser per operazione ed esito.",
+			ConstLabels: prometheus.Labels{"node_name": nodeName},
+			Buckets:     []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		},
+		[]string{"operation", "result"},
+	)
+
+	// desiredProfiles counts the profiles found in the ConfigMap.
+	desiredProfiles = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "kapparmor",
+		Name:        "desired_profiles",
+		Help:        "Numero di profili presenti nella ConfigMap.",
+		ConstLabels: prometheus.Labels{"node_name": nodeName},
+	})
+
+	// profileLoaded is 1 for every custom profile loaded in the kernel, labelled with its mode.
+	profileLoaded = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   "kapparmor",
+			Name:        "profile_loaded",
+			Help:        "Profili custom caricati nel kernel, con la relativa modalità (enforce, complain).",
+			ConstLabels: prometheus.Labels{"node_name": nodeName},
+		},
+		[]string{"profile", "mode"},
+	)
+
+	// profileInfo exposes the content hashes of every loaded custom profile, to compare nodes in PromQL.
+	profileInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   "kapparmor",
+			Name:        "profile_info",
+			Help:        "Informazioni sui profili custom caricati: sha256 del file installato e del sorgente nella ConfigMap, modalità e origine.",
+			ConstLabels: prometheus.Labels{"node_name": nodeName},
+		},
+		[]string{"profile_name", "sha256", "source_sha256", "mode", "source"},
+	)
+
+	// loadedProfiles counts the custom profiles loaded in the kernel.
+	loadedProfiles = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "kapparmor",
+		Name:        "loaded_profiles",
+		Help:        "Numero di profili custom caricati nel kernel.",
+		ConstLabels: prometheus.Labels{"node_name": nodeName},
+	})
+
+	// profileBlocked is 1 for every profile whose ConfigMap version is refused by the allowlist or the profile policy.
+	profileBlocked = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   "kapparmor",
+			Name:        "profile_blocked",
+			Help:        "Profili la cui versione nella ConfigMap è bloccata dalla allowlist, dalla policy o dalla firma: resta installata la versione precedente.",
+			ConstLabels: prometheus.Labels{"node_name": nodeName},
+		},
+		[]string{"profile"},
+	)
+
+	// denials counts the AppArmor denials of custom profiles read from the kernel audit log.
+	denials = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   "kapparmor",
+			Name:        "denials_total",
+			Help:        "Numero totale di accessi negati da AppArmor ai profili custom, per operazione e classe.",
+			ConstLabels: prometheus.Labels{"node_name": nodeName},
+		},
+		[]string{"profile", "operation", "class"},
+	)
+)
+
+// Reconcile cycle outcomes.
+const (
+	ReconcileSuccess = "success" // every profile operation succeeded
+	ReconcilePartial = "partial" // some apparmor_parser operations failed
+	ReconcileFailed  = "failed"  // the cycle could not compute the changes
 )
 
 func getNodeNameFromEnv() string {
@@ -44,16 +153,15 @@ func getNodeNameFromEnv() string {
 
 // Metrics setters
 
-// ProfileCreated increments create counter and increments gauge.
+// ProfileCreated increments the create counter.
+// The profiles_managed gauge is set from the observed state by SetProfileCount.
 func ProfileCreated(p string) {
 	profileOperations.WithLabelValues("create", p).Inc()
-	currentProfiles.Inc()
 }
 
-// ProfileDeleted increments delete counter and decrements gauge.
+// ProfileDeleted increments the delete counter.
 func ProfileDeleted(p string) {
 	profileOperations.WithLabelValues("delete", p).Inc()
-	currentProfiles.Dec()
 }
 
 // ProfileModified is an alias used by tests for updates.
@@ -70,3 +178,79 @@ func ProfileUpdated(p string) {
 func SetProfileCount(c int) {
 	currentProfiles.Set(float64(c))
 }
+
+// ReconcileFinished records a reconcile cycle with the given outcome and duration.
+func ReconcileFinished(outcome string, d time.Duration) {
+	reconcileDuration.Observe(d.Seconds())
+	reconcileCycles.WithLabelValues(outcome).Inc()
+
+	if outcome == ReconcileSuccess {
+		lastSuccessfulReconcile.SetToCurrentTime()
+	}
+}
+
+// ParserInvoked records an apparmor_parser run; operation is e.g. "replace", "remove" or "reload".
+func ParserInvoked(operation string, d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+
+	parserDuration.WithLabelValues(operation, result).Observe(d.Seconds())
+}
+
+// SetDesiredProfiles sets the number of profiles found in the ConfigMap.
+func SetDesiredProfiles(c int) {
+	desiredProfiles.Set(float64(c))
+}
+
+// SetLoadedProfiles replaces the profile_loaded series with the given
+// profile -> kernel mode map and sets loaded_profiles to its size.
+func SetLoadedProfiles(modes map[string]string) {
+	profileLoaded.Reset()
+
+	for profile, mode := range modes {
+		profileLoaded.WithLabelValues(profile, mode).Set(1)
+	}
+
+	loadedProfiles.Set(float64(len(modes)))
+}
+
+// Values of the source label of kapparmor_profile_info.
+const (
+	ProfileSourceConfigMap = "configmap" // the profile is in the ConfigMap
+	ProfileSourceOrphan    = "orphan"    // loaded, but no longer in the ConfigMap
+)
+
+// ProfileInfo describes a loaded custom profile for kapparmor_profile_info.
+type ProfileInfo struct {
+	Name   string
+	SHA256 string // of the installed file
+	// SourceSHA256 is the sha256 of the ConfigMap source the installed file was rendered from.
+	SourceSHA256 string
+	Mode         string
+	Source       string
+}
+
+// SetProfileInfo replaces the kapparmor_profile_info series with profiles.
+func SetProfileInfo(profiles []ProfileInfo) {
+	profileInfo.Reset()
+
+	for _, p := range profiles {
+		profileInfo.WithLabelValues(p.Name, p.SHA256, p.SourceSHA256, p.Mode, p.Source).Set(1)
+	}
+}
+
+// DenialObserved counts an apparmor="DENIED" audit record of a custom profile.
+func DenialObserved(profile, operation, class string) {
+	denials.WithLabelValues(profile, operation, class).Inc()
+}
+
+// SetBlockedProfiles replaces the profile_blocked series with profiles.
+func SetBlockedProfiles(profiles []string) {
+	profileBlocked.Reset()
+
+	for _, p := range profiles {
+		profileBlocked.WithLabelValues(p).Set(1)
+	}
+}
@@ -1,12 +1,14 @@
 package metrics
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -172,3 +174,111 @@ func TestMetricsServerHandler(t *testing.T) {
 		t.Error("Il body della risposta non contiene il valore corretto per 'test-server-profilo'")
 	}
 }
+
+func TestReconcileFinished(t *testing.T) {
+	// Le metriche di riconciliazione non vengono ricreate da resetMetrics: confrontiamo le differenze.
+	successBefore := testutil.ToFloat64(reconcileCycles.WithLabelValues(ReconcileSuccess))
+	partialBefore := testutil.ToFloat64(reconcileCycles.WithLabelValues(ReconcilePartial))
+	lastSuccessBefore := testutil.ToFloat64(lastSuccessfulReconcile)
+
+	ReconcileFinished(ReconcilePartial, 2*time.Second)
+
+	if got := testutil.ToFloat64(reconcileCycles.WithLabelValues(ReconcilePartial)); got != partialBefore+1 {
+		t.Errorf("reconcile_total{outcome=partial}: ottenuto %v, previsto %v", got, partialBefore+1)
+	}
+
+	if got := testutil.ToFloat64(lastSuccessfulReconcile); got != lastSuccessBefore {
+		t.Errorf("un ciclo parziale non deve aggiornare il timestamp di successo, ottenuto %v", got)
+	}
+
+	before := time.Now().Unix()
+	ReconcileFinished(ReconcileSuccess, time.Second)
+
+	if got := testutil.ToFloat64(reconcileCycles.WithLabelValues(ReconcileSuccess)); got != successBefore+1 {
+		t.Errorf("reconcile_total{outcome=success}: ottenuto %v, previsto %v", got, successBefore+1)
+	}
+
+	if got := testutil.ToFloat64(lastSuccessfulReconcile); got < float64(before) {
+		t.Errorf("last_successful_reconcile_timestamp_seconds non aggiornato: %v", got)
+	}
+
+	if n := testutil.CollectAndCount(reconcileDuration); n != 1 {
+		t.Errorf("reconcile_duration_seconds: previsto un istogramma, ottenuti %d", n)
+	}
+}
+
+func TestParserInvokedAndProfileCounts(t *testing.T) {
+	ParserInvoked("replace", 100*time.Millisecond, nil)
+	ParserInvoked("remove", 100*time.Millisecond, errors.New("exit status 1"))
+
+	if n := testutil.CollectAndCount(parserDuration, "kapparmor_apparmor_parser_duration_seconds"); n < 2 {
+		t.Errorf("apparmor_parser_duration_seconds: previste almeno 2 serie, ottenute %d", n)
+	}
+
+	SetDesiredProfiles(3)
+	SetLoadedProfiles(map[string]string{"custom.a": "enforce", "custom.b": "complain"})
+
+	if got := testutil.ToFloat64(desiredProfiles); got != 3 {
+		t.Errorf("desired_profiles: ottenuto %v, previsto 3", got)
+	}
+
+	if got := testutil.ToFloat64(loadedProfiles); got != 2 {
+		t.Errorf("loaded_profiles: ottenuto %v, previsto 2", got)
+	}
+}
+
+func TestSetLoadedProfiles_ReplacesSeries(t *testing.T) {
+	testNodeName := getNodeNameFromEnv()
+
+	SetLoadedProfiles(map[string]string{"custom.a": "enforce", "custom.b": "enforce"})
+	// custom.a passa in complain, custom.b viene rimosso.
+	SetLoadedProfiles(map[string]string{"custom.a": "complain"})
+
+	expected := `
+		# HELP kapparmor_profile_loaded Profili custom caricati nel kernel, con la relativa modalità (enforce, complain).
+		# TYPE kapparmor_profile_loaded gauge
+		kapparmor_profile_loaded{mode="complain",node_name="` + testNodeName + `",profile="custom.a"} 1
+	`
+	if err := testutil.CollectAndCompare(profileLoaded, strings.NewReader(expected), "kapparmor_profile_loaded"); err != nil {
+		t.Errorf("Metrica profile_loaded non corrispondente: %v", err)
+	}
+
+	if got := testutil.ToFloat64(loadedProfiles); got != 1 {
+		t.Errorf("loaded_profiles: ottenuto %v, previsto 1", got)
+	}
+}
+
+func TestProfileOperations_DoNotMoveManagedGauge(t *testing.T) {
+	resetMetrics()
+	SetProfileCount(1)
+
+	// Una sostituzione conta come create, ma il profilo gestito resta uno.
+	ProfileCreated("custom.a")
+	ProfileCreated("custom.a")
+	ProfileDeleted("custom.b")
+
+	if got := testutil.ToFloat64(currentProfiles); got != 1 {
+		t.Errorf("profiles_managed: ottenuto %v, previsto 1", got)
+	}
+}
+
+func TestSetProfileInfo(t *testing.T) {
+	testNodeName := getNodeNameFromEnv()
+
+	SetProfileInfo([]ProfileInfo{{Name: "custom.a", SHA256: "aaa", Mode: "enforce", Source: ProfileSourceConfigMap}})
+	// Nuova versione di custom.a: la serie con il vecchio hash deve sparire.
+	SetProfileInfo([]ProfileInfo{
+		{Name: "custom.a", SHA256: "bbb", SourceSHA256: "src", Mode: "enforce", Source: ProfileSourceConfigMap},
+		{Name: "custom.old", SHA256: "ccc", SourceSHA256: "unknown", Mode: "complain", Source: ProfileSourceOrphan},
+	})
+
+	expected := `
+		# HELP kapparmor_profile_info Informazioni sui profili custom caricati: sha256 del file installato e del sorgente nella ConfigMap, modalità e origine.
+		# TYPE kapparmor_profile_info gauge
+		kapparmor_profile_info{mode="enforce",node_name="` + testNodeName + `",profile_name="custom.a",sha256="bbb",source="configmap",source_sha256="src"} 1
+		kapparmor_profile_info{mode="complain",node_name="` + testNodeName + `",profile_name="custom.old",sha256="ccc",source="orphan",source_sha256="unknown"} 1
+	`
+	if err := testutil.CollectAndCompare(profileInfo, strings.NewReader(expected), "kapparmor_profile_info"); err != nil {
+		t.Errorf("Metrica profile_info non corrispondente: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Each agent publishes its status in a "kapparmor-node-<node>" Lease of the
+// release namespace. The Lease renewTime tells readers how fresh the report is.
+const (
+	nodeLeasePrefix      = "kapparmor-node-"
+	nodeLeaseLabel       = "kapparmor.io/lease"
+	nodeLeaseLabelValue  = "node-status"
+	annotationNodeStatus = "kapparmor.io/node-status"
+)
+
+// nodeStatus is the per-node report read by the staged rollout and the aggregator.
+type nodeStatus struct {
+	Node string `json:"node"`
+	// DesiredHash is the profile set hash attempted in the last reconcile.
+	DesiredHash string `json:"desiredHash,omitempty"`
+	// AppliedHash is the profile set hash of the last successful reconcile.
+	AppliedHash string `json:"appliedHash,omitempty"`
+	ReconcileOK bool   `json:"reconcileOK"`
+	// Held is true when the last change was held back by the staged rollout.
+	Held bool `json:"held,omitempty"`
+	// LoadedProfiles maps custom profiles loaded in the kernel to the sha256 of the installed file.
+	LoadedProfiles map[string]string `json:"loadedProfiles"`
+	// SourceProfiles maps the loaded profiles to the sha256 of the ConfigMap source their
+	// installed file was rendered from. Profiles installed from another source are missing.
+	SourceProfiles      map[string]string `json:"sourceProfiles"`
+	QuarantinedProfiles map[string]string `json:"quarantinedProfiles,omitempty"`
+	LastReconcileTime   time.Time         `json:"lastReconcileTime"`
+	LastError           string            `json:"lastError,omitempty"`
+}
+
+// nodeStatusReporter publishes the node status after every reconcile cycle.
+type nodeStatusReporter struct {
+	client    *kubeClient
+	namespace string
+	nodeName  string
+	now       func() time.Time
+
+	status nodeStatus
+}
+
+// newNodeStatusReporter builds the reporter from cfg using the in-cluster credentials.
+func newNodeStatusReporter(cfg *AppConfig) (*nodeStatusReporter, error) {
+	if cfg.NodeName == "" || cfg.PodNamespace == "" {
+		return nil, errors.New("NODE_NAME and POD_NAMESPACE must be set to publish the node status")
+	}
+
+	client, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeStatusReporter{
+		client:    client,
+		namespace: cfg.PodNamespace,
+		nodeName:  cfg.NodeName,
+		now:       cfg.clock().Now,
+		status:    nodeStatus{Node: cfg.NodeName},
+	}, nil
+}
+
+// observe folds the outcome of a reconcile cycle into the next report.
+// attemptedHash is empty when the staged rollout held the change.
+func (r *nodeStatusReporter) observe(attemptedHash string, reconcileErr error) {
+	r.status.LastReconcileTime = r.now().UTC()
+	r.status.Held = attemptedHash == ""
+
+	if r.status.Held {
+		return
+	}
+
+	r.status.DesiredHash = attemptedHash
+	r.status.ReconcileOK = reconcileErr == nil
+	r.status.LastError = ""
+
+	if reconcileErr != nil {
+		r.status.LastError = reconcileErr.Error()
+	} else {
+		r.status.AppliedHash = attemptedHash
+	}
+}
+
+// report records the cycle outcome and publishes it with the current node inventory.
+func (r *nodeStatusReporter) report(ctx context.Context, cfg *AppConfig, attemptedHash string, reconcileErr error) {
+	r.observe(attemptedHash, reconcileErr)
+	r.status.LoadedProfiles, r.status.SourceProfiles, r.status.QuarantinedProfiles = nodeInventory(ctx, cfg)
+
+	if err := r.publish(ctx); err != nil {
+		loggerFromContext(ctx).Error("cannot publish node status", slog.String("node", r.nodeName), slog.Any("error", err))
+	}
+}
+
+// publish writes the current status into the node Lease, creating it when missing.
+func (r *nodeStatusReporter) publish(ctx context.Context) error {
+	name := nodeLeasePrefix + r.nodeName
+
+	payload, err := json.Marshal(r.status)
+	if err != nil {
+		return err
+	}
+
+	lease, err := r.client.getLease(ctx, r.namespace, name)
+	if err != nil {
+		return fmt.Errorf("reading node lease: %w", err)
+	}
+
+	create := lease == nil
+	if create {
+		lease = newLease(r.namespace, name)
+	}
+
+	if lease.Metadata.Labels == nil {
+		lease.Metadata.Labels = map[string]string{}
+	}
+
+	if lease.Metadata.Annotations == nil {
+		lease.Metadata.Annotations = map[string]string{}
+	}
+
+	lease.Metadata.Labels[nodeLeaseLabel] = nodeLeaseLabelValue
+	lease.Metadata.Annotations[annotationNodeStatus] = string(payload)
+	lease.Spec.HolderIdentity = r.nodeName
+	lease.Spec.RenewTime = r.now().UTC().Format(leaseTimeFormat)
+
+	if create {
+		_, err = r.client.createLease(ctx, lease)
+	} else {
+		_, err = r.client.updateLease(ctx, lease)
+	}
+
+	return err
+}
+
+// nodeInventory returns the custom profiles loaded in the kernel with the sha256
+// of their installed file and of their source (see installedSourceDigest), and
+// the profile source files the agent cannot load.
+// Read errors are logged and leave the corresponding map empty.
+func nodeInventory(ctx context.Context, cfg *AppConfig) (loaded, sources, quarantined map[string]string) {
+	loaded, sources = map[string]string{}, map[string]string{}
+
+	_, customLoaded, err := getLoadedProfiles(ctx, cfg)
+	if err != nil {
+		loggerFromContext(ctx).Warn("cannot read loaded profiles for the node status", slog.Any("error", err))
+	}
+
+	for name := range customLoaded {
+		data, readErr := readProfileBytes(cfg.filesystem(), cfg.EtcRoot, cfg.EtcApparmord, name)
+		loaded[name], _ = profileDigest(data, readErr)
+
+		if readErr != nil {
+			continue
+		}
+
+		src, srcErr := readProfileBytes(cfg.filesystem(), cfg.ConfigmapRoot, cfg.ConfigmapPath, name)
+		if digest := installedSourceDigest(ctx, cfg, name, src, data); srcErr == nil && digest != "" {
+			sources[name] = digest
+		}
+	}
+
+	catalog, err := loadProfileCatalog(ctx, cfg.ConfigmapPath)
+	if err != nil {
+		loggerFromContext(ctx).Warn("cannot read profile source for the node status", slog.Any("error", err))
+
+		return loaded, sources, nil
+	}
+
+	return loaded, sources, catalog.quarantined
+}
+
+// reportedNodeStatus is a node status together with the time it was published.
+type reportedNodeStatus struct {
+	nodeStatus
+
+	ReportedAt time.Time `json:"reportedAt"`
+}
+
+// listNodeStatuses reads the node status Leases of namespace, sorted by node name.
+func listNodeStatuses(ctx context.Context, client *kubeClient, namespace string) ([]reportedNodeStatus, error) {
+	leases, err := client.listLeases(ctx, namespace, nodeLeaseLabel+"="+nodeLeaseLabelValue)
+	if err != nil {
+		return nil, fmt.Errorf("listing node leases: %w", err)
+	}
+
+	statuses := make([]reportedNodeStatus, 0, len(leases))
+
+	for i := range leases {
+		lease := &leases[i]
+
+		var status nodeStatus
+		if err := json.Unmarshal([]byte(lease.Metadata.Annotations[annotationNodeStatus]), &status); err != nil {
+			loggerFromContext(ctx).Warn("ignoring node lease with an unreadable status",
+				slog.String("lease", lease.Metadata.Name), slog.Any("error", err))
+
+			continue
+		}
+
+		if status.Node == "" {
+			status.Node = strings.TrimPrefix(lease.Metadata.Name, nodeLeasePrefix)
+		}
+
+		statuses = append(statuses, reportedNodeStatus{nodeStatus: status, ReportedAt: lease.renewedAt()})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Node < statuses[j].Node })
+
+	return statuses, nil
+}
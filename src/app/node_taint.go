@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultNodeTaintKey = "kapparmor.io/not-ready"
+	nodeTaintEffect     = "NoSchedule"
+)
+
+type nodeTaint struct {
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+	Effect    string `json:"effect"`
+	TimeAdded string `json:"timeAdded,omitempty"`
+}
+
+type nodeObject struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		Taints []nodeTaint `json:"taints,omitempty"`
+	} `json:"spec"`
+}
+
+type jsonPatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// nodeTaintManager keeps a NoSchedule taint on the node while the loaded
+// profiles do not match the desired ones, so workloads are not scheduled on a
+// node that would fail to start them.
+//
+// The taint is expected to be set at node registration (kubelet --register-with-taints):
+// it is removed after the first full reconcile and re-added only when the node
+// stays out of sync for longer than grace.
+type nodeTaintManager struct {
+	client   *kubeClient
+	nodeName string
+	key      string
+	grace    time.Duration
+	now      func() time.Time
+
+	synced     bool      // a full reconcile succeeded at least once
+	lastInSync time.Time // last time desired and loaded sets matched
+	stateKnown bool      // taintSet reflects the node as of the last API call
+	taintSet   bool
+}
+
+// newNodeTaintManager builds the manager from cfg using the in-cluster credentials.
+func newNodeTaintManager(cfg *AppConfig) (*nodeTaintManager, error) {
+	if cfg.NodeName == "" {
+		return nil, errors.New("NODE_NAME must be set to manage the node readiness taint")
+	}
+
+	graceSeconds, err := strconv.Atoi(cfg.NodeTaintGraceArg)
+	if err != nil || graceSeconds < 0 {
+		return nil, fmt.Errorf("invalid NODE_TAINT_GRACE %q: expected a number of seconds", cfg.NodeTaintGraceArg)
+	}
+
+	client, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeTaintManager{
+		client:   client,
+		nodeName: cfg.NodeName,
+		key:      cfg.NodeTaintKey,
+		grace:    time.Duration(graceSeconds) * time.Second,
+		now:      cfg.clock().Now,
+	}, nil
+}
+
+// observe records the outcome of a reconcile cycle and updates the taint when needed.
+func (m *nodeTaintManager) observe(ctx context.Context, inSync bool) {
+	now := m.now()
+
+	var wantTaint bool
+
+	switch {
+	case inSync:
+		m.synced = true
+		m.lastInSync = now
+		wantTaint = false
+	case !m.synced:
+		// Leave the registration taint alone until the first full reconcile.
+		return
+	case now.Sub(m.lastInSync) > m.grace:
+		wantTaint = true
+	default:
+		return
+	}
+
+	if m.stateKnown && m.taintSet == wantTaint {
+		return
+	}
+
+	if err := m.setTaint(ctx, wantTaint); err != nil {
+		m.stateKnown = false
+		loggerFromContext(ctx).Error("failed to update node readiness taint",
+			slog.String("node", m.nodeName),
+			slog.String("taint", m.key),
+			slog.Bool("present", wantTaint),
+			slog.Any("error", err))
+
+		return
+	}
+
+	m.stateKnown = true
+	m.taintSet = wantTaint
+}
+
+// setTaint adds or removes the readiness taint. The patch is guarded by the
+// node resourceVersion so concurrent taint changes by others are not lost.
+func (m *nodeTaintManager) setTaint(ctx context.Context, present bool) error {
+	nodePath := "/api/v1/nodes/" + url.PathEscape(m.nodeName)
+
+	var node nodeObject
+	if err := m.client.do(ctx, http.MethodGet, nodePath, "", nil, &node); err != nil {
+		return fmt.Errorf("reading node: %w", err)
+	}
+
+	taints := make([]nodeTaint, 0, len(node.Spec.Taints)+1)
+	found := false
+
+	for _, t := range node.Spec.Taints {
+		if t.Key == m.key && t.Effect == nodeTaintEffect {
+			found = true
+
+			if !present {
+				continue
+			}
+		}
+
+		taints = append(taints, t)
+	}
+
+	if found == present {
+		return nil
+	}
+
+	if present {
+		taints = append(taints, nodeTaint{
+			Key:       m.key,
+			Effect:    nodeTaintEffect,
+			TimeAdded: m.now().UTC().Format(time.RFC3339),
+		})
+	}
+
+	patch := []jsonPatchOp{
+		{Op: "test", Path: "/metadata/resourceVersion", Value: node.Metadata.ResourceVersion},
+		{Op: "add", Path: "/spec/taints", Value: taints},
+	}
+
+	if err := m.client.do(ctx, http.MethodPatch, nodePath, "application/json-patch+json", patch, nil); err != nil {
+		return fmt.Errorf("patching node taints: %w", err)
+	}
+
+	if present {
+		loggerFromContext(ctx).Warn("Node tainted: AppArmor profiles out of sync",
+			slog.String("node", m.nodeName), slog.String("taint", m.key))
+	} else {
+		loggerFromContext(ctx).Info("Node readiness taint removed",
+			slog.String("node", m.nodeName), slog.String("taint", m.key))
+	}
+
+	return nil
+}
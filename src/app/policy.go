@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+var errPolicyViolation = errors.New("profile policy violation")
+
+// includeRule matches the include lines of a profile: `include <abstractions/base>`,
+// the older `#include <...>` form and quoted paths. `include if exists` is not
+// accepted, since it does not guarantee the rules are there.
+var includeRule = regexp.MustCompile(`^#?include\s+[<"]([^>"]+)[>"]`)
+
+// profilePolicy holds the organization rules applied to every custom profile:
+// a snippet, e.g. deny rules, injected at the end of each top-level profile block,
+// and the includes each block must contain once the snippet is in.
+type profilePolicy struct {
+	requiredIncludes []string
+	snippet          []byte
+}
+
+// loadProfilePolicy builds the policy from a comma separated list of includes
+// (e.g. "abstractions/base,local/deny") and the file of the snippet to inject.
+func loadProfilePolicy(requiredIncludes, snippetPath string) (*profilePolicy, error) {
+	policy := &profilePolicy{}
+
+	for include := range strings.SplitSeq(requiredIncludes, ",") {
+		if include = strings.Trim(strings.TrimSpace(include), `<>"`); include != "" {
+			policy.requiredIncludes = append(policy.requiredIncludes, include)
+		}
+	}
+
+	if snippetPath == "" {
+		return policy, nil
+	}
+
+	data, err := os.ReadFile(snippetPath) // #nosec G304 -- operator-configured PROFILE_POLICY_SNIPPET
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lintProfile(data); err != nil {
+		return nil, fmt.Errorf("policy snippet %s: %w", snippetPath, err)
+	}
+
+	if snippet := strings.Trim(string(data), "\r\n"); strings.TrimSpace(snippet) != "" {
+		var b strings.Builder
+
+		b.WriteString("  # Injected by the kapparmor profile policy.\n")
+
+		for line := range strings.SplitSeq(snippet, "\n") {
+			if line = strings.TrimRight(line, " \t\r"); line != "" {
+				b.WriteString("  " + line)
+			}
+
+			b.WriteString("\n")
+		}
+
+		policy.snippet = []byte(b.String())
+	}
+
+	return policy, nil
+}
+
+// render returns the version of the profile data to install: the snippet
+// injected, and an error when a required include is missing. A nil policy
+// returns data unchanged.
+func (p *profilePolicy) render(data []byte) ([]byte, error) {
+	if p == nil {
+		return data, nil
+	}
+
+	rendered := p.inject(data)
+
+	return rendered, p.check(rendered)
+}
+
+// hashInput returns what identifies the policy in the profile set hash.
+func (p *profilePolicy) hashInput() []byte {
+	if p == nil {
+		return nil
+	}
+
+	includes := slices.Sorted(slices.Values(p.requiredIncludes))
+
+	return fmt.Appendf(nil, "policy\x00%s\x00%s\x00", strings.Join(includes, ","), p.snippet)
+}
+
+// inject adds the snippet before the closing brace of every top-level profile block.
+func (p *profilePolicy) inject(data []byte) []byte {
+	if p == nil || len(p.snippet) == 0 {
+		return data
+	}
+
+	// From the last block, so that the offsets of the others stay valid.
+	blocks := profileBlocks(data)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		data = insertBeforeBlockEnd(data, blocks[i], p.snippet)
+	}
+
+	return data
+}
+
+// insertBeforeBlockEnd returns a copy of data with text, whole lines, inserted
+// before the closing brace of block. A brace alone on its line keeps its
+// indentation; one after rules is moved to a new line.
+func insertBeforeBlockEnd(data []byte, block profileBlock, text []byte) []byte {
+	cut := bytes.LastIndexByte(data[:block.end], '\n') + 1
+	inline := len(bytes.TrimSpace(data[cut:block.end])) > 0
+
+	if inline {
+		cut = block.end
+	}
+
+	out := make([]byte, 0, len(data)+len(text)+1)
+	out = append(out, data[:cut]...)
+
+	if inline {
+		out = append(out, '\n')
+	}
+
+	out = append(out, text...)
+
+	return append(out, data[cut:]...)
+}
+
+// check reports the required includes missing from a top-level profile block.
+func (p *profilePolicy) check(data []byte) error {
+	if p == nil {
+		return nil
+	}
+
+	blocks := profileBlocks(data)
+	if len(blocks) == 0 {
+		return fmt.Errorf("%w: no profile block found", errPolicyViolation)
+	}
+
+	var missing []string
+
+	for _, block := range blocks {
+		for _, include := range p.requiredIncludes {
+			if !block.includes[include] && !slices.Contains(missing, "<"+include+">") {
+				missing = append(missing, "<"+include+">")
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: missing required include %s", errPolicyViolation, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// profileBlock is a top-level profile of a file: the offset of its closing
+// brace and the includes found directly in its body.
+type profileBlock struct {
+	end      int
+	includes map[string]bool
+}
+
+// profileBlocks finds the top-level profile blocks of data, comments ignored as
+// in lintProfile. At the top level a '{' followed by a blank, a '}' or the end of
+// the line opens a block, wherever it is on the line; the other braces, such as
+// `@{HOME}=...` or `/usr/bin/{a,b}`, are variables and globs, closed on the same line.
+func profileBlocks(data []byte) []profileBlock {
+	var blocks []profileBlock
+
+	depth, offset := 0, 0
+
+	for line := range bytes.SplitAfterSeq(data, []byte("\n")) {
+		code := line
+		if i := bytes.IndexByte(code, '#'); i >= 0 {
+			code = code[:i]
+		}
+
+		if depth == 1 {
+			addInclude(blocks, line)
+		}
+
+		glob := 0
+
+		for i := 0; i < len(code); i++ {
+			switch c := code[i]; {
+			case depth == 0 && c == '{' && opensBlock(code[i+1:]):
+				blocks = append(blocks, profileBlock{includes: map[string]bool{}})
+				depth = 1
+				// A one-line profile may start with an include.
+				addInclude(blocks, line[i+1:])
+			case depth == 0 && c == '{':
+				glob++
+			case depth == 0 && c == '}' && glob > 0:
+				glob--
+			case c == '{':
+				depth++
+			case c == '}' && depth > 0:
+				depth--
+				if depth == 0 {
+					blocks[len(blocks)-1].end = offset + i
+				}
+			}
+		}
+
+		offset += len(line)
+	}
+
+	// An unclosed block has no end to inject at.
+	if depth > 0 {
+		blocks = blocks[:len(blocks)-1]
+	}
+
+	return blocks
+}
+
+// opensBlock reports whether the '{' followed by rest opens a profile block.
+func opensBlock(rest []byte) bool {
+	return len(rest) == 0 || rest[0] == '}' || unicode.IsSpace(rune(rest[0]))
+}
+
+// addInclude records the include that text starts with in the last block.
+func addInclude(blocks []profileBlock, text []byte) {
+	if m := includeRule.FindSubmatch(bytes.TrimSpace(text)); m != nil {
+		blocks[len(blocks)-1].includes[string(m[1])] = true
+	}
+}
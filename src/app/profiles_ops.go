@@ -3,24 +3,28 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
-	"os/exec"
 	"path"
+	"slices"
 	"sort"
 	"strings"
 
 	"github.com/tuxerrante/kapparmor/src/app/metrics"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// printLoadedProfiles prints node apparmor loaded profiles.
-func printLoadedProfiles(p map[string]bool) {
+// printLoadedProfiles logs the node apparmor loaded profiles at debug level.
+func printLoadedProfiles(ctx context.Context, p map[string]bool) {
+	logger := loggerFromContext(ctx)
 	delete(p, "")
 
 	// Sort alphabetically the profiles and print them
-	slog.Default().Info("Profiles already on this node", slog.Int("count", len(p)))
+	logger.Debug("Profiles already on this node", slog.Int("count", len(p)))
 	loadedProfileNames := make([]string, 0, len(p))
 	for loadedProfileName := range p {
 		loadedProfileNames = append(loadedProfileNames, loadedProfileName)
@@ -29,16 +33,16 @@ func printLoadedProfiles(p map[string]bool) {
 	sort.Strings(loadedProfileNames)
 	for _, p := range loadedProfileNames {
 		if p != "" {
-			slog.Default().Info("profile", slog.String("name", p))
+			logger.Debug("profile", slog.String("name", p))
 		}
 	}
 }
 
 // showProfilesDiff logs metadata about changed profiles without exposing full content.
 // Full content is redacted to prevent information disclosure (threat T7).
-func showProfilesDiff(cfg *AppConfig, newProfileName string) {
-	srcBytes, srcErr := readProfileBytes(cfg.ConfigmapRoot, cfg.ConfigmapPath, newProfileName)
-	dstBytes, dstErr := readProfileBytes(cfg.EtcRoot, cfg.EtcApparmord, newProfileName)
+func showProfilesDiff(ctx context.Context, cfg *AppConfig, newProfileName string) {
+	srcBytes, srcErr := readSourceProfile(ctx, cfg, newProfileName)
+	dstBytes, dstErr := readProfileBytes(cfg.filesystem(), cfg.EtcRoot, cfg.EtcApparmord, newProfileName)
 
 	srcHash, srcLines := profileDigest(srcBytes, srcErr)
 	dstHash, dstLines := profileDigest(dstBytes, dstErr)
@@ -59,7 +63,7 @@ func showProfilesDiff(cfg *AppConfig, newProfileName string) {
 		attrs = append(attrs, slog.String("dst_error", dstErr.Error()))
 	}
 
-	slog.Default().Warn("Profile content changed", attrs...)
+	loggerFromContext(ctx).Warn("Profile content changed", attrs...)
 }
 
 func profileDigest(data []byte, readErr error) (hash string, lines int) {
@@ -88,37 +92,76 @@ func countLines(data []byte) int {
 
 // calculateProfileChanges compares desired state (newProfiles) vs current state (customLoadedProfiles).
 // It returns two lists: profiles to apply and profiles to unload/remove.
-func calculateProfileChanges(cfg *AppConfig, newProfiles map[string]bool, customLoadedProfiles map[string]bool) (
+// Profiles breaking the policy, whose digest is not in the allowlist or whose signature
+// was rejected are blocked: neither applied nor unloaded.
+func calculateProfileChanges(ctx context.Context, cfg *AppConfig, newProfiles map[string]bool, customLoadedProfiles map[string]bool) (
 	toApply []string,
 	toUnload []string,
 	err error,
 ) {
+	logger := loggerFromContext(ctx)
 	newProfilesToApply := make([]string, 0, len(newProfiles))
+	blocked := map[string]string{}
+
+	cfg.Allowlist.refresh(ctx)
 
 	for newProfileName := range newProfiles {
 		filePath1 := path.Join(cfg.ConfigmapPath, newProfileName)
 
+		if reason := signatureRejection(ctx, newProfileName); reason != "" {
+			logger.Warn("Profile blocked, keeping the installed version",
+				slog.String("name", newProfileName), slog.String("reason", reason))
+			blocked[newProfileName] = reason
+
+			continue
+		}
+
 		// Does it exist a profile with the same name already loaded?
 		if customLoadedProfiles[newProfileName] {
-			slog.Default().Info("Checking profile", slog.String("path", filePath1))
+			logger.Info("Checking profile", slog.String("path", filePath1))
 
-			srcBytes, errSrc := readProfileBytes(cfg.ConfigmapRoot, cfg.ConfigmapPath, newProfileName)
-			dstBytes, errDst := readProfileBytes(cfg.EtcRoot, cfg.EtcApparmord, newProfileName)
+			srcBytes, errSrc := readSourceProfile(ctx, cfg, newProfileName)
+			dstBytes, errDst := readProfileBytes(cfg.filesystem(), cfg.EtcRoot, cfg.EtcApparmord, newProfileName)
 			if errSrc != nil || errDst != nil {
 				return nil, nil, fmt.Errorf("error checking content of profile %q: configmap: %v; etc: %v",
 					newProfileName, errSrc, errDst)
 			}
 
-			if profileBytesEqual(srcBytes, dstBytes) {
-				slog.Default().Info("Contents are the same, skipping", slog.String("name", newProfileName))
+			desired, reason := desiredProfile(ctx, cfg, newProfileName, srcBytes)
+			if reason != "" {
+				logger.Warn("Profile blocked, keeping the installed version",
+					slog.String("name", newProfileName), slog.String("reason", reason))
+				blocked[newProfileName] = reason
+
+				continue
+			}
+
+			if profileBytesEqual(desired, dstBytes) {
+				logger.Info("Contents are the same, skipping", slog.String("name", newProfileName))
 
 				continue
 			}
-			slog.Default().Info("Content changed, scheduling replacement", slog.String("name", newProfileName))
-			showProfilesDiff(cfg, newProfileName)
+
+			logger.Info("Content changed, scheduling replacement", slog.String("name", newProfileName))
+			showProfilesDiff(ctx, cfg, newProfileName)
 			metrics.ProfileModified(newProfileName)
 		} else {
-			slog.Default().Info("New profile found, scheduling for load", slog.String("name", newProfileName))
+			if cfg.Allowlist != nil || cfg.Policy != nil || cfg.Templater != nil {
+				srcBytes, err := readSourceProfile(ctx, cfg, newProfileName)
+				if err != nil {
+					return nil, nil, fmt.Errorf("error reading profile %q: %w", newProfileName, err)
+				}
+
+				if _, reason := desiredProfile(ctx, cfg, newProfileName, srcBytes); reason != "" {
+					logger.Warn("Profile blocked, not loading it",
+						slog.String("name", newProfileName), slog.String("reason", reason))
+					blocked[newProfileName] = reason
+
+					continue
+				}
+			}
+
+			logger.Info("New profile found, scheduling for load", slog.String("name", newProfileName))
 		}
 
 		newProfilesToApply = append(newProfilesToApply, filePath1)
@@ -132,17 +175,83 @@ func calculateProfileChanges(cfg *AppConfig, newProfiles map[string]bool, custom
 		}
 	}
 
+	cfg.History.setBlocked(blocked)
+	metrics.SetBlockedProfiles(slices.Sorted(maps.Keys(blocked)))
+
 	return newProfilesToApply, loadedProfilesToUnload, nil
 }
 
+// desiredProfile returns the version of a profile to install (see renderProfile).
+// The reason is set when it must not be applied, because it cannot be rendered,
+// breaks the policy or is not in the allowlist.
+func desiredProfile(ctx context.Context, cfg *AppConfig, name string, src []byte) (desired []byte, reason string) {
+	desired, err := renderProfile(ctx, cfg, name, src)
+	if err != nil {
+		return nil, err.Error()
+	}
+
+	return desired, cfg.Allowlist.blockReason(name, src)
+}
+
+// renderProfile returns the version of a profile that is installed, hashed and
+// compared: its ConfigMap content src executed as a template, then the policy
+// snippet injected. The source was validated by getNewProfiles; a rendered
+// template is validated again.
+func renderProfile(ctx context.Context, cfg *AppConfig, name string, src []byte) ([]byte, error) {
+	rendered, err := cfg.Templater.render(name, src)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Templater != nil {
+		if err := validateProfileContent(ctx, name, rendered); err != nil {
+			return nil, fmt.Errorf("rendered profile: %w", err)
+		}
+	}
+
+	return cfg.Policy.render(rendered)
+}
+
+// stageRenderedProfile writes the rendered version of the profile name next to
+// the installed profiles, under a hidden name never read as a profile, and
+// returns its path. loadRenderedProfile loads it and renames it over the installed file.
+func stageRenderedProfile(ctx context.Context, cfg *AppConfig, name string) (string, error) {
+	src, err := readSourceProfile(ctx, cfg, name)
+	if err != nil {
+		return "", err
+	}
+
+	rendered, err := renderProfile(ctx, cfg, name, src)
+	if err != nil {
+		return "", err
+	}
+
+	staged := "." + name + ".rendered"
+
+	if cfg.EtcRoot != nil {
+		err = cfg.EtcRoot.WriteFile(staged, rendered, 0o600)
+	} else {
+		err = os.WriteFile(path.Join(cfg.EtcApparmord, staged), rendered, 0o600)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(cfg.EtcApparmord, staged), nil
+}
+
 // It reads the files provided in the ConfigmapPath.
-func getNewProfiles(cfg *AppConfig) (bool, map[string]bool) {
-	return areProfilesReadable(cfg)
+// Template values are reloaded first, so that calculateProfileChanges renders with the current ones.
+func getNewProfiles(ctx context.Context, cfg *AppConfig) (bool, map[string]bool) {
+	cfg.Templater.refresh(ctx)
+
+	return areProfilesReadable(ctx, cfg)
 }
 
 // It reads a list of profile names from a singe file under KERNEL_PATH.
-func getLoadedProfiles(cfg *AppConfig) (map[string]bool, map[string]bool, error) {
-	return getProfilesNamesFromFile(cfg.KernelPath, ProfileNamePrefix)
+func getLoadedProfiles(ctx context.Context, cfg *AppConfig) (map[string]bool, map[string]bool, error) {
+	return getProfilesNamesFromFile(ctx, cfg.filesystem(), cfg.KernelPath, ProfileNamePrefix)
 }
 
 // Search for profiles already present on the current node in '$apparmorfs/profiles' folder
@@ -150,8 +259,8 @@ func getLoadedProfiles(cfg *AppConfig) (map[string]bool, map[string]bool, error)
 // Output
 //   - profiles{} map containing all the loaded profiles
 //   - customProfiles{} map containing only the profiles starting with the given PREFIX
-func getProfilesNamesFromFile(profilesPath, profileNamePrefix string) (map[string]bool, map[string]bool, error) {
-	profilesFile, err := os.Open(profilesPath) // #nosec G304 -- profilesPath is a system path
+func getProfilesNamesFromFile(ctx context.Context, fsys FileSystem, profilesPath, profileNamePrefix string) (map[string]bool, map[string]bool, error) {
+	profilesFile, err := fsys.Open(profilesPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to open %s: %w", profilesPath, err)
 	}
@@ -159,7 +268,7 @@ func getProfilesNamesFromFile(profilesPath, profileNamePrefix string) (map[strin
 	defer func() {
 		err := profilesFile.Close()
 		if err != nil {
-			slog.Default().Warn("error closing profilesFile", slog.Any("error", err))
+			loggerFromContext(ctx).Warn("error closing profilesFile", slog.Any("error", err))
 		}
 	}()
 
@@ -193,32 +302,48 @@ func parseProfileName(profileLine string) string {
 	return strings.TrimSpace(profileLine[:modeIndex])
 }
 
-func execApparmor(cfg *AppConfig, args ...string) error {
-	cmd := exec.Command(cfg.ProfilerFullPath, args...) // #nosec G204 -- profilename validated before
-	stderr := &bytes.Buffer{}
-	cmd.Stderr = stderr
-	out, err := cmd.Output()
+func execApparmor(ctx context.Context, cfg *AppConfig, args ...string) (err error) {
+	_, span := startSpan(ctx, "execApparmor",
+		attribute.String("operation", parserOperation(args)),
+		attribute.String("path", args[len(args)-1]))
+	defer func() { endSpan(span, err) }()
+
+	start := cfg.clock().Now()
+	out, stderr, err := cfg.loader().Run(ctx, args...)
+	metrics.ParserInvoked(parserOperation(args), cfg.clock().Now().Sub(start), err)
 
 	path := args[len(args)-1]
+	logger := loggerFromContext(ctx)
 
 	if len(out) > 0 {
-		slog.Default().Info("execApparmor", slog.String("path", path), slog.String("stdout", string(out)))
+		logger.Info("execApparmor", slog.String("path", path), slog.String("stdout", string(out)))
 	} else {
-		slog.Default().Info("No profiles", slog.String("path", path))
+		logger.Info("No profiles", slog.String("path", path))
 	}
 
 	if err != nil {
-		if stderr.Len() > 0 {
-			slog.Default().Error("apparmor_parser stderr", slog.String("stderr", stderr.String()))
+		if len(stderr) > 0 {
+			logger.Error("apparmor_parser stderr", slog.String("stderr", string(stderr)))
 		}
 
-		return fmt.Errorf("error loading profile >> %w >> %v", err, stderr)
+		return fmt.Errorf("error loading profile >> %w >> %s", err, stderr)
 	}
 
 	return nil
 }
 
-// A line separator to simplify logs reading.
-func printLogSeparator() {
-	slog.Default().Info("============================================================")
+// parserOperation returns the apparmor_parser action requested by args, for metrics labels.
+func parserOperation(args []string) string {
+	for _, arg := range args {
+		switch arg {
+		case "--replace", "-r":
+			return "replace"
+		case "--remove", "-R":
+			return "remove"
+		case "--reload":
+			return "reload"
+		}
+	}
+
+	return "other"
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// Annotations of rendered profile ConfigMaps. The set hash is the one the staged
+// rollout uses as target hash when neither the profile policy nor templates are
+// configured, since they are part of it. The digests are the source sha256 reported per
+// profile by the node status (sourceProfiles) and the source_sha256 label of the
+// kapparmor_profile_info metric.
+const (
+	annotationProfileSetHash = "kapparmor.io/profile-set-hash"
+	annotationProfileDigests = "kapparmor.io/profile-digests"
+)
+
+// renderedConfigMap is the manifest written by the render command.
+type renderedConfigMap struct {
+	APIVersion string `json:"apiVersion" yaml:"apiVersion"`
+	Kind       string `json:"kind" yaml:"kind"`
+	Metadata   struct {
+		Name        string            `json:"name" yaml:"name"`
+		Namespace   string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+		Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations" yaml:"annotations"`
+	} `json:"metadata" yaml:"metadata"`
+	Data map[string]string `json:"data" yaml:"data"`
+}
+
+// runRender validates a profiles directory with the node agent rules and prints
+// the profiles ConfigMap, annotated with content hashes. Nothing is printed when
+// a profile is invalid.
+//
+//	kapparmor render [-o yaml|json] [-name name] [-namespace ns] <directory>
+func runRender(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	output := flags.String("o", "yaml", "output format: yaml or json")
+	name := flags.String("name", "kapparmor-profiles", "name of the ConfigMap")
+	namespace := flags.String("namespace", "", "namespace of the ConfigMap, omitted when empty")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: kapparmor render [-o yaml|json] [-name name] [-namespace ns] <directory>")
+	}
+
+	profiles, err := readProfileDirectory(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if problems := validateProfileSet(context.Background(), &AppConfig{}, profiles); len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errValidationFailed, strings.Join(problems, "; "))
+	}
+
+	cm, err := renderProfilesConfigMap(*name, *namespace, profiles)
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "yaml":
+		data, err := yaml.Marshal(cm)
+		if err != nil {
+			return err
+		}
+
+		_, err = stdout.Write(data)
+
+		return err
+	case formatJSON:
+		return writeJSONIndent(stdout, cm)
+	default:
+		return fmt.Errorf("unknown output format %q (available: yaml, json)", *output)
+	}
+}
+
+// renderProfilesConfigMap builds the ConfigMap the node agent mounts. Hidden
+// entries are skipped, as they would be on the node; signatures are kept but
+// have no digest.
+func renderProfilesConfigMap(name, namespace string, profiles map[string][]byte) (*renderedConfigMap, error) {
+	cm := &renderedConfigMap{APIVersion: "v1", Kind: "ConfigMap", Data: map[string]string{}}
+	cm.Metadata.Name = name
+	cm.Metadata.Namespace = namespace
+	cm.Metadata.Labels = map[string]string{"app.kubernetes.io/managed-by": "kapparmor-render"}
+
+	digests := map[string]string{}
+
+	for profileName, data := range profiles {
+		if strings.HasPrefix(profileName, ".") {
+			continue
+		}
+
+		cm.Data[profileName] = string(data)
+
+		if isProfileEntry(profileName) {
+			digests[profileName], _ = profileDigest(data, nil)
+		}
+	}
+
+	// encoding/json sorts map keys, so the annotation is stable.
+	encoded, err := json.Marshal(digests)
+	if err != nil {
+		return nil, err
+	}
+
+	cm.Metadata.Annotations = map[string]string{
+		annotationProfileSetHash: hashProfileSet(profiles),
+		annotationProfileDigests: string(encoded),
+	}
+
+	return cm, nil
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Staged rollout state is kept in the "kapparmor-rollout" Lease of the release
+// namespace, held by the coordinating agent (leader). Canary health is read from
+// the node status Leases (see nodeStatusReporter). The sources of the stable
+// profile set are kept in the "kapparmor-rollout-stable" ConfigMap, created by
+// the chart, for the held nodes that have nothing installed.
+const (
+	rolloutLeaseName          = "kapparmor-rollout"
+	rolloutStableConfigMap    = "kapparmor-rollout-stable"
+	annotationStableTemplates = "kapparmor.io/stable-template-vars"
+	annotationTargetHash      = "kapparmor.io/target-hash"
+	annotationStableHash      = "kapparmor.io/stable-hash"
+	annotationPhase           = "kapparmor.io/rollout-phase"
+	annotationCanaries        = "kapparmor.io/canary-nodes"
+	annotationStartedAt       = "kapparmor.io/rollout-started-at"
+
+	rolloutPhaseCanary   = "canary"
+	rolloutPhasePromoted = "promoted"
+	rolloutPhaseFailed   = "failed"
+)
+
+// rolloutState is the content of the kapparmor-rollout Lease annotations.
+type rolloutState struct {
+	target    string // profile set hash being rolled out
+	stable    string // last promoted profile set hash
+	phase     string
+	canaries  []string
+	startedAt time.Time
+}
+
+// rolloutManager gates profile changes behind a canary phase: a new profile set
+// is applied on a percentage of nodes first, and on the rest of the fleet once
+// the canaries reconciled it without errors for the whole soak time.
+type rolloutManager struct {
+	client        *kubeClient
+	namespace     string
+	nodeName      string
+	canaryPercent int
+	soak          time.Duration
+	leaseDuration time.Duration
+	now           func() time.Time
+	// storedStable is the stable hash known to be in the rolloutStableConfigMap.
+	storedStable string
+}
+
+// newRolloutManager builds the manager from cfg. It shares the API client and
+// the node identity of the node status reporter, whose reports it reads.
+func newRolloutManager(cfg *AppConfig, pollTime int) (*rolloutManager, error) {
+	const maxPercent = 100
+
+	reporter := cfg.NodeStatus
+	if reporter == nil {
+		return nil, errors.New("the staged rollout needs the node status reports")
+	}
+
+	percent, err := strconv.Atoi(cfg.RolloutCanaryPercentArg)
+	if err != nil || percent < 1 || percent > maxPercent {
+		return nil, fmt.Errorf("invalid ROLLOUT_CANARY_PERCENT %q: expected a number between 1 and 100",
+			cfg.RolloutCanaryPercentArg)
+	}
+
+	soakSeconds, err := strconv.Atoi(cfg.RolloutSoakArg)
+	if err != nil || soakSeconds < 0 {
+		return nil, fmt.Errorf("invalid ROLLOUT_SOAK %q: expected a number of seconds", cfg.RolloutSoakArg)
+	}
+
+	return &rolloutManager{
+		client:        reporter.client,
+		namespace:     reporter.namespace,
+		nodeName:      reporter.nodeName,
+		canaryPercent: percent,
+		soak:          time.Duration(soakSeconds) * time.Second,
+		// The leader must renew within a few polls, otherwise another agent takes over.
+		leaseDuration: 3 * time.Duration(pollTime) * time.Second,
+		now:           cfg.clock().Now,
+	}, nil
+}
+
+// profileSetDigest hashes the names and contents of the profiles in the
+// ConfigMap volume, with the same trimming used for change detection, and the
+// settings they are rendered with: the profile policy and the template variables.
+// Node labels and names are left out, so every node computes the same hash.
+func profileSetDigest(cfg *AppConfig) (string, error) {
+	profiles, err := readProfileSet(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	return profileSetHash(profiles, cfg.Policy, cfg.Templater.vars()), nil
+}
+
+// readProfileSet reads the regular, non hidden entries of the ConfigMap volume:
+// the profiles and their signatures.
+func readProfileSet(cfg *AppConfig) (map[string][]byte, error) {
+	var (
+		entries []fs.DirEntry
+		err     error
+	)
+
+	if cfg.ConfigmapRoot != nil {
+		entries, err = fs.ReadDir(cfg.ConfigmapRoot.FS(), ".")
+	} else {
+		entries, err = os.ReadDir(cfg.ConfigmapPath)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := map[string][]byte{}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		data, err := readProfileBytes(cfg.filesystem(), cfg.ConfigmapRoot, cfg.ConfigmapPath, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		profiles[entry.Name()] = data
+	}
+
+	return profiles, nil
+}
+
+// profileSetHash is the profileSetDigest of in-memory profiles rendered with
+// policy and, when templates are on (vars not nil), the variables vars.
+func profileSetHash(profiles map[string][]byte, policy *profilePolicy, vars map[string]string) string {
+	digest := hashProfileSet(profiles)
+	if policy == nil && vars == nil {
+		return digest
+	}
+
+	h := sha256.New()
+	h.Write([]byte(digest))
+	h.Write(policy.hashInput())
+	h.Write(hashTemplateVars(vars))
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// hashProfileSet is the profileSetDigest of in-memory profiles. Hidden entries and signatures are skipped.
+func hashProfileSet(profiles map[string][]byte) string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		if isProfileEntry(name) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	h := sha256.New()
+
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write(bytes.TrimSpace(profiles[name]))
+		h.Write([]byte{0})
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// beforeReconcile advances the rollout when this agent is the leader and reports
+// whether this node may apply the profile set identified by desiredHash.
+// Errors talking to the API server hold the change: the installed profiles stay.
+// A node applying the stable set stores it, a held node without any installed
+// profile, e.g. restarted or added during the rollout, installs it.
+func (m *rolloutManager) beforeReconcile(ctx context.Context, cfg *AppConfig, desiredHash string) bool {
+	state, err := m.coordinate(ctx, desiredHash)
+	if err != nil {
+		loggerFromContext(ctx).Error("staged rollout unavailable, keeping installed profiles", slog.Any("error", err))
+
+		return false
+	}
+
+	if state.allows(m.nodeName, desiredHash) {
+		if desiredHash == state.stable {
+			m.storeStable(ctx, cfg, state.stable)
+		}
+
+		return true
+	}
+
+	loggerFromContext(ctx).Info("Profile change held by staged rollout",
+		slog.String("desired_hash", desiredHash),
+		slog.String("target_hash", state.target),
+		slog.String("phase", state.phase))
+
+	m.restoreStable(ctx, cfg, state.stable)
+
+	return false
+}
+
+// storeStable writes the ConfigMap sources of the stable profile set, with the
+// template variables they are rendered with, in the rolloutStableConfigMap.
+func (m *rolloutManager) storeStable(ctx context.Context, cfg *AppConfig, stable string) {
+	if m.storedStable == stable {
+		return
+	}
+
+	logger := loggerFromContext(ctx)
+
+	cm, err := m.client.getConfigMap(ctx, m.namespace, rolloutStableConfigMap)
+	if err != nil || cm == nil {
+		logger.Warn("Cannot read the stable profile set ConfigMap, held nodes without profiles will stay empty",
+			slog.String("configmap", rolloutStableConfigMap), slog.Any("error", err))
+
+		return
+	}
+
+	if cm.Metadata.Annotations[annotationStableHash] == stable {
+		m.storedStable = stable
+
+		return
+	}
+
+	profiles, err := readProfileSet(cfg)
+	vars := cfg.Templater.vars()
+
+	// The ConfigMap volume changed since desiredHash was computed: next cycle.
+	if err != nil || profileSetHash(profiles, cfg.Policy, vars) != stable {
+		return
+	}
+
+	cm.Data, cm.BinaryData = nil, profiles
+	if cm.Metadata.Annotations == nil {
+		cm.Metadata.Annotations = map[string]string{}
+	}
+
+	cm.Metadata.Annotations[annotationStableHash] = stable
+	delete(cm.Metadata.Annotations, annotationStableTemplates)
+
+	if vars != nil {
+		encoded, _ := json.Marshal(vars) // a map of strings always encodes
+		cm.Metadata.Annotations[annotationStableTemplates] = string(encoded)
+	}
+
+	if err := m.client.updateConfigMap(ctx, cm); err != nil {
+		// A conflict means another node stored it first.
+		logger.Warn("Cannot store the stable profile set", slog.Any("error", err))
+
+		return
+	}
+
+	m.storedStable = stable
+	logger.Info("Stored the stable profile set", slog.String("stable_hash", stable))
+}
+
+// restoreStable installs the stable profile set stored by storeStable when no
+// profile is installed on the node, so a held node keeps the previous version
+// instead of running without custom profiles until the promotion.
+func (m *rolloutManager) restoreStable(ctx context.Context, cfg *AppConfig, stable string) {
+	logger := loggerFromContext(ctx)
+
+	installed, err := hasInstalledProfiles(cfg)
+	if err != nil || installed || stable == "" {
+		return
+	}
+
+	cm, err := m.client.getConfigMap(ctx, m.namespace, rolloutStableConfigMap)
+	if err != nil || cm == nil || cm.Metadata.Annotations[annotationStableHash] != stable {
+		logger.Warn("The stable profile set is not stored, the node stays without custom profiles until the promotion",
+			slog.String("stable_hash", stable), slog.Any("error", err))
+
+		return
+	}
+
+	profiles := profileSetFromConfigMap(cm)
+
+	var vars map[string]string
+	if encoded := cm.Metadata.Annotations[annotationStableTemplates]; encoded != "" {
+		if err := json.Unmarshal([]byte(encoded), &vars); err != nil {
+			logger.Warn("Invalid template variables in the stored stable profile set", slog.Any("error", err))
+
+			return
+		}
+	}
+
+	// The node must render the stored sources as the other nodes did, with the same policy.
+	if profileSetHash(profiles, cfg.Policy, vars) != stable {
+		logger.Warn("The stored stable profile set does not match the profile policy of this node",
+			slog.String("stable_hash", stable))
+
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "kapparmor-stable-")
+	if err != nil {
+		logger.Warn("Cannot stage the stable profile set", slog.Any("error", err))
+
+		return
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	for name, data := range profiles {
+		if ok, _ := isValidFilename(strings.TrimSuffix(name, SignatureSuffix)); !ok {
+			continue
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			logger.Warn("Cannot stage the stable profile set", slog.Any("error", err))
+
+			return
+		}
+	}
+
+	// The stable sources go through the usual checks: signatures, allowlist and policy.
+	stableCfg := *cfg
+	stableCfg.ConfigmapPath, stableCfg.ConfigmapRoot = dir, nil
+	stableCfg.Templater = cfg.Templater.withVars(vars)
+
+	applied, err := loadNewProfiles(ctx, &stableCfg)
+	if err != nil {
+		logger.Error("Cannot install the stable profile set", slog.Any("error", err))
+
+		return
+	}
+
+	logger.Info("Installed the stable profile set on a node held by the staged rollout",
+		slog.String("stable_hash", stable), slog.Any("profiles", applied))
+}
+
+// hasInstalledProfiles reports whether the custom profile directory holds a profile.
+func hasInstalledProfiles(cfg *AppConfig) (bool, error) {
+	var (
+		entries []fs.DirEntry
+		err     error
+	)
+
+	if cfg.EtcRoot != nil {
+		entries, err = fs.ReadDir(cfg.EtcRoot.FS(), ".")
+	} else {
+		entries, err = os.ReadDir(cfg.EtcApparmord)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isProfileEntry(entry.Name()) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// coordinate returns the current rollout state, first advancing it when this
+// agent holds (or can take) the rollout Lease.
+func (m *rolloutManager) coordinate(ctx context.Context, desiredHash string) (*rolloutState, error) {
+	now := m.now()
+
+	lease, err := m.client.getLease(ctx, m.namespace, rolloutLeaseName)
+	if err != nil {
+		return nil, fmt.Errorf("reading rollout lease: %w", err)
+	}
+
+	if lease == nil {
+		// First agent ever: there is nothing to protect yet, the current set is stable.
+		lease = newLease(m.namespace, rolloutLeaseName)
+		m.hold(lease, now)
+		writeRolloutState(lease, &rolloutState{target: desiredHash, stable: desiredHash, phase: rolloutPhasePromoted})
+
+		created, err := m.client.createLease(ctx, lease)
+		if isKubeStatus(err, http.StatusConflict) {
+			return m.readState(ctx)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("creating rollout lease: %w", err)
+		}
+
+		return readRolloutState(created), nil
+	}
+
+	state := readRolloutState(lease)
+
+	holder := lease.Spec.HolderIdentity
+	expired := now.After(lease.renewedAt().Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second))
+
+	if holder != m.nodeName && !expired {
+		return state, nil
+	}
+
+	reports, err := m.nodeReports(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if holder != m.nodeName {
+		loggerFromContext(ctx).Info("Taking over staged rollout coordination", slog.String("previous_holder", holder))
+	}
+
+	m.advance(ctx, state, desiredHash, reports, now)
+	m.hold(lease, now)
+	writeRolloutState(lease, state)
+
+	updated, err := m.client.updateLease(ctx, lease)
+	if isKubeStatus(err, http.StatusConflict) {
+		// Another agent won the race: follow its view.
+		return m.readState(ctx)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("updating rollout lease: %w", err)
+	}
+
+	return readRolloutState(updated), nil
+}
+
+func (m *rolloutManager) readState(ctx context.Context) (*rolloutState, error) {
+	lease, err := m.client.getLease(ctx, m.namespace, rolloutLeaseName)
+	if err != nil {
+		return nil, err
+	}
+
+	if lease == nil {
+		return nil, errors.New("rollout lease disappeared")
+	}
+
+	return readRolloutState(lease), nil
+}
+
+func (m *rolloutManager) hold(lease *leaseObject, now time.Time) {
+	lease.Spec.HolderIdentity = m.nodeName
+	lease.Spec.LeaseDurationSeconds = int(m.leaseDuration.Seconds())
+	lease.Spec.RenewTime = now.UTC().Format(leaseTimeFormat)
+}
+
+// advance moves the rollout state machine forward. Only the leader calls it.
+func (m *rolloutManager) advance(ctx context.Context, state *rolloutState, desiredHash string, reports map[string]nodeStatus, now time.Time) {
+	if desiredHash != state.target {
+		if desiredHash == state.stable {
+			// Back to the last good profile set: no need to canary it again.
+			*state = rolloutState{target: desiredHash, stable: desiredHash, phase: rolloutPhasePromoted}
+			loggerFromContext(ctx).Info("Staged rollout reverted to the stable profiles", slog.String("stable_hash", desiredHash))
+
+			return
+		}
+
+		*state = rolloutState{
+			target:    desiredHash,
+			stable:    state.stable,
+			phase:     rolloutPhaseCanary,
+			canaries:  m.pickCanaries(reports, desiredHash),
+			startedAt: now,
+		}
+
+		loggerFromContext(ctx).Info("Staged rollout started",
+			slog.String("target_hash", state.target),
+			slog.String("phase", state.phase),
+			slog.Any("canaries", state.canaries))
+
+		return
+	}
+
+	if state.phase != rolloutPhaseCanary {
+		return
+	}
+
+	m.dropMissingCanaries(ctx, state, reports, now)
+
+	healthy := 0
+
+	for _, canary := range state.canaries {
+		report, found := reports[canary]
+		if !found {
+			continue
+		}
+
+		if report.DesiredHash == state.target && !report.ReconcileOK {
+			state.phase = rolloutPhaseFailed
+			loggerFromContext(ctx).Error("Staged rollout failed on a canary node, the rest of the fleet keeps the stable profiles",
+				slog.String("node", canary),
+				slog.String("target_hash", state.target),
+				slog.String("stable_hash", state.stable))
+
+			return
+		}
+
+		if report.AppliedHash == state.target && report.ReconcileOK {
+			healthy++
+		}
+	}
+
+	if healthy == len(state.canaries) && now.Sub(state.startedAt) >= m.soak {
+		state.phase = rolloutPhasePromoted
+		state.stable = state.target
+		loggerFromContext(ctx).Info("Staged rollout promoted to all nodes", slog.String("target_hash", state.target))
+	}
+}
+
+// dropMissingCanaries removes the canaries without a recent report, e.g. deleted
+// or drained nodes, which would otherwise hold the promotion forever. When none
+// is left, new canaries are picked and the soak time starts again.
+func (m *rolloutManager) dropMissingCanaries(ctx context.Context, state *rolloutState, reports map[string]nodeStatus, now time.Time) {
+	var reporting, dropped []string
+
+	for _, node := range state.canaries {
+		if _, found := reports[node]; found {
+			reporting = append(reporting, node)
+		} else {
+			dropped = append(dropped, node)
+		}
+	}
+
+	if len(dropped) == 0 {
+		return
+	}
+
+	loggerFromContext(ctx).Warn("Dropping staged rollout canaries that stopped reporting",
+		slog.Any("nodes", dropped),
+		slog.String("target_hash", state.target))
+
+	state.canaries = reporting
+
+	if len(reporting) == 0 {
+		state.canaries = m.pickCanaries(reports, state.target)
+		state.startedAt = now
+		loggerFromContext(ctx).Info("Staged rollout restarted on new canaries", slog.Any("canaries", state.canaries))
+	}
+}
+
+// pickCanaries chooses ceil(canaryPercent%) of the reporting nodes. The order
+// depends on the target hash, so successive rollouts start on different nodes.
+func (m *rolloutManager) pickCanaries(reports map[string]nodeStatus, targetHash string) []string {
+	nodes := make([]string, 0, len(reports))
+	for node := range reports {
+		nodes = append(nodes, node)
+	}
+
+	if len(nodes) == 0 {
+		return []string{m.nodeName}
+	}
+
+	rank := func(node string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(targetHash + "/" + node))
+
+		return h.Sum64()
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return rank(nodes[i]) < rank(nodes[j]) })
+
+	count := (len(nodes)*m.canaryPercent + 99) / 100 //nolint:mnd // ceil of a percentage
+	canaries := nodes[:count]
+	sort.Strings(canaries)
+
+	return canaries
+}
+
+// nodeReports returns the node statuses renewed recently enough to be trusted.
+func (m *rolloutManager) nodeReports(ctx context.Context) (map[string]nodeStatus, error) {
+	statuses, err := listNodeStatuses(ctx, m.client, m.namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make(map[string]nodeStatus, len(statuses))
+	now := m.now()
+
+	for _, status := range statuses {
+		if now.Sub(status.ReportedAt) <= m.leaseDuration {
+			reports[status.Node] = status.nodeStatus
+		}
+	}
+
+	return reports, nil
+}
+
+// allows reports whether node may apply the profile set hashed as desiredHash.
+func (s *rolloutState) allows(node, desiredHash string) bool {
+	switch {
+	case desiredHash == s.stable:
+		return true
+	case desiredHash != s.target:
+		// The leader has not seen this profile set yet.
+		return false
+	case s.phase == rolloutPhasePromoted:
+		return true
+	case s.phase == rolloutPhaseCanary:
+		return slices.Contains(s.canaries, node)
+	default:
+		return false
+	}
+}
+
+func readRolloutState(lease *leaseObject) *rolloutState {
+	a := lease.Metadata.Annotations
+	state := &rolloutState{
+		target: a[annotationTargetHash],
+		stable: a[annotationStableHash],
+		phase:  a[annotationPhase],
+	}
+
+	if canaries := a[annotationCanaries]; canaries != "" {
+		state.canaries = strings.Split(canaries, ",")
+	}
+
+	state.startedAt, _ = time.Parse(time.RFC3339, a[annotationStartedAt])
+
+	return state
+}
+
+func writeRolloutState(lease *leaseObject, state *rolloutState) {
+	if lease.Metadata.Annotations == nil {
+		lease.Metadata.Annotations = map[string]string{}
+	}
+
+	a := lease.Metadata.Annotations
+	a[annotationTargetHash] = state.target
+	a[annotationStableHash] = state.stable
+	a[annotationPhase] = state.phase
+	a[annotationCanaries] = strings.Join(state.canaries, ",")
+	a[annotationStartedAt] = ""
+
+	if !state.startedAt.IsZero() {
+		a[annotationStartedAt] = state.startedAt.UTC().Format(time.RFC3339)
+	}
+}
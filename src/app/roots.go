@@ -45,14 +45,13 @@ func closeProfileRoots(cfg *AppConfig) {
 }
 
 // readProfileBytes reads a profile file by leaf name under root when non-nil,
-// otherwise uses basePath/name (tests and fallback).
-func readProfileBytes(root *os.Root, basePath, name string) ([]byte, error) {
+// otherwise reads basePath/name from fsys (tests and fallback).
+func readProfileBytes(fsys FileSystem, root *os.Root, basePath, name string) ([]byte, error) {
 	if root != nil {
 		return root.ReadFile(name)
 	}
 
-	// #nosec G304 -- basePath is configured root; name is a validated profile leaf
-	return os.ReadFile(filepath.Join(basePath, name))
+	return readFile(fsys, filepath.Join(basePath, name))
 }
 
 // profileBytesEqual mirrors HasTheSameContent trimming semantics for comparing
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	serverReadTimeout     = 10 * time.Second
+	serverWriteTimeout    = 10 * time.Second
+	serverShutdownTimeout = 5 * time.Second
+)
+
+// newModeServer returns an http.Server with the timeouts shared by the webhook and aggregator modes.
+func newModeServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+	}
+}
+
+// serveUntilStopped runs listen (srv.ListenAndServe or its TLS variant) until
+// ctx is canceled or a stop signal is received, then shuts srv down gracefully.
+func serveUntilStopped(ctx context.Context, name string, srv *http.Server, listen func() error) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- listen()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("%s server failed: %w", name, err)
+	case <-ctx.Done():
+		slog.Default().Info("Stopping server", slog.String("server", name))
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%s server shutdown: %w", name, err)
+	}
+
+	return nil
+}
+
+func writeHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var (
+	errSignatureMissing = errors.New("no signature")
+	errSignatureInvalid = errors.New("signature does not match any trusted key")
+)
+
+// profileVerifier checks the detached signature shipped with each profile in the
+// "<profile>.sig" key of the ConfigMap: the base64 signature of the profile file,
+// by ed25519 keys or by the ECDSA keys of `cosign sign-blob`.
+type profileVerifier struct {
+	keys []crypto.PublicKey
+}
+
+// loadProfileVerifier reads the PEM public keys of a file, or of the files of a
+// directory such as a mounted ConfigMap.
+func loadProfileVerifier(path string) (*profileVerifier, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		files = files[:0]
+
+		for _, entry := range entries {
+			if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	verifier := &profileVerifier{}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file) // #nosec G304 -- operator-configured PROFILE_SIGNING_KEYS
+		if err != nil {
+			return nil, err
+		}
+
+		keys, err := parsePublicKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		verifier.keys = append(verifier.keys, keys...)
+	}
+
+	if len(verifier.keys) == 0 {
+		return nil, fmt.Errorf("no public key found in %s", path)
+	}
+
+	return verifier, nil
+}
+
+// parsePublicKeys returns the ed25519 and ECDSA keys of the PUBLIC KEY blocks of data.
+func parsePublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case ed25519.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported %T public key, use ed25519 or ECDSA", key)
+		}
+	}
+
+	return keys, nil
+}
+
+// verify checks the base64 signature of content against every trusted key.
+// ECDSA signatures are over the sha256 of content, as cosign does.
+func (v *profileVerifier) verify(content, encodedSignature []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encodedSignature)))
+	if err != nil {
+		return fmt.Errorf("signature is not base64: %w", err)
+	}
+
+	digest := sha256.Sum256(content)
+
+	for _, key := range v.keys {
+		switch key := key.(type) {
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, content, signature) {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, digest[:], signature) {
+				return nil
+			}
+		}
+	}
+
+	return errSignatureInvalid
+}
+
+// verifyProfileSignatures checks the signature of every desired profile and
+// returns the verified contents, read once, which the cycle then loads (see
+// readSourceProfile), and the reason each other profile was rejected. Unsigned
+// or badly signed profiles are blocked by calculateProfileChanges: neither
+// loaded nor unloaded, their installed version stays.
+func verifyProfileSignatures(ctx context.Context, cfg *AppConfig, profiles map[string]bool) (
+	verified map[string][]byte,
+	rejected map[string]string,
+) {
+	if cfg.Verifier == nil {
+		return nil, nil
+	}
+
+	verified = make(map[string][]byte, len(profiles))
+	rejected = map[string]string{}
+
+	for _, name := range slices.Sorted(maps.Keys(profiles)) {
+		content, err := verifyProfileSignature(ctx, cfg, name)
+		if err != nil {
+			rejected[name] = "signature verification failed: " + err.Error()
+
+			continue
+		}
+
+		verified[name] = content
+	}
+
+	loggerFromContext(ctx).Info("Profile signatures verified",
+		slog.Int("verified", len(verified)), slog.Int("rejected", len(rejected)))
+
+	return verified, rejected
+}
+
+// verifyProfileSignature returns the content of the profile name once its
+// signature is verified. The validation is repeated on these bytes, since the
+// ConfigMap may have changed after getNewProfiles read it.
+func verifyProfileSignature(ctx context.Context, cfg *AppConfig, name string) ([]byte, error) {
+	content, err := readProfileBytes(cfg.filesystem(), cfg.ConfigmapRoot, cfg.ConfigmapPath, name)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := readProfileBytes(cfg.filesystem(), cfg.ConfigmapRoot, cfg.ConfigmapPath, name+SignatureSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errSignatureMissing
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Verifier.verify(content, signature); err != nil {
+		return nil, err
+	}
+
+	if err := validateProfileContent(ctx, name, content); err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+type (
+	verifiedSourcesKey    struct{}
+	rejectedSignaturesKey struct{}
+)
+
+// withVerifiedSources returns a copy of ctx carrying the profile contents
+// verified in this cycle and the rejection reasons of the other profiles.
+// A nil sources map leaves ctx unchanged.
+func withVerifiedSources(ctx context.Context, sources map[string][]byte, rejected map[string]string) context.Context {
+	if sources == nil {
+		return ctx
+	}
+
+	ctx = context.WithValue(ctx, verifiedSourcesKey{}, sources)
+
+	return context.WithValue(ctx, rejectedSignaturesKey{}, rejected)
+}
+
+// verifiedSources returns the profile contents verified in this cycle, nil when
+// signatures are not checked.
+func verifiedSources(ctx context.Context) map[string][]byte {
+	sources, _ := ctx.Value(verifiedSourcesKey{}).(map[string][]byte)
+
+	return sources
+}
+
+// signatureRejection returns why the signature of the profile name was
+// rejected in this cycle, empty when it was verified or not checked.
+func signatureRejection(ctx context.Context, name string) string {
+	rejected, _ := ctx.Value(rejectedSignaturesKey{}).(map[string]string)
+
+	return rejected[name]
+}
+
+// readSourceProfile returns the ConfigMap content of the profile name: the
+// verified bytes when signatures are checked, so that the kernel loads exactly
+// what was verified even if the ConfigMap volume is updated meanwhile.
+func readSourceProfile(ctx context.Context, cfg *AppConfig, name string) ([]byte, error) {
+	sources := verifiedSources(ctx)
+	if sources == nil {
+		return readProfileBytes(cfg.filesystem(), cfg.ConfigmapRoot, cfg.ConfigmapPath, name)
+	}
+
+	content, found := sources[name]
+	if !found {
+		return nil, fmt.Errorf("profile %s was not verified: %w", name, errSignatureMissing)
+	}
+
+	return content, nil
+}
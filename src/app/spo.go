@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// security-profiles-operator (SPO) AppArmorProfile manifests.
+const (
+	spoAPIVersion = "security-profiles-operator.x-k8s.io/v1alpha1"
+	spoKind       = "AppArmorProfile"
+)
+
+// spoFlags are the profile flags of the profiles generated from an abstract policy.
+const (
+	spoFlags         = "flags=(attach_disconnected)"
+	spoComplainFlags = "flags=(attach_disconnected,complain)"
+)
+
+var (
+	// dnsSubdomain matches Kubernetes object names (RFC 1123 subdomains).
+	dnsSubdomain = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	// abstractPath and abstractCapability keep abstract values from adding rules to the generated profile.
+	abstractPath       = regexp.MustCompile(`^/[^\s,#{}"\x00]*$`)
+	abstractCapability = regexp.MustCompile(`^[a-z_]+$`)
+)
+
+// Subset of the SPO AppArmorProfile CRD. A profile is either raw policy text or
+// an abstract policy the operator turns into a profile.
+type spoAppArmorProfile struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace,omitempty"`
+	} `yaml:"metadata"`
+	Spec spoAppArmorProfileSpec `yaml:"spec"`
+}
+
+type spoAppArmorProfileSpec struct {
+	Policy       string       `yaml:"policy,omitempty"`
+	Abstract     *spoAbstract `yaml:"abstract,omitempty"`
+	ComplainMode bool         `yaml:"complainMode,omitempty"`
+}
+
+type spoAbstract struct {
+	Executable *spoExecutableRules `yaml:"executable,omitempty"`
+	Filesystem *spoFilesystemRules `yaml:"filesystem,omitempty"`
+	Network    *spoNetworkRules    `yaml:"network,omitempty"`
+	Capability *spoCapabilityRules `yaml:"capability,omitempty"`
+}
+
+type spoExecutableRules struct {
+	AllowedExecutables []string `yaml:"allowedExecutables,omitempty"`
+	AllowedLibraries   []string `yaml:"allowedLibraries,omitempty"`
+}
+
+type spoFilesystemRules struct {
+	ReadOnlyPaths  []string `yaml:"readOnlyPaths,omitempty"`
+	WriteOnlyPaths []string `yaml:"writeOnlyPaths,omitempty"`
+	ReadWritePaths []string `yaml:"readWritePaths,omitempty"`
+}
+
+type spoNetworkRules struct {
+	AllowRaw         bool          `yaml:"allowRaw,omitempty"`
+	AllowedProtocols *spoProtocols `yaml:"allowedProtocols,omitempty"`
+}
+
+type spoProtocols struct {
+	AllowTCP bool `yaml:"allowTcp,omitempty"`
+	AllowUDP bool `yaml:"allowUdp,omitempty"`
+}
+
+type spoCapabilityRules struct {
+	AllowedCapabilities []string `yaml:"allowedCapabilities,omitempty"`
+}
+
+// runSPO converts between profile files and SPO AppArmorProfile manifests.
+//
+//	kapparmor spo import -out dir <manifest.yaml>
+//	kapparmor spo export [-namespace ns] <directory>
+func runSPO(args []string, stdout io.Writer) error {
+	const usage = "usage: kapparmor spo import -out dir <manifest.yaml> | kapparmor spo export [-namespace ns] <directory>"
+
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	flags := flag.NewFlagSet("spo "+args[0], flag.ContinueOnError)
+
+	switch args[0] {
+	case "import":
+		out := flags.String("out", "", "directory the profiles are written to")
+
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		if flags.NArg() != 1 || *out == "" {
+			return errors.New(usage)
+		}
+
+		return importSPOProfiles(flags.Arg(0), *out, stdout)
+	case "export":
+		namespace := flags.String("namespace", "", "namespace of the AppArmorProfiles, omitted when empty")
+
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		if flags.NArg() != 1 {
+			return errors.New(usage)
+		}
+
+		return exportSPOProfiles(flags.Arg(0), *namespace, stdout)
+	default:
+		return errors.New(usage)
+	}
+}
+
+// importSPOProfiles writes one profile file per AppArmorProfile of the manifest
+// into dir, after the node agent checks.
+func importSPOProfiles(path, dir string, stdout io.Writer) error {
+	data, err := os.ReadFile(path) // #nosec G304 -- path given by the operator
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+
+	profiles := map[string][]byte{}
+
+	for {
+		var doc spoAppArmorProfile
+
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if doc.Kind != spoKind {
+			continue
+		}
+
+		name, content, err := profileFromSPO(&doc)
+		if err != nil {
+			return fmt.Errorf("%s: AppArmorProfile %s: %w", path, doc.Metadata.Name, err)
+		}
+
+		if _, found := profiles[name]; found {
+			return fmt.Errorf("%s: profile %s is defined twice", path, name)
+		}
+
+		profiles[name] = content
+	}
+
+	if len(profiles) == 0 {
+		return fmt.Errorf("%s: no AppArmorProfile found", path)
+	}
+
+	if problems := validateProfileSet(context.Background(), &AppConfig{}, profiles); len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errValidationFailed, strings.Join(problems, "; "))
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		target := filepath.Join(dir, name)
+		if err := os.WriteFile(target, profiles[name], 0o600); err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintln(stdout, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// profileFromSPO returns the kapparmor profile name and text of an AppArmorProfile.
+// Raw policies are kept as they are and must declare a custom profile. Abstract
+// policies are generated under the object name, prefixed when needed: pods then
+// have to reference the prefixed name.
+func profileFromSPO(doc *spoAppArmorProfile) (string, []byte, error) {
+	if doc.Spec.Policy != "" {
+		name, err := extractProfileName(context.Background(), []byte(doc.Spec.Policy))
+		if err != nil {
+			return "", nil, err
+		}
+
+		if !strings.HasPrefix(name, ProfileNamePrefix) {
+			return "", nil, fmt.Errorf("the policy declares profile %q: kapparmor only manages profiles named %s*, rename it first",
+				name, ProfileNamePrefix)
+		}
+
+		return name, []byte(doc.Spec.Policy), nil
+	}
+
+	if doc.Spec.Abstract == nil {
+		return "", nil, errors.New("neither policy nor abstract is set")
+	}
+
+	name := doc.Metadata.Name
+	if !strings.HasPrefix(name, ProfileNamePrefix) {
+		name = ProfileNamePrefix + name
+		slog.Default().Warn("Abstract AppArmorProfile renamed, update the pods referencing it",
+			slog.String("name", doc.Metadata.Name),
+			slog.String("profile", name))
+	}
+
+	content, err := profileFromAbstract(name, doc.Spec.Abstract, doc.Spec.ComplainMode)
+
+	return name, content, err
+}
+
+// profileFromAbstract generates the profile of an SPO abstract policy, with the
+// rules the operator generates for each field.
+func profileFromAbstract(name string, abstract *spoAbstract, complain bool) ([]byte, error) {
+	flags := spoFlags
+	if complain {
+		flags = spoComplainFlags
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "#include <tunables/global>\n\nprofile %s %s {\n  #include <abstractions/base>\n\n", name, flags)
+
+	var invalid []string
+
+	rule := func(format string, args ...any) {
+		fmt.Fprintf(&b, "  "+format+",\n", args...)
+	}
+
+	pathRules := func(paths []string, permissions string) {
+		for _, path := range paths {
+			if !abstractPath.MatchString(path) {
+				invalid = append(invalid, fmt.Sprintf("path %q", path))
+			}
+
+			rule("%s %s", path, permissions)
+		}
+	}
+
+	if e := abstract.Executable; e != nil {
+		pathRules(e.AllowedExecutables, "ix")
+		pathRules(e.AllowedLibraries, "mr")
+	}
+
+	if fs := abstract.Filesystem; fs != nil {
+		pathRules(fs.ReadOnlyPaths, "r")
+		pathRules(fs.WriteOnlyPaths, "w")
+		pathRules(fs.ReadWritePaths, "rw")
+	}
+
+	if n := abstract.Network; n != nil {
+		if n.AllowedProtocols != nil && n.AllowedProtocols.AllowTCP {
+			rule("network inet tcp")
+			rule("network inet6 tcp")
+		}
+
+		if n.AllowedProtocols != nil && n.AllowedProtocols.AllowUDP {
+			rule("network inet udp")
+			rule("network inet6 udp")
+		}
+
+		if n.AllowRaw {
+			rule("network raw")
+		}
+	}
+
+	if c := abstract.Capability; c != nil {
+		for _, capability := range c.AllowedCapabilities {
+			if !abstractCapability.MatchString(capability) {
+				invalid = append(invalid, fmt.Sprintf("capability %q", capability))
+			}
+
+			rule("capability %s", capability)
+		}
+	}
+
+	b.WriteString("}\n")
+
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("invalid abstract values: %s", strings.Join(invalid, ", "))
+	}
+
+	return []byte(b.String()), nil
+}
+
+// exportSPOProfiles prints one AppArmorProfile per profile of dir. Profiles made
+// only of rules the abstract model can express are exported as abstract
+// policies, the others as raw policies.
+func exportSPOProfiles(dir, namespace string, stdout io.Writer) error {
+	profiles, err := readProfileDirectory(dir)
+	if err != nil {
+		return err
+	}
+
+	if problems := validateProfileSet(context.Background(), &AppConfig{}, profiles); len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errValidationFailed, strings.Join(problems, "; "))
+	}
+
+	names := make([]string, 0, len(profiles))
+
+	for name := range profiles {
+		if !isProfileEntry(name) {
+			continue
+		}
+
+		// SPO loads the profile under the object name, which must be a valid Kubernetes name.
+		if !dnsSubdomain.MatchString(name) {
+			return fmt.Errorf("%s: not a valid Kubernetes object name", name)
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for i, name := range names {
+		doc := spoAppArmorProfile{APIVersion: spoAPIVersion, Kind: spoKind}
+		doc.Metadata.Name = name
+		doc.Metadata.Namespace = namespace
+
+		if abstract, complain, ok := abstractFromProfile(name, profiles[name]); ok {
+			doc.Spec.Abstract, doc.Spec.ComplainMode = abstract, complain
+		} else {
+			doc.Spec.Policy = string(profiles[name])
+		}
+
+		data, err := yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+
+		if i > 0 {
+			data = append([]byte("---\n"), data...)
+		}
+
+		if _, err := stdout.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// abstractFromProfile is the inverse of profileFromAbstract. It reports false
+// when a rule, the header or the flags have no abstract equivalent, so no rule
+// is ever lost or widened by the conversion. Comments and layout are ignored.
+func abstractFromProfile(name string, data []byte) (*spoAbstract, bool, bool) {
+	rules := profileRules(data)
+
+	if len(rules) < 4 || rules[0] != "#include <tunables/global>" || rules[2] != "#include <abstractions/base>" ||
+		rules[len(rules)-1] != "}" {
+		return nil, false, false
+	}
+
+	var complain bool
+
+	switch rules[1] {
+	case fmt.Sprintf("profile %s %s {", name, spoFlags):
+	case fmt.Sprintf("profile %s %s {", name, spoComplainFlags):
+		complain = true
+	default:
+		return nil, false, false
+	}
+
+	var (
+		abstract = &spoAbstract{
+			Executable: &spoExecutableRules{},
+			Filesystem: &spoFilesystemRules{},
+			Network:    &spoNetworkRules{AllowedProtocols: &spoProtocols{}},
+			Capability: &spoCapabilityRules{},
+		}
+		network []string
+	)
+
+	for _, rule := range rules[3 : len(rules)-1] {
+		fields := strings.Fields(strings.TrimSuffix(rule, ","))
+		if !strings.HasSuffix(rule, ",") || len(fields) < 2 {
+			return nil, false, false
+		}
+
+		switch {
+		case fields[0] == "network":
+			network = append(network, strings.Join(fields[1:], " "))
+		case fields[0] == "capability" && len(fields) == 2:
+			abstract.Capability.AllowedCapabilities = append(abstract.Capability.AllowedCapabilities, fields[1])
+		case strings.HasPrefix(fields[0], "/") && len(fields) == 2:
+			path := fields[0]
+
+			switch fields[1] {
+			case "ix":
+				abstract.Executable.AllowedExecutables = append(abstract.Executable.AllowedExecutables, path)
+			case "mr":
+				abstract.Executable.AllowedLibraries = append(abstract.Executable.AllowedLibraries, path)
+			case "r":
+				abstract.Filesystem.ReadOnlyPaths = append(abstract.Filesystem.ReadOnlyPaths, path)
+			case "w":
+				abstract.Filesystem.WriteOnlyPaths = append(abstract.Filesystem.WriteOnlyPaths, path)
+			case "rw":
+				abstract.Filesystem.ReadWritePaths = append(abstract.Filesystem.ReadWritePaths, path)
+			default:
+				return nil, false, false
+			}
+		default:
+			return nil, false, false
+		}
+	}
+
+	// TCP and UDP are allowed over both IPv4 and IPv6, or not at all.
+	for _, rule := range network {
+		switch rule {
+		case "inet tcp", "inet6 tcp":
+			abstract.Network.AllowedProtocols.AllowTCP = slices.Contains(network, "inet tcp") && slices.Contains(network, "inet6 tcp")
+			if !abstract.Network.AllowedProtocols.AllowTCP {
+				return nil, false, false
+			}
+		case "inet udp", "inet6 udp":
+			abstract.Network.AllowedProtocols.AllowUDP = slices.Contains(network, "inet udp") && slices.Contains(network, "inet6 udp")
+			if !abstract.Network.AllowedProtocols.AllowUDP {
+				return nil, false, false
+			}
+		case "raw":
+			abstract.Network.AllowRaw = true
+		default:
+			return nil, false, false
+		}
+	}
+
+	return abstract.compact(), complain, true
+}
+
+// compact drops the empty sections, so that exported manifests only show what is allowed.
+func (a *spoAbstract) compact() *spoAbstract {
+	if len(a.Executable.AllowedExecutables)+len(a.Executable.AllowedLibraries) == 0 {
+		a.Executable = nil
+	}
+
+	if len(a.Filesystem.ReadOnlyPaths)+len(a.Filesystem.WriteOnlyPaths)+len(a.Filesystem.ReadWritePaths) == 0 {
+		a.Filesystem = nil
+	}
+
+	if *a.Network.AllowedProtocols == (spoProtocols{}) {
+		a.Network.AllowedProtocols = nil
+	}
+
+	if a.Network.AllowedProtocols == nil && !a.Network.AllowRaw {
+		a.Network = nil
+	}
+
+	if len(a.Capability.AllowedCapabilities) == 0 {
+		a.Capability = nil
+	}
+
+	return a
+}
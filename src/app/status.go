@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tuxerrante/kapparmor/src/app/metrics"
+)
+
+// reconcileHistory remembers the outcome of the last operations on each profile,
+// which cannot be read back from the kernel or the filesystem, and the status
+// snapshot published at the end of the last reconcile cycle.
+// A nil *reconcileHistory records nothing.
+type reconcileHistory struct {
+	mu            sync.Mutex
+	lastReconcile time.Time
+	lastError     string
+	profiles      map[string]profileEvent
+	// blocked maps the profiles refused by the allowlist or the policy in the last cycle to the reason.
+	blocked map[string]string
+	// held is true while the staged rollout holds the ConfigMap change back on this node.
+	held bool
+
+	// snapshot is read by the HTTP handlers without touching the filesystem.
+	snapshot atomic.Pointer[agentStatus]
+}
+
+type profileEvent struct {
+	appliedAt     time.Time
+	lastError     string
+	blockedReason string
+}
+
+func newReconcileHistory() *reconcileHistory {
+	return &reconcileHistory{profiles: map[string]profileEvent{}}
+}
+
+// applied records a successful load of the profile at now, or the error that prevented it.
+func (h *reconcileHistory) applied(name string, now time.Time, err error) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	event := h.profiles[name]
+	event.lastError = ""
+
+	if err != nil {
+		event.lastError = err.Error()
+	} else {
+		event.appliedAt = now.UTC()
+	}
+
+	h.profiles[name] = event
+}
+
+// removed forgets a profile unloaded from the node.
+func (h *reconcileHistory) removed(name string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.profiles, name)
+}
+
+// setBlocked replaces the profiles blocked by the allowlist, the policy or their signature.
+func (h *reconcileHistory) setBlocked(blocked map[string]string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.blocked = blocked
+}
+
+// setHeld records whether the staged rollout holds the ConfigMap change back.
+func (h *reconcileHistory) setHeld(held bool) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.held = held
+}
+
+// reconciled records the end of a reconcile cycle at now.
+func (h *reconcileHistory) reconciled(now time.Time, err error) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastReconcile = now.UTC()
+	h.lastError = ""
+
+	if err != nil {
+		h.lastError = err.Error()
+	}
+}
+
+func (h *reconcileHistory) profile(name string) profileEvent {
+	if h == nil {
+		return profileEvent{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	event := h.profiles[name]
+	event.blockedReason = h.blocked[name]
+
+	return event
+}
+
+// latest returns the last published status, nil before the first one.
+func (h *reconcileHistory) latest() *agentStatus {
+	if h == nil {
+		return nil
+	}
+
+	return h.snapshot.Load()
+}
+
+// refreshAgentStatus collects the agent status between profile operations and
+// publishes it for the HTTP handlers. The returned status must not be modified.
+func refreshAgentStatus(ctx context.Context, cfg *AppConfig) *agentStatus {
+	profileOperationsMutex.Lock()
+	status := collectAgentStatus(ctx, cfg)
+	profileOperationsMutex.Unlock()
+
+	if cfg.History != nil {
+		cfg.History.snapshot.Store(status)
+	}
+
+	recordProfileMetrics(status)
+
+	return status
+}
+
+// recordProfileMetrics derives the profile gauges from the observed state, so they
+// stay correct across replacements and agent restarts. Hashes are the installed
+// file and source digests computed by collectAgentStatus.
+func recordProfileMetrics(status *agentStatus) {
+	modes := map[string]string{}
+	infos := []metrics.ProfileInfo{}
+	managed := 0
+
+	for _, p := range status.Profiles {
+		if !p.Loaded {
+			continue
+		}
+
+		modes[p.Name] = p.KernelMode
+
+		info := metrics.ProfileInfo{
+			Name:         p.Name,
+			SHA256:       cmp.Or(p.InstalledSHA256, "unknown"),
+			SourceSHA256: cmp.Or(p.AppliedSourceSHA256, "unknown"),
+			Mode:         p.KernelMode,
+			Source:       metrics.ProfileSourceConfigMap,
+		}
+		if !p.Desired {
+			info.Source = metrics.ProfileSourceOrphan
+		}
+
+		infos = append(infos, info)
+
+		if p.InstalledSHA256 != "" {
+			managed++
+		}
+	}
+
+	metrics.SetLoadedProfiles(modes)
+	metrics.SetProfileInfo(infos)
+	metrics.SetProfileCount(managed)
+}
+
+// agentStatus is the body of the /status endpoint.
+type agentStatus struct {
+	Ready bool `json:"ready"`
+	// GeneratedAt is the end of the reconcile cycle that produced this status.
+	GeneratedAt time.Time `json:"generatedAt"`
+	// Reasons explains why the node is not ready.
+	Reasons []string `json:"reasons,omitempty"`
+	// Held is true while the staged rollout holds the ConfigMap change back: the
+	// installed profiles are kept and the differences are not reasons.
+	Held               bool            `json:"held,omitempty"`
+	LastReconcileTime  *time.Time      `json:"lastReconcileTime,omitempty"`
+	LastReconcileError string          `json:"lastReconcileError,omitempty"`
+	Profiles           []profileStatus `json:"profiles"`
+}
+
+// profileStatus describes a profile that is desired (in the ConfigMap) or loaded (in the kernel).
+type profileStatus struct {
+	Name            string `json:"name"`
+	Desired         bool   `json:"desired"`
+	Loaded          bool   `json:"loaded"`
+	SourceSHA256    string `json:"sourceSha256,omitempty"`
+	InstalledSHA256 string `json:"installedSha256,omitempty"`
+	// AppliedSourceSHA256 is SourceSHA256 when the installed file is the rendered source, empty otherwise.
+	AppliedSourceSHA256 string `json:"appliedSourceSha256,omitempty"`
+	// KernelMode is the mode reported by the kernel, e.g. "enforce" or "complain".
+	KernelMode       string     `json:"kernelMode,omitempty"`
+	LastAppliedTime  *time.Time `json:"lastAppliedTime,omitempty"`
+	LastError        string     `json:"lastError,omitempty"`
+	QuarantineReason string     `json:"quarantineReason,omitempty"`
+	// BlockedReason is set when the allowlist or the policy refuses the ConfigMap version: the installed one is kept.
+	BlockedReason string `json:"blockedReason,omitempty"`
+	// Held is set when the profile differs from the ConfigMap because the staged rollout holds the change.
+	Held   bool `json:"held,omitempty"`
+	InSync bool `json:"inSync"`
+}
+
+// collectAgentStatus compares the profile source, the installed files and the kernel
+// profiles. Any difference is reported as a reason for the node not to be ready.
+func collectAgentStatus(ctx context.Context, cfg *AppConfig) *agentStatus {
+	status := &agentStatus{GeneratedAt: cfg.clock().Now().UTC(), Profiles: []profileStatus{}}
+	if h := cfg.History; h != nil {
+		h.mu.Lock()
+		status.Held = h.held
+		h.mu.Unlock()
+	}
+
+	profiles := map[string]*profileStatus{}
+
+	entry := func(name string) *profileStatus {
+		if profiles[name] == nil {
+			profiles[name] = &profileStatus{Name: name}
+		}
+
+		return profiles[name]
+	}
+
+	catalog, err := loadProfileCatalog(ctx, cfg.ConfigmapPath)
+	if err != nil {
+		status.Reasons = append(status.Reasons, err.Error())
+		catalog = &profileCatalog{}
+	}
+
+	for name := range catalog.known {
+		entry(name).Desired = true
+	}
+
+	for name, reason := range catalog.quarantined {
+		entry(name).QuarantineReason = reason
+	}
+
+	modes, err := getCustomProfileModes(ctx, cfg)
+	if err != nil {
+		status.Reasons = append(status.Reasons, err.Error())
+	}
+
+	for name, mode := range modes {
+		p := entry(name)
+		p.Loaded = true
+		p.KernelMode = mode
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(profiles)) {
+		p := profiles[name]
+
+		var srcBytes, dstBytes []byte
+
+		if p.Desired || p.QuarantineReason != "" {
+			var readErr error
+			srcBytes, readErr = readProfileBytes(cfg.filesystem(), cfg.ConfigmapRoot, cfg.ConfigmapPath, name)
+			p.SourceSHA256 = digestOrEmpty(srcBytes, readErr)
+		}
+
+		dstBytes, dstErr := readProfileBytes(cfg.filesystem(), cfg.EtcRoot, cfg.EtcApparmord, name)
+		p.InstalledSHA256 = digestOrEmpty(dstBytes, dstErr)
+
+		event := cfg.History.profile(name)
+		if !event.appliedAt.IsZero() {
+			p.LastAppliedTime = &event.appliedAt
+		}
+
+		p.LastError = event.lastError
+		p.BlockedReason = event.blockedReason
+
+		installedMatchesSource := dstErr == nil && installedSourceDigest(ctx, cfg, name, srcBytes, dstBytes) != ""
+		if installedMatchesSource {
+			p.AppliedSourceSHA256 = p.SourceSHA256
+		}
+
+		reason := profileNotReadyReason(p, installedMatchesSource)
+		if reason != "" && status.Held && heldByRollout(p, dstErr == nil) {
+			p.Held, reason = true, ""
+		}
+
+		p.InSync = reason == ""
+
+		if reason != "" {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("profile %s %s", name, reason))
+		}
+
+		status.Profiles = append(status.Profiles, *p)
+	}
+
+	if h := cfg.History; h != nil {
+		h.mu.Lock()
+		if !h.lastReconcile.IsZero() {
+			lastReconcile := h.lastReconcile
+			status.LastReconcileTime = &lastReconcile
+		}
+
+		status.LastReconcileError = h.lastError
+		h.mu.Unlock()
+	}
+
+	status.Ready = len(status.Reasons) == 0
+
+	return status
+}
+
+// profileNotReadyReason returns why p is out of sync, or an empty string.
+func profileNotReadyReason(p *profileStatus, installedMatchesSource bool) string {
+	switch {
+	case p.QuarantineReason != "":
+		return "is quarantined: " + p.QuarantineReason
+	case p.BlockedReason != "":
+		return "is blocked: " + p.BlockedReason
+	case p.Desired && !p.Loaded:
+		return "is not loaded in the kernel"
+	case !p.Desired && p.Loaded:
+		return "is loaded but no longer in the ConfigMap"
+	case p.Desired && !installedMatchesSource:
+		return "installed file differs from the ConfigMap"
+	default:
+		return ""
+	}
+}
+
+// heldByRollout reports whether the difference of p with the ConfigMap comes from
+// the change held back by the staged rollout. A blocked profile, or an installed
+// one missing from the kernel, is out of sync whatever the ConfigMap holds.
+func heldByRollout(p *profileStatus, installed bool) bool {
+	return p.BlockedReason == "" && (!p.Desired || p.Loaded || !installed)
+}
+
+// installedSourceDigest returns the sha256 of the source src of the profile name
+// when the installed file dst is its rendered version, or an empty string.
+// Source digests are the ones the render command annotates and the aggregator
+// compares, since the installed files also depend on the policy of each node.
+func installedSourceDigest(ctx context.Context, cfg *AppConfig, name string, src, dst []byte) string {
+	if src == nil {
+		return ""
+	}
+
+	rendered, err := renderProfile(ctx, cfg, name, src)
+	if err != nil || !profileBytesEqual(rendered, dst) {
+		return ""
+	}
+
+	return digestOrEmpty(src, nil)
+}
+
+func digestOrEmpty(data []byte, readErr error) string {
+	if readErr != nil {
+		return ""
+	}
+
+	hash, _ := profileDigest(data, nil)
+
+	return hash
+}
+
+// getCustomProfileModes returns the custom profiles loaded in the kernel with their mode.
+func getCustomProfileModes(ctx context.Context, cfg *AppConfig) (map[string]string, error) {
+	profilesFile, err := cfg.filesystem().Open(cfg.KernelPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", cfg.KernelPath, err)
+	}
+
+	defer func() {
+		if err := profilesFile.Close(); err != nil {
+			loggerFromContext(ctx).Warn("error closing profilesFile", slog.Any("error", err))
+		}
+	}()
+
+	modes := map[string]string{}
+	scanner := bufio.NewScanner(profilesFile)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		name := parseProfileName(line)
+		if !strings.HasPrefix(name, ProfileNamePrefix) {
+			continue
+		}
+
+		mode := line[strings.IndexRune(line, '(')+1:]
+		modes[name] = strings.TrimSuffix(strings.TrimSpace(mode), ")")
+	}
+
+	return modes, scanner.Err()
+}
+
+// errNoStatusYet is served until the first status snapshot is published.
+const errNoStatusYet = "no reconcile cycle completed yet"
+
+// writeStatus serves the /status endpoint from the last published snapshot.
+func writeStatus(cfg *AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		status := cfg.History.latest()
+		if status == nil {
+			http.Error(w, errNoStatusYet, http.StatusServiceUnavailable)
+
+			return
+		}
+
+		writeJSON(w, status)
+	}
+}
+
+// writeReadiness serves /readyz from the last published snapshot:
+// "READY", or "NOT_READY" followed by one reason per line.
+func writeReadiness(cfg *AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		reasons := []string{errNoStatusYet}
+
+		status := cfg.History.latest()
+		if status != nil {
+			reasons = status.Reasons
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		if status != nil && status.Ready {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("READY"))
+
+			return
+		}
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("NOT_READY\n" + strings.Join(reasons, "\n") + "\n"))
+	}
+}
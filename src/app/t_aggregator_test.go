@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClusterStatusAPI is an in-memory ClusterProfileStatus endpoint with a status subresource.
+type fakeClusterStatusAPI struct {
+	mu     sync.Mutex
+	object *clusterStatusObject
+}
+
+func (f *fakeClusterStatusAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	objectPath := clusterStatusPath + "/" + clusterStatusName
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == objectPath:
+		if f.object == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(f.object)
+	case r.Method == http.MethodPost && r.URL.Path == clusterStatusPath:
+		var obj clusterStatusObject
+		_ = json.NewDecoder(r.Body).Decode(&obj)
+		obj.Metadata.ResourceVersion = "1"
+		f.object = &obj
+		_ = json.NewEncoder(w).Encode(obj)
+	case r.Method == http.MethodPut && r.URL.Path == objectPath+"/status":
+		var obj clusterStatusObject
+		_ = json.NewDecoder(r.Body).Decode(&obj)
+
+		if f.object == nil || obj.Metadata.ResourceVersion != f.object.Metadata.ResourceVersion {
+			http.Error(w, "conflict", http.StatusConflict)
+
+			return
+		}
+
+		f.object.Status = obj.Status
+		_ = json.NewEncoder(w).Encode(f.object)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func sha256Of(content string) string {
+	hash, _ := profileDigest([]byte(content), nil)
+
+	return hash
+}
+
+func TestBuildClusterStatus(t *testing.T) {
+	now := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	desired := map[string]string{"custom.web": sha256Of("new"), "custom.db": sha256Of("db")}
+
+	statuses := []reportedNodeStatus{
+		{
+			nodeStatus: nodeStatus{
+				Node: "node-a", ReconcileOK: true,
+				LoadedProfiles: map[string]string{"custom.web": sha256Of("new"), "custom.db": sha256Of("db")},
+			},
+			ReportedAt: now,
+		},
+		{
+			nodeStatus: nodeStatus{
+				Node: "node-b", ReconcileOK: true,
+				LoadedProfiles: map[string]string{"custom.web": sha256Of("old"), "custom.db": sha256Of("db")},
+			},
+			ReportedAt: now,
+		},
+		{
+			nodeStatus: nodeStatus{
+				Node: "node-c", ReconcileOK: true,
+				LoadedProfiles: map[string]string{"custom.db": sha256Of("db")},
+			},
+			ReportedAt: now.Add(-time.Hour),
+		},
+		{
+			// The installed files carry the node policy: only the source digests are compared.
+			nodeStatus: nodeStatus{
+				Node: "node-d", ReconcileOK: true,
+				LoadedProfiles: map[string]string{"custom.web": sha256Of("new+policy"), "custom.db": sha256Of("db+policy")},
+				SourceProfiles: map[string]string{"custom.web": sha256Of("new"), "custom.db": sha256Of("db")},
+			},
+			ReportedAt: now,
+		},
+		{
+			nodeStatus: nodeStatus{
+				Node: "node-e", ReconcileOK: true,
+				LoadedProfiles: map[string]string{"custom.web": sha256Of("new"), "custom.db": sha256Of("db")},
+				SourceProfiles: map[string]string{"custom.db": sha256Of("db")},
+			},
+			ReportedAt: now,
+		},
+	}
+
+	view := buildClusterStatus("set-hash", desired, statuses, now, 3*time.Minute)
+
+	want := clusterSummary{Nodes: 5, InSync: 2, OutOfSync: 2, Stale: 1}
+	if view.Summary != want {
+		t.Errorf("summary = %+v, want %+v", view.Summary, want)
+	}
+
+	if len(view.Profiles) != 2 || view.Profiles[1].Name != "custom.web" {
+		t.Fatalf("expected profiles sorted by name, got %+v", view.Profiles)
+	}
+
+	web := view.Profiles[1]
+	if !reflect.DeepEqual(web.UpToDateNodes, []string{"node-a", "node-d"}) {
+		t.Errorf("up to date nodes = %v", web.UpToDateNodes)
+	}
+
+	if !reflect.DeepEqual(web.OutdatedNodes, map[string][]string{sha256Of("old"): {"node-b"}, sha256Of("new"): {"node-e"}}) {
+		t.Errorf("outdated nodes = %v", web.OutdatedNodes)
+	}
+
+	if !reflect.DeepEqual(web.MissingNodes, []string{"node-c"}) {
+		t.Errorf("missing nodes = %v", web.MissingNodes)
+	}
+}
+
+func TestStatusAggregator_Refresh(t *testing.T) {
+	leases := newFakeLeaseAPI()
+	crd := &fakeClusterStatusAPI{}
+
+	mux := http.NewServeMux()
+	mux.Handle(leasesPath("kapparmor"), leases)
+	mux.Handle(leasesPath("kapparmor")+"/", leases)
+	mux.Handle(clusterStatusPath, crd)
+	mux.Handle(clusterStatusPath+"/", crd)
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	now := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	client := &kubeClient{baseURL: srv.URL, http: srv.Client()}
+	clock := func() time.Time { return now }
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "custom.web"), []byte("new"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for node, installed := range map[string]string{"node-a": "new", "node-b": "old"} {
+		reporter := &nodeStatusReporter{
+			client: client, namespace: "kapparmor", nodeName: node, now: clock,
+			status: nodeStatus{
+				Node: node, ReconcileOK: true,
+				LoadedProfiles: map[string]string{"custom.web": sha256Of(installed)},
+			},
+		}
+		ok(t, reporter.publish(context.Background()))
+	}
+
+	agg := &statusAggregator{
+		cfg:        &AppConfig{ConfigmapPath: dir},
+		client:     client,
+		namespace:  "kapparmor",
+		staleAfter: time.Minute,
+		now:        clock,
+	}
+
+	ok(t, agg.refresh(context.Background()))
+	// The second refresh goes through the update path of the status subresource.
+	ok(t, agg.refresh(context.Background()))
+
+	status := crd.object.Status
+	if status == nil || !reflect.DeepEqual(status.OutdatedProfiles, map[string][]string{"custom.web": {"node-b"}}) {
+		t.Fatalf("unexpected ClusterProfileStatus status: %+v", status)
+	}
+
+	if !reflect.DeepEqual(status.OutOfSyncNodes, []string{"node-b"}) {
+		t.Errorf("out of sync nodes = %v", status.OutOfSyncNodes)
+	}
+
+	handler := agg.handler()
+
+	for path, code := range map[string]int{
+		"/status":                      http.StatusOK,
+		"/status/profiles/custom.web":  http.StatusOK,
+		"/status/profiles/custom.none": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if rec.Code != code {
+			t.Errorf("GET %s = %d, want %d", path, rec.Code, code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status/profiles/custom.web", nil))
+
+	var profile profileFleetStatus
+	ok(t, json.NewDecoder(rec.Body).Decode(&profile))
+
+	if !reflect.DeepEqual(profile.OutdatedNodes, map[string][]string{sha256Of("old"): {"node-b"}}) {
+		t.Errorf("custom.web outdated nodes = %v", profile.OutdatedNodes)
+	}
+}
+
+func TestStatusAggregator_NotCollectedYet(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&statusAggregator{}).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /status before the first refresh = %d, want 503", rec.Code)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const allowlistTestProfile = "profile custom.web {\n    deny network,\n}\n"
+
+// writeAllowlist writes the allowlist of digests to path, moving its modification
+// time forward so that the next refresh reads it even within the same second.
+func writeAllowlist(t *testing.T, path string, digests map[string][]string) {
+	t.Helper()
+
+	modTime := time.Now()
+	if info, err := os.Stat(path); err == nil && !info.ModTime().Before(modTime) {
+		modTime = info.ModTime().Add(time.Second)
+	}
+
+	var b strings.Builder
+
+	for name, list := range digests {
+		fmt.Fprintf(&b, "%s:\n", name)
+
+		for _, digest := range list {
+			fmt.Fprintf(&b, "  - %s\n", digest)
+		}
+	}
+
+	writeTestFile(t, path, b.String())
+	ok(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestLoadNewProfiles_Allowlist(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.History = newReconcileHistory()
+
+	approved, _ := profileDigest([]byte(statusTestProfile), nil)
+	changed, _ := profileDigest([]byte(allowlistTestProfile), nil)
+
+	allowlistPath := filepath.Join(t.TempDir(), "allowlist.yaml")
+	writeAllowlist(t, allowlistPath, map[string][]string{"custom.web": {approved}})
+
+	var err error
+	cfg.Allowlist, err = loadProfileAllowlist(allowlistPath)
+	ok(t, err)
+
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), statusTestProfile)
+
+	loader := &fakeLoader{}
+	cfg.Loader = loader
+
+	_, err = loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	if calls := loader.invoked("--replace"); len(calls) != 1 {
+		t.Fatalf("expected the approved profile to be loaded, got %v", calls)
+	}
+
+	// An unapproved change keeps the installed version.
+	writeTestFile(t, cfg.KernelPath, "custom.web (enforce)\n")
+	ok(t, os.Remove(filepath.Join(cfg.ConfigmapPath, "custom.web")))
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), allowlistTestProfile)
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.new"), "profile custom.new {\n  file,\n}\n")
+
+	loader = &fakeLoader{}
+	cfg.Loader = loader
+
+	_, err = loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	if calls := append(loader.invoked("--replace"), loader.invoked("--remove")...); len(calls) != 0 {
+		t.Fatalf("blocked profiles must be neither loaded nor unloaded, got %v", calls)
+	}
+
+	installed, err := os.ReadFile(filepath.Join(cfg.EtcApparmord, "custom.web"))
+	ok(t, err)
+
+	if string(installed) != statusTestProfile {
+		t.Errorf("the installed version was replaced: %q", installed)
+	}
+
+	status := collectAgentStatus(context.Background(), cfg)
+
+	for _, name := range []string{"custom.new", "custom.web"} {
+		if value, found := gatheredValue(t, "kapparmor_profile_blocked", map[string]string{"profile": name}); !found || value != 1 {
+			t.Errorf("expected %s to be reported as blocked, got %v (found %v)", name, value, found)
+		}
+	}
+
+	if web := status.Profiles[1]; web.Name != "custom.web" || !strings.Contains(web.BlockedReason, changed) {
+		t.Errorf("unexpected custom.web status: %+v", web)
+	}
+
+	if status.Ready || !strings.Contains(strings.Join(status.Reasons, "\n"), "profile custom.web is blocked: sha256 "+changed) {
+		t.Errorf("a blocked profile must make the node not ready: %v", status.Reasons)
+	}
+
+	// Approving the new digest applies it on the next cycle, without a restart.
+	writeAllowlist(t, allowlistPath, map[string][]string{"custom.web": {approved, changed}})
+
+	loader = &fakeLoader{}
+	cfg.Loader = loader
+
+	_, err = loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	if calls := loader.invoked("--replace"); len(calls) != 1 || filepath.Base(calls[0][len(calls[0])-1]) != "custom.web" {
+		t.Fatalf("expected only the approved custom.web to be loaded, got %v", calls)
+	}
+
+	if _, found := gatheredValue(t, "kapparmor_profile_blocked", map[string]string{"profile": "custom.web"}); found {
+		t.Error("custom.web is no longer blocked")
+	}
+}
+
+func TestProfileAllowlist_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist.yaml")
+
+	for name, content := range map[string]string{
+		"uppercase digest": "custom.web:\n  - " + strings.Repeat("A", 64) + "\n",
+		"short digest":     "custom.web:\n  - abc\n",
+		"not a list":       "custom.web: " + strings.Repeat("a", 64) + "\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeTestFile(t, path, content)
+
+			if _, err := loadProfileAllowlist(path); err == nil {
+				t.Fatal("expected an invalid allowlist to be rejected")
+			}
+		})
+	}
+
+	if _, err := loadProfileAllowlist(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expected a missing allowlist to be rejected")
+	}
+
+	// A broken update keeps the last valid allowlist.
+	digest, _ := profileDigest([]byte(statusTestProfile), nil)
+	writeAllowlist(t, path, map[string][]string{"custom.web": {digest}})
+
+	allowlist, err := loadProfileAllowlist(path)
+	ok(t, err)
+
+	writeTestFile(t, path, "custom.web: [")
+	allowlist.refresh(context.Background())
+
+	if reason := allowlist.blockReason("custom.web", []byte(statusTestProfile)); reason != "" {
+		t.Errorf("the previous allowlist was dropped: %s", reason)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readAuditEntries(t *testing.T, path string) []auditEntry {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	ok(t, err)
+
+	var entries []auditEntry
+
+	for line := range bytes.Lines(data) {
+		var entry auditEntry
+		ok(t, json.Unmarshal(line, &entry))
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestAuditLog_ProfileChanges(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.Loader, cfg.Clock, cfg.NodeName = &fakeLoader{failing: []string{"custom.bad"}}, newFakeClock(), "node-a"
+
+	auditPath := filepath.Join(t.TempDir(), "kapparmor", "audit.log")
+	cfg.AuditLogPath = auditPath
+
+	var err error
+
+	cfg.Audit, err = openAuditLog(context.Background(), cfg)
+	ok(t, err)
+
+	source := filepath.Join(cfg.ConfigmapPath, "custom.web")
+	updated := "profile custom.web {\n  deny network,\n}\n"
+
+	writeTestFile(t, source, statusTestProfile)
+	ok(t, loadProfile(context.Background(), cfg, source))
+
+	// ConfigMap updates replace the files: the installed copy may be a hard link to the old one.
+	ok(t, os.Remove(source))
+	writeTestFile(t, source, updated)
+	ok(t, loadProfile(context.Background(), cfg, source))
+
+	bad := filepath.Join(cfg.ConfigmapPath, "custom.bad")
+	writeTestFile(t, bad, "profile custom.bad {\n}\n")
+
+	if loadProfile(context.Background(), cfg, bad) == nil {
+		t.Fatal("expected the fake parser to reject custom.bad")
+	}
+
+	ok(t, unloadProfile(context.Background(), cfg, "custom.web"))
+	ok(t, cfg.Audit.close())
+
+	entries := readAuditEntries(t, auditPath)
+	if len(entries) != 4 {
+		t.Fatalf("got %d audit entries, want 4: %+v", len(entries), entries)
+	}
+
+	first, replaced, failed, removed := entries[0], entries[1], entries[2], entries[3]
+
+	if first.Operation != auditLoad || first.OldSHA256 != "" || first.NewSHA256 != sha256Of(statusTestProfile) ||
+		first.Node != "node-a" || first.Result != auditSuccess || first.PrevHash != "" {
+		t.Errorf("unexpected first load: %+v", first)
+	}
+
+	if replaced.OldSHA256 != sha256Of(statusTestProfile) || replaced.NewSHA256 != sha256Of(updated) {
+		t.Errorf("replacement hashes: old %s new %s", replaced.OldSHA256, replaced.NewSHA256)
+	}
+
+	if failed.Result != auditFailure || !strings.Contains(failed.Error, "simulated failure") || failed.NewSHA256 != "" {
+		t.Errorf("unexpected failed load: %+v", failed)
+	}
+
+	if removed.Operation != auditUnload || removed.OldSHA256 != sha256Of(updated) || removed.NewSHA256 != "" {
+		t.Errorf("unexpected unload: %+v", removed)
+	}
+
+	ok(t, verifyAuditLog(context.Background(), auditPath))
+
+	// Reopening resumes the chain.
+	cfg.Audit, err = openAuditLog(context.Background(), cfg)
+	ok(t, err)
+	ok(t, loadProfile(context.Background(), cfg, source))
+	ok(t, cfg.Audit.close())
+
+	entries = readAuditEntries(t, auditPath)
+	if entries[4].PrevHash != removed.Hash {
+		t.Errorf("reopened chain starts from %q, want %q", entries[4].PrevHash, removed.Hash)
+	}
+
+	ok(t, verifyAuditLog(context.Background(), auditPath))
+}
+
+func TestVerifyAuditLog_DetectsTampering(t *testing.T) {
+	write := func(t *testing.T, entries ...auditEntry) string {
+		t.Helper()
+
+		path := filepath.Join(t.TempDir(), "audit.log")
+
+		log, err := openAuditLog(context.Background(), &AppConfig{AuditLogPath: path})
+		ok(t, err)
+
+		for _, entry := range entries {
+			ok(t, log.record(entry))
+		}
+
+		ok(t, log.close())
+
+		return path
+	}
+
+	entries := []auditEntry{
+		{Profile: "custom.a", Operation: auditLoad, NewSHA256: "aaa", Result: auditSuccess},
+		{Profile: "custom.b", Operation: auditLoad, NewSHA256: "bbb", Result: auditSuccess},
+		{Profile: "custom.a", Operation: auditUnload, OldSHA256: "aaa", Result: auditSuccess},
+	}
+
+	for name, tamper := range map[string]func(lines []string) []string{
+		"edited": func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"bbb"`, `"ccc"`, 1)
+
+			return lines
+		},
+		"removed": func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		},
+		"reordered": func(lines []string) []string {
+			lines[0], lines[1] = lines[1], lines[0]
+
+			return lines
+		},
+		"partial line in the middle": func(lines []string) []string {
+			lines[1] = lines[1][:len(lines[1])/2]
+
+			return lines
+		},
+		"extra field": func(lines []string) []string {
+			lines[2] = strings.Replace(lines[2], "{", `{"note":"x",`, 1)
+
+			return lines
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := write(t, entries...)
+			ok(t, verifyAuditLog(context.Background(), path))
+
+			data, err := os.ReadFile(path)
+			ok(t, err)
+
+			lines := tamper(strings.Split(strings.TrimSpace(string(data)), "\n"))
+			ok(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600))
+
+			if verifyAuditLog(context.Background(), path) == nil {
+				t.Error("tampering not detected")
+			}
+
+			if _, err := openAuditLog(context.Background(), &AppConfig{AuditLogPath: path}); err == nil {
+				t.Error("the agent must not append to a broken chain")
+			}
+		})
+	}
+}
+
+func TestAuditLog_PartialLastLine(t *testing.T) {
+	cfg := &AppConfig{AuditLogPath: filepath.Join(t.TempDir(), "audit.log"), Clock: newFakeClock(), NodeName: "node-a"}
+
+	log, err := openAuditLog(context.Background(), cfg)
+	ok(t, err)
+	ok(t, log.record(auditEntry{Profile: "custom.a", Operation: auditLoad, NewSHA256: "aaa", Result: auditSuccess}))
+	ok(t, log.close())
+
+	// A write interrupted by a node crash.
+	partial := `{"time":"2026-03-01T08:00:00Z","node":"node-a","prof`
+	file, err := os.OpenFile(cfg.AuditLogPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	ok(t, err)
+	_, err = file.WriteString(partial)
+	ok(t, err)
+	ok(t, file.Close())
+
+	ok(t, verifyAuditLog(context.Background(), cfg.AuditLogPath))
+
+	log, err = openAuditLog(context.Background(), cfg)
+	ok(t, err)
+	ok(t, log.record(auditEntry{Profile: "custom.b", Operation: auditLoad, NewSHA256: "bbb", Result: auditSuccess}))
+	ok(t, log.close())
+
+	ok(t, verifyAuditLog(context.Background(), cfg.AuditLogPath))
+
+	data, err := os.ReadFile(cfg.AuditLogPath)
+	ok(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 4 || lines[1] != partial {
+		t.Fatalf("expected the partial line to be kept and terminated:\n%s", data)
+	}
+
+	var first, mark, next auditEntry
+	ok(t, json.Unmarshal([]byte(lines[0]), &first))
+	ok(t, json.Unmarshal([]byte(lines[2]), &mark))
+	ok(t, json.Unmarshal([]byte(lines[3]), &next))
+
+	if mark.Operation != auditPartialLine || mark.OldSHA256 != sha256Of(partial) || mark.PrevHash != first.Hash || mark.Node != "node-a" {
+		t.Errorf("unexpected partial line mark: %+v", mark)
+	}
+
+	if next.PrevHash != mark.Hash {
+		t.Errorf("the chain does not continue after the mark: %+v", next)
+	}
+
+	// A complete last entry without its newline only gets the newline.
+	ok(t, os.WriteFile(cfg.AuditLogPath, data[:len(data)-1], 0o600))
+
+	log, err = openAuditLog(context.Background(), cfg)
+	ok(t, err)
+	ok(t, log.record(auditEntry{Profile: "custom.c", Operation: auditLoad, NewSHA256: "ccc", Result: auditSuccess}))
+	ok(t, log.close())
+
+	ok(t, verifyAuditLog(context.Background(), cfg.AuditLogPath))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
@@ -23,7 +24,7 @@ func Test_CopyFile(t *testing.T) {
 		t.Fatalf("mkdir dst: %v", err)
 	}
 
-	err = CopyFile(src, dstDir)
+	err = CopyFile(context.Background(), hostFileSystem{}, src, dstDir)
 	if err != nil {
 		t.Fatalf("CopyFile error: %v", err)
 	}
@@ -32,3 +33,20 @@ func Test_CopyFile(t *testing.T) {
 		t.Fatalf("copied file missing: %v", err)
 	}
 }
+
+func Test_CopyFile_FileSystem(t *testing.T) {
+	t.Parallel()
+
+	fsys := newMemFileSystem(map[string]string{
+		"/app/profiles/custom.demo":           "demo",
+		"/etc/apparmor.d/custom/custom.other": "other",
+	})
+
+	if err := CopyFile(context.Background(), fsys, "/app/profiles/custom.demo", "/etc/apparmor.d/custom"); err != nil {
+		t.Fatalf("CopyFile error: %v", err)
+	}
+
+	if got := fsys.content("/etc/apparmor.d/custom/custom.demo"); got != "demo" {
+		t.Fatalf("copied content = %q, want %q", got, "demo")
+	}
+}
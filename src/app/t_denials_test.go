@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const denialTestRecords = `type=AVC msg=audit(1760000000.100:10): apparmor="DENIED" operation="open" class="file" profile="custom.web" name="/etc/shadow" pid=42 comm="nginx" requested_mask="r" denied_mask="r" fsuid=0 ouid=0
+type=AVC msg=audit(1760000000.200:11): apparmor="ALLOWED" operation="open" class="file" profile="custom.web" name="/etc/hosts" pid=42 comm="nginx" requested_mask="r" denied_mask="r" fsuid=0 ouid=0
+type=AVC msg=audit(1760000000.300:12): apparmor="DENIED" operation="open" class="file" profile="docker-default" name="/proc/kcore" pid=7 comm="cat" requested_mask="r" denied_mask="r" fsuid=0 ouid=0
+[ 1234.5678] audit: type=1400 audit(1760000000.400:13): apparmor="DENIED" operation="capable" class="cap" profile="custom.web//null-/usr/bin/id" pid=43 comm=2F7573722F62696E2F6964 capability=21 capname="sys_admin"
+type=AVC msg=audit(1760000000.500:14): apparmor="DENIED" operation="open" class="file" profile="custom.web" name="/etc/gshadow" pid=42 comm="nginx" requested_mask="r" denied_mask="r" fsuid=0 ouid=0
+`
+
+func newTestDenialCollector(t *testing.T, limit string) (*denialCollector, *bytes.Buffer, *fakeClock, string) {
+	t.Helper()
+
+	var logs bytes.Buffer
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestFile(t, path, denialTestRecords) // written before the agent started: not counted
+
+	clock := newFakeClock()
+	cfg := &AppConfig{
+		DenialLogPath:     path,
+		DenialLogLimitArg: limit,
+		Logger:            slog.New(slog.NewJSONHandler(&logs, nil)),
+		Clock:             clock,
+	}
+
+	c, err := newDenialCollector(cfg)
+	ok(t, err)
+	t.Cleanup(func() { _ = c.file.Close() })
+
+	return c, &logs, clock, path
+}
+
+func appendTestFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	ok(t, err)
+
+	_, err = file.WriteString(content)
+	ok(t, err)
+	ok(t, file.Close())
+}
+
+func TestDenialCollector_CountsAndLogs(t *testing.T) {
+	c, logs, _, path := newTestDenialCollector(t, "10")
+
+	fileLabels := map[string]string{"profile": "custom.web", "operation": "open", "class": "file"}
+	capLabels := map[string]string{"profile": "custom.web", "operation": "capable", "class": "cap"}
+	fileBefore, _ := gatheredValue(t, "kapparmor_denials_total", fileLabels)
+	capBefore, _ := gatheredValue(t, "kapparmor_denials_total", capLabels)
+
+	ok(t, c.poll())
+
+	// A record is only handled once its line is complete.
+	lines := strings.SplitAfter(denialTestRecords, "\n")
+	appendTestFile(t, path, strings.Join(lines[:3], "")+lines[3][:40])
+	ok(t, c.poll())
+	appendTestFile(t, path, lines[3][40:]+lines[4])
+	ok(t, c.poll())
+
+	if got, _ := gatheredValue(t, "kapparmor_denials_total", fileLabels); got-fileBefore != 2 {
+		t.Errorf("got %v new file denials, want 2", got-fileBefore)
+	}
+
+	if got, _ := gatheredValue(t, "kapparmor_denials_total", capLabels); got-capBefore != 1 {
+		t.Errorf("got %v new capability denials, want 1", got-capBefore)
+	}
+
+	if _, found := gatheredValue(t, "kapparmor_denials_total", map[string]string{"profile": "docker-default"}); found {
+		t.Error("denials of profiles not managed by kapparmor must not be counted")
+	}
+
+	for _, want := range []string{`"name":"/etc/shadow"`, `"comm":"nginx"`, `"profile":"custom.web//null-/usr/bin/id"`, `"comm":"/usr/bin/id"`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs do not contain %s:\n%s", want, logs.String())
+		}
+	}
+}
+
+func TestDenialCollector_LogLimitAndRotation(t *testing.T) {
+	c, logs, clock, path := newTestDenialCollector(t, "1")
+
+	appendTestFile(t, path, denialTestRecords)
+	ok(t, c.poll())
+
+	if got := strings.Count(logs.String(), `"msg":"AppArmor denial"`); got != 1 {
+		t.Fatalf("got %d denial log lines, want 1 per profile and minute:\n%s", got, logs.String())
+	}
+
+	// The log is rotated: the new file is read from its beginning.
+	ok(t, os.Rename(path, path+".1"))
+	writeTestFile(t, path, denialTestRecords)
+
+	clock.now = clock.now.Add(time.Minute)
+	ok(t, c.poll())
+
+	if !strings.Contains(logs.String(), `"msg":"AppArmor denial logs suppressed","profile":"custom.web","count":2`) {
+		t.Errorf("suppressed lines not reported:\n%s", logs.String())
+	}
+
+	if got := strings.Count(logs.String(), `"msg":"AppArmor denial"`); got != 2 {
+		t.Errorf("got %d denial log lines after rotation, want 2:\n%s", got, logs.String())
+	}
+}
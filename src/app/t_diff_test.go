@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProfileRules(t *testing.T) {
+	rules := profileRules([]byte("#include <tunables/global>\n# a comment\nprofile custom.web {\n\n    file,   # trailing\n  deny   network,\n}\n"))
+	want := []string{"#include <tunables/global>", "profile custom.web {", "file,", "deny network,", "}"}
+
+	if fmt.Sprint(rules) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", rules, want)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n", "o"}
+	b := []string{"a", "B", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n", "O", "p"}
+
+	want := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -12,4 +12,5 @@
+ l
+ m
+ n
+-o
++O
++p
+`
+	if got := unifiedDiff(a, b, "old", "new"); got != want {
+		t.Errorf("unexpected diff:\n%s", got)
+	}
+
+	if got := unifiedDiff(a, a, "old", "new"); got != "" {
+		t.Errorf("equal inputs produced a diff:\n%s", got)
+	}
+}
+
+func TestDiffOps_LargeChange(t *testing.T) {
+	// The changed ranges would need a 2049x2049 LCS table, above diffMaxCells.
+	a, b := []string{"include"}, []string{"include"}
+	for i := range 2048 {
+		a = append(a, fmt.Sprintf("/a/%d r,", i))
+		b = append(b, fmt.Sprintf("/b/%d r,", i))
+	}
+
+	a, b = append(a, "file,"), append(b, "file,")
+
+	ops := diffOps(a, b)
+	if len(ops) != 2+2*2048 || ops[0].kind != ' ' || ops[1].kind != '-' || ops[2049].kind != '+' || ops[len(ops)-1].kind != ' ' {
+		t.Fatalf("expected the changed rules removed then added, got %d ops", len(ops))
+	}
+}
+
+func TestRunDiff(t *testing.T) {
+	dir := t.TempDir()
+	installed := filepath.Join(dir, "installed")
+	kernel := filepath.Join(dir, "kernel")
+	manifest := filepath.Join(dir, "manifest.yaml")
+
+	ok(t, os.MkdirAll(installed, 0o750))
+	writeTestFile(t, filepath.Join(installed, "custom.web"), "profile custom.web {\n  file,\n  network,\n}\n")
+	writeTestFile(t, filepath.Join(installed, "custom.fmt"), "profile custom.fmt {\n  file,\n}\n")
+	writeTestFile(t, filepath.Join(installed, "custom.old"), "profile custom.old {\n}\n")
+	writeTestFile(t, kernel, "custom.web (enforce)\ncustom.fmt (enforce)\ncustom.old (complain)\n/usr/bin/man (enforce)\n")
+	writeTestFile(t, manifest, `kind: ConfigMap
+metadata:
+  name: kapparmor-profiles
+data:
+  custom.web: |
+    profile custom.web {
+      file,
+      deny network,
+    }
+  custom.fmt: |
+    # reformatted
+    profile custom.fmt {
+        file,
+    }
+  custom.new: |
+    profile custom.new {
+    }
+`)
+
+	var out bytes.Buffer
+	ok(t, runDiff([]string{"-installed", installed, "-kernel", kernel, manifest}, &out))
+
+	for _, want := range []string{
+		"Profiles to load: custom.new\n",
+		"Profiles to replace: custom.fmt custom.web\n",
+		"Profiles to remove: custom.old\n",
+		"custom.fmt: formatting or comment changes only\n",
+		"-network,\n+deny network,\n",
+		"+++ " + manifest + ":kapparmor-profiles/custom.web\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRunDiff_Policy(t *testing.T) {
+	dir := t.TempDir()
+	installed := filepath.Join(dir, "installed")
+	kernel := filepath.Join(dir, "kernel")
+	snippet := filepath.Join(dir, "snippet")
+	proposed := filepath.Join(dir, "proposed")
+
+	ok(t, os.MkdirAll(installed, 0o750))
+	ok(t, os.MkdirAll(proposed, 0o750))
+	writeTestFile(t, snippet, "deny /proc/sys/** w,\n")
+	writeTestFile(t, filepath.Join(installed, "custom.web"),
+		"profile custom.web {\n  include <abstractions/base>\n  file,\n  # Injected by the kapparmor profile policy.\n  deny /proc/sys/** w,\n}\n")
+	writeTestFile(t, kernel, "custom.web (enforce)\n")
+	writeTestFile(t, filepath.Join(proposed, "custom.web"), "profile custom.web {\n  include <abstractions/base>\n  file,\n  network,\n}\n")
+	writeTestFile(t, filepath.Join(proposed, "custom.bare"), "profile custom.bare {\n  file,\n}\n")
+
+	var out bytes.Buffer
+	ok(t, runDiff([]string{"-installed", installed, "-kernel", kernel,
+		"-required-includes", "abstractions/base", "-policy-snippet", snippet, proposed}, &out))
+
+	for _, want := range []string{
+		"Profiles to replace: custom.web\n",
+		"Profiles to block: custom.bare\n",
+		"custom.bare: profile policy violation: missing required include <abstractions/base>\n",
+		" file,\n+network,\n deny /proc/sys/** w,\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRunDiff_Templates(t *testing.T) {
+	dir := t.TempDir()
+	installed := filepath.Join(dir, "installed")
+	kernel := filepath.Join(dir, "kernel")
+	vars := filepath.Join(dir, "vars")
+	proposed := filepath.Join(dir, "proposed")
+
+	for _, d := range []string{installed, vars, proposed} {
+		ok(t, os.MkdirAll(d, 0o750))
+	}
+
+	writeTestFile(t, filepath.Join(vars, "log_dir"), "/var/log/web")
+	writeTestFile(t, filepath.Join(installed, "custom.web"), "profile custom.web {\n  /var/log/web/** rw,\n}\n")
+	writeTestFile(t, filepath.Join(installed, "custom.db"), "profile custom.db {\n  /var/log/web/** r,\n}\n")
+	writeTestFile(t, kernel, "custom.web (enforce)\ncustom.db (enforce)\n")
+	writeTestFile(t, filepath.Join(proposed, "custom.web"), "profile custom.web {\n  {{ .Vars.log_dir }}/** rw,\n}\n")
+	writeTestFile(t, filepath.Join(proposed, "custom.db"), "profile custom.db {\n  {{ .Vars.log_dir }}/** rw,\n}\n")
+
+	var out bytes.Buffer
+	ok(t, runDiff([]string{"-installed", installed, "-kernel", kernel, "-template-vars", vars, proposed}, &out))
+
+	for _, want := range []string{
+		"Profiles to replace: custom.db\n",
+		"-/var/log/web/** r,\n+/var/log/web/** rw,\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
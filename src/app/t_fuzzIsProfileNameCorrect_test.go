@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"strings"
 	"testing"
 )
@@ -8,7 +9,7 @@ import (
 func FuzzIsProfileNameCorrect(f *testing.F) {
 	f.Fuzz(
 		func(t *testing.T, directory, filename string) {
-			err := IsProfileNameCorrect(directory, filename)
+			err := IsProfileNameCorrect(context.Background(), directory, filename)
 			if err != nil {
 				// --- EXPECTED FAILURES (Success) ---
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"io/fs"
 	"log/slog"
 	"os"
@@ -50,12 +51,12 @@ func TestHasTheSameContent_fsFS(t *testing.T) {
 	}
 
 	t.Run("identical profiles", func(t *testing.T) {
-		got, err := HasTheSameContent(fsmap, "foo.profile", "foo.profile.copy")
+		got, err := HasTheSameContent(context.Background(), fsmap, "foo.profile", "foo.profile.copy")
 		ok(t, err)
 		assertBool(t, got, true)
 	})
 	t.Run("different profiles", func(t *testing.T) {
-		got, err := HasTheSameContent(fsmap, "foo.profile", "bar.profile")
+		got, err := HasTheSameContent(context.Background(), fsmap, "foo.profile", "bar.profile")
 		ok(t, err)
 		assertBool(t, got, false)
 	})
@@ -73,13 +74,13 @@ func TestHasTheSameContent_localFiles(t *testing.T) {
 	os.WriteFile(tmp3, []byte(testProfileDataDifferent), 0o644)
 
 	t.Run("same local files", func(t *testing.T) {
-		got, err := HasTheSameContent(nil, tmp1, tmp2)
+		got, err := HasTheSameContent(context.Background(), nil, tmp1, tmp2)
 		ok(t, err)
 		assertBool(t, got, true)
 	})
 
 	t.Run("different local files", func(t *testing.T) {
-		got, err := HasTheSameContent(nil, tmp1, tmp3)
+		got, err := HasTheSameContent(context.Background(), nil, tmp1, tmp3)
 		ok(t, err)
 		assertBool(t, got, false)
 	})
@@ -97,7 +98,7 @@ func TestAreProfilesReadable(t *testing.T) {
 	os.WriteFile(validProfile, content, 0o644)
 
 	t.Run("folder with valid profile", func(t *testing.T) {
-		readable, profiles := areProfilesReadable(&AppConfig{ConfigmapPath: tmp})
+		readable, profiles := areProfilesReadable(context.Background(), &AppConfig{ConfigmapPath: tmp})
 		assertBool(t, readable, true)
 
 		if !profiles[testingFileName] {
@@ -107,7 +108,7 @@ func TestAreProfilesReadable(t *testing.T) {
 
 	t.Run("folder with hidden file", func(t *testing.T) {
 		os.WriteFile(filepath.Join(tmp, ".hidden"), []byte("ignored"), 0o644)
-		readable, profiles := areProfilesReadable(&AppConfig{ConfigmapPath: tmp})
+		readable, profiles := areProfilesReadable(context.Background(), &AppConfig{ConfigmapPath: tmp})
 		assertBool(t, readable, true)
 
 		if profiles[".hidden"] {
@@ -160,7 +161,7 @@ func TestCopyFileContents(t *testing.T) {
 
 	os.WriteFile(src, []byte(testContent), 0o644)
 
-	err := copyFileContents(src, dst)
+	err := copyFileContents(context.Background(), hostFileSystem{}, src, dst)
 	ok(t, err)
 
 	b, _ := os.ReadFile(dst)
@@ -175,7 +176,7 @@ type badFS struct{ fs.FS }
 func (b badFS) Open(name string) (fs.File, error) { return nil, os.ErrNotExist }
 
 func TestCompareFSFiles_error(t *testing.T) {
-	_, err := HasTheSameContent(badFS{}, "nonexistent", "other")
+	_, err := HasTheSameContent(context.Background(), badFS{}, "nonexistent", "other")
 	if err == nil {
 		t.Fatal("expected error for nonexistent files")
 	}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func ok(t testing.TB, err error) {
@@ -127,3 +137,119 @@ func writeParserScript(t *testing.T, dir string, exitCode int, writeStderr bool)
 
 	return s
 }
+
+// fakeLoader records the apparmor_parser invocations and fails those whose
+// last argument (the profile path) has a base name listed in failing.
+type fakeLoader struct {
+	mu      sync.Mutex
+	calls   [][]string
+	failing []string
+}
+
+func (l *fakeLoader) Run(_ context.Context, args ...string) (stdout, stderr []byte, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.calls = append(l.calls, args)
+
+	if slices.Contains(l.failing, filepath.Base(args[len(args)-1])) {
+		return nil, []byte("simulated failure"), errors.New("exit status 1")
+	}
+
+	return []byte("OK: " + strings.Join(args, " ")), nil, nil
+}
+
+// invoked returns the recorded invocations whose arguments contain operation (e.g. "--replace").
+func (l *fakeLoader) invoked(operation string) [][]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var calls [][]string
+
+	for _, args := range l.calls {
+		if slices.Contains(args, operation) {
+			calls = append(calls, args)
+		}
+	}
+
+	return calls
+}
+
+// fakeClock ticks only when tick is called.
+type fakeClock struct {
+	now   time.Time
+	ticks chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC), ticks: make(chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) NewTicker(time.Duration) (<-chan time.Time, func()) { return c.ticks, func() {} }
+
+// tick delivers one tick, blocking until the poller receives it.
+func (c *fakeClock) tick() { c.ticks <- c.now }
+
+// memFileSystem is an in-memory FileSystem keyed by absolute path.
+type memFileSystem struct {
+	mu    sync.Mutex
+	files fstest.MapFS
+}
+
+func newMemFileSystem(files map[string]string) *memFileSystem {
+	m := &memFileSystem{files: fstest.MapFS{}}
+	for name, data := range files {
+		m.files[strings.TrimPrefix(name, "/")] = &fstest.MapFile{Data: []byte(data), Mode: 0o600}
+	}
+
+	return m
+}
+
+func (m *memFileSystem) Open(name string) (fs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.files.Open(strings.TrimPrefix(name, "/"))
+}
+
+func (m *memFileSystem) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return fs.Stat(m.files, strings.TrimPrefix(name, "/"))
+}
+
+func (m *memFileSystem) Create(name string) (io.WriteCloser, error) {
+	return &memFile{fs: m, name: strings.TrimPrefix(name, "/")}, nil
+}
+
+func (m *memFileSystem) Link(string, string) error { return errors.ErrUnsupported }
+
+func (m *memFileSystem) content(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if f := m.files[strings.TrimPrefix(name, "/")]; f != nil {
+		return string(f.Data)
+	}
+
+	return ""
+}
+
+// memFile stores its content in the memFileSystem when closed.
+type memFile struct {
+	bytes.Buffer
+	fs   *memFileSystem
+	name string
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	f.fs.files[f.name] = &fstest.MapFile{Data: f.Bytes(), Mode: 0o600}
+
+	return nil
+}
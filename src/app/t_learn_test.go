@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const learnTestAuditLog = `type=AVC msg=audit(1760000000.100:10): apparmor="ALLOWED" operation="open" class="file" profile="custom.web" name="/etc/nginx/nginx.conf" pid=42 comm="nginx" requested_mask="r" denied_mask="r" fsuid=0 ouid=0
+type=AVC msg=audit(1760000000.200:11): apparmor="ALLOWED" operation="mknod" class="file" profile="custom.web" name="/var/cache/nginx/a" pid=42 comm="nginx" requested_mask="c" denied_mask="c" fsuid=0 ouid=0
+type=AVC msg=audit(1760000000.300:12): apparmor="ALLOWED" operation="open" class="file" profile="custom.web" name="/var/cache/nginx/a" pid=42 comm="nginx" requested_mask="wr" denied_mask="wr" fsuid=0 ouid=0
+[ 1234.5678] audit: type=1400 audit(1760000000.400:13): apparmor="DENIED" operation="capable" class="cap" profile="custom.web" pid=42 comm="nginx" capability=10 capname="net_bind_service"
+type=AVC msg=audit(1760000000.500:14): apparmor="ALLOWED" operation="create" class="net" profile="custom.web" pid=42 comm="nginx" family="inet" sock_type="stream" protocol=6 requested_mask="create" denied_mask="create"
+type=AVC msg=audit(1760000000.600:15): apparmor="ALLOWED" operation="open" class="file" profile="custom.web" name=2F746D702F6D792066696C65 pid=42 comm="nginx" requested_mask="r" denied_mask="r" fsuid=0 ouid=0
+type=AVC msg=audit(1760000000.700:16): apparmor="ALLOWED" operation="exec" class="file" profile="custom.web" name="/usr/bin/id" pid=42 comm="sh" requested_mask="x" denied_mask="x" fsuid=0 ouid=0
+type=AVC msg=audit(1760000000.800:17): apparmor="ALLOWED" operation="open" class="file" profile="custom.other" name="/etc/shadow" pid=7 comm="cat" requested_mask="r" denied_mask="r" fsuid=0 ouid=0
+type=AVC msg=audit(1760000000.900:18): apparmor="ALLOWED" operation="signal" class="signal" profile="custom.web" pid=42 comm="nginx" requested_mask="send" denied_mask="send" signal=term peer="unconfined"
+type=AVC msg=audit(1760000001.000:19): apparmor="STATUS" operation="profile_replace" profile="unconfined" name="custom.web" pid=1 comm="apparmor_parser"
+`
+
+func TestRunLearn(t *testing.T) {
+	dir := t.TempDir()
+	profile := filepath.Join(dir, "custom.web")
+	auditLog := filepath.Join(dir, "audit.log")
+
+	writeTestFile(t, profile, "profile custom.web flags=(attach_disconnected,complain) {\n  file,\n  /etc/nginx/nginx.conf r,\n}\n")
+	writeTestFile(t, auditLog, learnTestAuditLog)
+
+	var out bytes.Buffer
+
+	ok(t, runLearn([]string{profile, auditLog}, &out))
+
+	want := `profile custom.web flags=(attach_disconnected,complain) {
+  file,
+  /etc/nginx/nginx.conf r,
+
+  # Proposed by kapparmor learn: review before enforcing.
+  "/tmp/my file" r,
+  /usr/bin/id ix,
+  /var/cache/nginx/a rw,
+  network inet stream,
+  capability net_bind_service,
+}
+`
+	if out.String() != want {
+		t.Errorf("unexpected profile:\n%s", out.String())
+	}
+
+	// Running it again on its output proposes nothing new.
+	writeTestFile(t, profile, out.String())
+	out.Reset()
+	ok(t, runLearn([]string{profile, auditLog}, &out))
+
+	if strings.Count(out.String(), "Proposed by kapparmor learn") != 1 {
+		t.Errorf("rules proposed twice:\n%s", out.String())
+	}
+}
+
+func TestLearnedRules_SkipsUnsafePaths(t *testing.T) {
+	learned := newLearnedRules()
+	learned.add("custom.web", parseAuditFields(`apparmor="ALLOWED" profile="custom.web" name="/tmp/x} r,\n" requested_mask="r"`))
+	learned.add("custom.web", parseAuditFields(`apparmor="ALLOWED" profile="custom.web" capname="sys_admin,"`))
+
+	if rules := learned.rules(nil); len(rules) != 0 {
+		t.Errorf("unsafe values must not become rules: %q", rules)
+	}
+}
+
+func TestLearnedRules_EscapesGlobs(t *testing.T) {
+	learned := newLearnedRules()
+	learned.add("custom.web", parseAuditFields(`apparmor="ALLOWED" profile="custom.web" name="/srv/[a]*?.txt" requested_mask="r"`))
+	learned.add("custom.web", parseAuditFields(`apparmor="ALLOWED" profile="custom.web" name="/srv/my *file" requested_mask="r"`))
+
+	want := []string{`/srv/\[a\]\*\?.txt r,`, `"/srv/my \*file" r,`}
+	if rules := learned.rules(nil); !slices.Equal(rules, want) {
+		t.Errorf("expected the glob characters to be escaped, got %q", rules)
+	}
+}
+
+func TestLearnedRules_ApplyFirstBlock(t *testing.T) {
+	learned := newLearnedRules()
+	learned.add("custom.web", parseAuditFields(`apparmor="ALLOWED" profile="custom.web" capname="net_bind_service"`))
+
+	profile := "profile custom.web { file, }\n@{EXTRA}={a,b} # trailing }\n"
+
+	updated, err := learned.apply([]byte(profile))
+	ok(t, err)
+
+	want := "profile custom.web { file, \n\n  # Proposed by kapparmor learn: review before enforcing.\n  capability net_bind_service,\n}\n@{EXTRA}={a,b} # trailing }\n"
+	if string(updated) != want {
+		t.Errorf("unexpected profile:\n%s", updated)
+	}
+
+	if _, err := learned.apply([]byte("profile custom.web {\n  file,\n")); err == nil {
+		t.Error("expected an error for a profile without a closed block")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	for _, tc := range []struct {
+		format, level string
+		wantErr       bool
+	}{
+		{"text", "info", false},
+		{"JSON", "debug", false},
+		{"json", "WARN", false},
+		{"yaml", "info", true},
+		{"text", "verbose", true},
+	} {
+		_, err := newLogger(&bytes.Buffer{}, tc.format, tc.level)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("newLogger(%q, %q) error = %v, wantErr %t", tc.format, tc.level, err, tc.wantErr)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	logger, err := newLogger(&buf, "json", "warn")
+	ok(t, err)
+
+	logger.Info("dropped")
+	logger.Warn("kept")
+
+	if out := buf.String(); strings.Contains(out, "dropped") || !strings.Contains(out, `"msg":"kept"`) {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestReconcileOnce_LogsCarryReconcileID(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.ProfilerFullPath = "true" // 'true' always succeeds
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), statusTestProfile)
+
+	var buf bytes.Buffer
+
+	logger, err := newLogger(&buf, "json", "debug")
+	ok(t, err)
+
+	ctx := contextWithLogger(context.Background(), logger)
+	reconcileOnce(ctx, cfg)
+	reconcileOnce(ctx, cfg)
+
+	ids := map[string]int{}
+
+	for line := range strings.Lines(buf.String()) {
+		var record map[string]any
+		ok(t, json.Unmarshal([]byte(line), &record))
+
+		id, _ := record["reconcile_id"].(string)
+		if id == "" {
+			t.Fatalf("record without reconcile_id: %s", line)
+		}
+
+		if strings.HasPrefix(record["msg"].(string), "=====") {
+			t.Errorf("separator banner logged in JSON mode: %s", line)
+		}
+
+		ids[id]++
+	}
+
+	if len(ids) != 2 {
+		t.Errorf("got %d reconcile IDs, want one per cycle: %v", len(ids), ids)
+	}
+}
+
+func TestPrintLogSeparator_TextOnly(t *testing.T) {
+	var buf bytes.Buffer
+
+	printLogSeparator(contextWithLogger(context.Background(), slog.New(slog.NewTextHandler(&buf, nil))))
+
+	if !strings.Contains(buf.String(), "=====") {
+		t.Errorf("text logs should keep the separator, got %q", buf.String())
+	}
+}
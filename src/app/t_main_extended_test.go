@@ -30,12 +30,13 @@ func TestRunApp_ShutdownImmediately(t *testing.T) {
 	}
 
 	cfg := &AppConfig{
-		ConfigmapPath:    configmapDir,
-		EtcApparmord:     etcApparmordDir,
-		KernelPath:       kernelPath,
-		PollTimeArg:      "1",
-		ProfilerFullPath: "/nonexistent/parser", // Won't actually be called
-		Logger:           slog.Default(),
+		ConfigmapPath: configmapDir,
+		EtcApparmord:  etcApparmordDir,
+		KernelPath:    kernelPath,
+		PollTimeArg:   "1",
+		Loader:        &fakeLoader{},
+		Clock:         newFakeClock(),
+		Logger:        slog.Default(),
 	}
 
 	// Create a context that cancels after 100ms
@@ -46,9 +47,7 @@ func TestRunApp_ShutdownImmediately(t *testing.T) {
 	err := RunApp(ctx, cfg)
 
 	// Should not error when cancelled
-	if err != nil && err != context.DeadlineExceeded {
-		t.Logf("expected context deadline or nil, got: %v", err)
-	}
+	ok(t, err)
 }
 
 // TestRunApp_WithValidProfiles tests RunApp with valid profile loading.
@@ -71,21 +70,45 @@ func TestRunApp_WithValidProfiles(t *testing.T) {
 		t.Fatalf("failed to create kernel profile file: %v", err)
 	}
 
+	profileFile := path.Join(configmapDir, "custom.test")
+	if err := os.WriteFile(profileFile, []byte("profile custom.test { }"), 0o644); err != nil {
+		t.Fatalf("failed to create profile file: %v", err)
+	}
+
+	loader := &fakeLoader{}
+	clock := newFakeClock()
+
 	cfg := &AppConfig{
-		ConfigmapPath:    configmapDir,
-		EtcApparmord:     etcApparmordDir,
-		KernelPath:       kernelPath,
-		PollTimeArg:      "1",
-		ProfilerFullPath: "apparmor_parser",
-		Logger:           slog.Default(),
+		ConfigmapPath: configmapDir,
+		EtcApparmord:  etcApparmordDir,
+		KernelPath:    kernelPath,
+		PollTimeArg:   "1",
+		Loader:        loader,
+		Clock:         clock,
+		Logger:        slog.Default(),
 	}
 
-	// Create a context that cancels quickly
-	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// RunApp should handle empty configmap gracefully
-	_ = RunApp(ctx, cfg)
+	done := make(chan error)
+
+	go func() { done <- RunApp(ctx, cfg) }()
+
+	// The poller reads the second tick only once the first cycle is over.
+	clock.tick()
+	clock.tick()
+
+	if _, err := os.Stat(path.Join(etcApparmordDir, "custom.test")); err != nil {
+		t.Errorf("expected the profile to be installed after a poll cycle: %v", err)
+	}
+
+	cancel()
+	ok(t, <-done)
+
+	if len(loader.invoked("--replace")) == 0 {
+		t.Errorf("expected the profile to be loaded, got %v", loader.calls)
+	}
 }
 
 // TestPollProfiles_ContextCancellation tests that pollProfiles respects context cancellation.
@@ -107,12 +130,13 @@ func TestPollProfiles_ContextCancellation(t *testing.T) {
 	}
 
 	cfg := &AppConfig{
-		ConfigmapPath:    configmapDir,
-		EtcApparmord:     etcApparmordDir,
-		KernelPath:       kernelPath,
-		PollTimeArg:      "1",
-		ProfilerFullPath: "apparmor_parser",
-		Logger:           slog.Default(),
+		ConfigmapPath: configmapDir,
+		EtcApparmord:  etcApparmordDir,
+		KernelPath:    kernelPath,
+		PollTimeArg:   "1",
+		Loader:        &fakeLoader{},
+		Clock:         newFakeClock(),
+		Logger:        slog.Default(),
 	}
 
 	// Create a context that cancels immediately
@@ -141,19 +165,19 @@ func TestLoadProfile_ErrorHandling(t *testing.T) {
 	}
 
 	cfg := &AppConfig{
-		EtcApparmord:     tempDir,
-		ProfilerFullPath: "/nonexistent/parser",
+		EtcApparmord: tempDir,
+		Loader:       &fakeLoader{failing: []string{"test.profile"}},
 	}
 
-	// Should fail because parser doesn't exist
-	err := loadProfile(cfg, profileFile)
+	// Should fail because the parser rejects the profile
+	err := loadProfile(context.Background(), cfg, profileFile)
 
 	if err == nil {
-		t.Error("expected error for nonexistent parser")
+		t.Error("expected error for a parser failure")
 	}
 }
 
-// TestLoadProfile_Success tests successful profile loading (without apparmor_parser).
+// TestLoadProfile_Success tests successful profile loading.
 func TestLoadProfile_Success(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -172,11 +196,11 @@ func TestLoadProfile_Success(t *testing.T) {
 	}
 
 	cfg := &AppConfig{
-		EtcApparmord:     destDir,
-		ProfilerFullPath: "true", // 'true' always succeeds
+		EtcApparmord: destDir,
+		Loader:       &fakeLoader{},
 	}
 
-	err := loadProfile(cfg, srcProfile)
+	err := loadProfile(context.Background(), cfg, srcProfile)
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -199,11 +223,11 @@ func TestUnloadAllProfiles_EmptyDirectory(t *testing.T) {
 	}
 
 	cfg := &AppConfig{
-		EtcApparmord:     destDir,
-		ProfilerFullPath: "true",
+		EtcApparmord: destDir,
+		Loader:       &fakeLoader{},
 	}
 
-	err := unloadAllProfiles(cfg)
+	err := unloadAllProfiles(context.Background(), cfg)
 
 	if err != nil {
 		t.Errorf("unexpected error for empty directory: %v", err)
@@ -228,11 +252,11 @@ func TestUnloadAllProfiles_WithProfiles(t *testing.T) {
 	}
 
 	cfg := &AppConfig{
-		EtcApparmord:     destDir,
-		ProfilerFullPath: "true",
+		EtcApparmord: destDir,
+		Loader:       &fakeLoader{},
 	}
 
-	err := unloadAllProfiles(cfg)
+	err := unloadAllProfiles(context.Background(), cfg)
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -252,11 +276,11 @@ func TestUnloadAllProfiles_WithProfiles(t *testing.T) {
 // TestUnloadAllProfiles_NonexistentDirectory tests with non-existent directory.
 func TestUnloadAllProfiles_NonexistentDirectory(t *testing.T) {
 	cfg := &AppConfig{
-		EtcApparmord:     "/nonexistent/path",
-		ProfilerFullPath: "true",
+		EtcApparmord: "/nonexistent/path",
+		Loader:       &fakeLoader{},
 	}
 
-	err := unloadAllProfiles(cfg)
+	err := unloadAllProfiles(context.Background(), cfg)
 
 	if err != nil {
 		t.Errorf("expected no error for nonexistent directory, got: %v", err)
@@ -274,11 +298,11 @@ func TestUnloadProfile_Success(t *testing.T) {
 	}
 
 	cfg := &AppConfig{
-		EtcApparmord:     tempDir,
-		ProfilerFullPath: "true",
+		EtcApparmord: tempDir,
+		Loader:       &fakeLoader{},
 	}
 
-	err := unloadProfile(cfg, "custom.test")
+	err := unloadProfile(context.Background(), cfg, "custom.test")
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -299,12 +323,12 @@ func TestUnloadProfile_NonexistentProfile(t *testing.T) {
 	}
 
 	cfg := &AppConfig{
-		EtcApparmord:     tempDir,
-		ProfilerFullPath: "true",
+		EtcApparmord: tempDir,
+		Loader:       &fakeLoader{},
 	}
 
 	// Should not error for non-existent profile
-	err := unloadProfile(cfg, "nonexistent.profile")
+	err := unloadProfile(context.Background(), cfg, "nonexistent.profile")
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -322,11 +346,11 @@ func TestUnloadProfile_ParserFailure(t *testing.T) {
 	}
 
 	cfg := &AppConfig{
-		EtcApparmord:     tempDir,
-		ProfilerFullPath: "false", // 'false' always fails
+		EtcApparmord: tempDir,
+		Loader:       &fakeLoader{failing: []string{"custom.test"}},
 	}
 
-	err := unloadProfile(cfg, "custom.test")
+	err := unloadProfile(context.Background(), cfg, "custom.test")
 
 	// Should have error from parser failure, but file should still be removed
 	if err == nil {
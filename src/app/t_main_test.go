@@ -2,58 +2,48 @@ package main
 
 import (
 	"context"
-	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
 func Test_main_RunApp_StartsAndStops(t *testing.T) {
-	// Skip if AppArmor not present
-	if _, err := os.Stat("/sys/module/apparmor/parameters/enabled"); os.IsNotExist(err) {
-		t.Skip(`====================
-		WARNING: AppArmor is not available in this environment.
-		Some tests were skipped.
-		Run tests in a real Linux VM with AppArmor enabled for full coverage.
-		====================`)
-	}
+	cfg, _ := preFlightChecksInit(t)
+	cfg.History = newReconcileHistory()
 
-	t.Setenv("TESTING", "true")
-	cfg, f := preFlightChecksInit(t)
-	defer func() {
-		_ = os.Remove(f.Name())
-	}()
+	loader := &fakeLoader{}
+	clock := newFakeClock()
+	cfg.Loader, cfg.Clock = loader, clock
 
-	done := make(chan struct{})
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), statusTestProfile)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go func() {
-		assertDontPanic(t, func() { _ = RunApp(ctx, cfg) })
-		close(done)
-	}()
+	done := make(chan error)
 
-	// Allow bootstrap then send a stop
-	select {
-	case <-time.After(750 * time.Millisecond):
-		// fall-through
-	case <-done:
-		// Process ended. OK.
+	go func() { done <- RunApp(ctx, cfg) }()
+
+	// The poller reads the second tick only once the first cycle is over.
+	clock.tick()
+	clock.tick()
+
+	// The fake kernel never lists custom.web, so every cycle loads it again.
+	if calls := loader.invoked("--replace"); len(calls) == 0 || filepath.Base(calls[0][len(calls[0])-1]) != "custom.web" {
+		t.Fatalf("expected custom.web to be loaded, got %v", calls)
 	}
 
-	// If process is still running, send interrupt signal
+	cancel()
+
 	select {
-	case <-done:
-		// ok
-	default:
-		// Send SIGINT to stop the app
-		cancel()
-
-		// Wait for process to end or timeout
-		select {
-		case <-done:
-		case <-time.After(5 * time.Second):
-			t.Fatal("RunApp did not stop on SIGINT")
-		}
+	case err := <-done:
+		ok(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunApp did not stop on context cancellation")
+	}
+
+	// Shutdown unloads the custom profiles.
+	if calls := loader.invoked("--remove"); len(calls) != 1 {
+		t.Errorf("expected one profile unloaded on shutdown, got %v", calls)
 	}
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNodeAPI serves GET and JSON patch for a single node.
+type fakeNodeAPI struct {
+	mu              sync.Mutex
+	taints          []nodeTaint
+	resourceVersion int
+	patches         int
+}
+
+func (f *fakeNodeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path != "/api/v1/nodes/worker-1" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var node nodeObject
+		node.Metadata.Name = "worker-1"
+		node.Metadata.ResourceVersion = strconv.Itoa(f.resourceVersion)
+		node.Spec.Taints = f.taints
+		_ = json.NewEncoder(w).Encode(node)
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/json-patch+json" {
+			http.Error(w, "unsupported patch type", http.StatusUnsupportedMediaType)
+
+			return
+		}
+
+		var ops []struct {
+			Op    string          `json:"op"`
+			Path  string          `json:"path"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil || len(ops) != 2 {
+			http.Error(w, "bad patch", http.StatusBadRequest)
+
+			return
+		}
+
+		if string(ops[0].Value) != strconv.Quote(strconv.Itoa(f.resourceVersion)) {
+			http.Error(w, "resourceVersion changed", http.StatusConflict)
+
+			return
+		}
+
+		var taints []nodeTaint
+		_ = json.Unmarshal(ops[1].Value, &taints)
+		f.taints = taints
+		f.resourceVersion++
+		f.patches++
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeNodeAPI) hasTaint(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, t := range f.taints {
+		if t.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newTestTaintManager(t *testing.T, api *fakeNodeAPI, now *time.Time) *nodeTaintManager {
+	t.Helper()
+
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+
+	return &nodeTaintManager{
+		client:   &kubeClient{baseURL: srv.URL, http: srv.Client()},
+		nodeName: "worker-1",
+		key:      defaultNodeTaintKey,
+		grace:    time.Minute,
+		now:      func() time.Time { return *now },
+	}
+}
+
+func TestNodeTaintManager_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	api := &fakeNodeAPI{taints: []nodeTaint{
+		{Key: "node.kubernetes.io/unschedulable", Effect: "NoSchedule"},
+		{Key: defaultNodeTaintKey, Effect: nodeTaintEffect},
+	}}
+	m := newTestTaintManager(t, api, &now)
+
+	// Not yet synced: the registration taint stays.
+	m.observe(ctx, false)
+	assertBool(t, api.hasTaint(defaultNodeTaintKey), true)
+
+	// First full reconcile removes it and keeps foreign taints.
+	m.observe(ctx, true)
+	assertBool(t, api.hasTaint(defaultNodeTaintKey), false)
+	assertBool(t, api.hasTaint("node.kubernetes.io/unschedulable"), true)
+
+	// Out of sync within the grace period: nothing happens.
+	now = now.Add(30 * time.Second)
+	m.observe(ctx, false)
+	assertBool(t, api.hasTaint(defaultNodeTaintKey), false)
+
+	// Out of sync beyond the grace period: the node is tainted again, once.
+	now = now.Add(time.Minute)
+	m.observe(ctx, false)
+	m.observe(ctx, false)
+	assertBool(t, api.hasTaint(defaultNodeTaintKey), true)
+
+	if api.patches != 2 {
+		t.Errorf("expected 2 patches, got %d", api.patches)
+	}
+
+	// Back in sync.
+	m.observe(ctx, true)
+	assertBool(t, api.hasTaint(defaultNodeTaintKey), false)
+}
+
+func TestNodeTaintManager_RetriesAfterAPIError(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	api := &fakeNodeAPI{taints: []nodeTaint{{Key: defaultNodeTaintKey, Effect: nodeTaintEffect}}}
+	m := newTestTaintManager(t, api, &now)
+	m.nodeName = "missing-node"
+
+	m.observe(ctx, true)
+	assertBool(t, m.stateKnown, false)
+
+	m.nodeName = "worker-1"
+	m.observe(ctx, true)
+	assertBool(t, api.hasTaint(defaultNodeTaintKey), false)
+	assertBool(t, m.stateKnown, true)
+}
+
+func TestNewNodeTaintManager_Validation(t *testing.T) {
+	if _, err := newNodeTaintManager(&AppConfig{NodeTaintGraceArg: "60"}); err == nil {
+		t.Error("expected an error without NODE_NAME")
+	}
+
+	if _, err := newNodeTaintManager(&AppConfig{NodeName: "n", NodeTaintGraceArg: "soon"}); err == nil {
+		t.Error("expected an error for a non numeric grace")
+	}
+}
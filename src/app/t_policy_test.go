@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const policyTestProfile = `include <tunables/global>
+@{WEB}=/srv/{www,static}
+
+profile custom.web flags=(attach_disconnected) {
+  include <abstractions/base>
+  @{WEB}/** r,
+
+  ^hat {
+    include <abstractions/nameservice>
+  }
+}
+`
+
+func TestProfilePolicy_Render(t *testing.T) {
+	snippetPath := filepath.Join(t.TempDir(), "snippet")
+	writeTestFile(t, snippetPath, "\ndeny /proc/sys/** w,\ndeny @{PROC}/sysrq-trigger rwklx,\n\n")
+
+	policy, err := loadProfilePolicy(" <abstractions/base>, abstractions/nameservice", snippetPath)
+	ok(t, err)
+
+	rendered, err := policy.render([]byte(policyTestProfile))
+	if !errors.Is(err, errPolicyViolation) || !strings.Contains(err.Error(), "<abstractions/nameservice>") {
+		t.Fatalf("includes of a hat must not count for the profile, got %v", err)
+	}
+
+	want := strings.Replace(policyTestProfile, "  }\n}\n", `  }
+  # Injected by the kapparmor profile policy.
+  deny /proc/sys/** w,
+  deny @{PROC}/sysrq-trigger rwklx,
+}
+`, 1)
+	if string(rendered) != want {
+		t.Errorf("unexpected rendered profile:\n%s", rendered)
+	}
+
+	for name, tc := range map[string]struct {
+		profile  string
+		required string
+		wantErr  bool
+		want     string
+	}{
+		"inline closing brace": {
+			profile:  "profile custom.a {\n  include <abstractions/base>\n  file, }\n",
+			required: "abstractions/base",
+			want:     "profile custom.a {\n  include <abstractions/base>\n  file, \n  # Injected by the kapparmor profile policy.\n  deny /proc/sys/** w,\n}\n",
+		},
+		"included by the snippet": {
+			profile:  "profile custom.a {\n  file,\n}\n",
+			required: "abstractions/base",
+			want:     "profile custom.a {\n  file,\n  # Injected by the kapparmor profile policy.\n  include <abstractions/base>\n}\n",
+		},
+		"every top-level profile": {
+			profile:  "profile custom.a {\n  #include <abstractions/base>\n}\nprofile custom.b {\n}\n",
+			required: "abstractions/base",
+			wantErr:  true,
+		},
+		"one-line profile": {
+			profile:  "profile custom.a { /** rwx, }\n",
+			required: "abstractions/base",
+			wantErr:  true,
+			want:     "profile custom.a { /** rwx, \n  # Injected by the kapparmor profile policy.\n  deny /proc/sys/** w,\n}\n",
+		},
+		"one-line profile with the include": {
+			profile:  "@{HOME}=/home/{a,b}\nprofile custom.a @{HOME}/bin/{x,y} { include <abstractions/base> }\n",
+			required: "abstractions/base",
+			want:     "@{HOME}=/home/{a,b}\nprofile custom.a @{HOME}/bin/{x,y} { include <abstractions/base> \n  # Injected by the kapparmor profile policy.\n  deny /proc/sys/** w,\n}\n",
+		},
+		"no profile block": {
+			profile:  "include <abstractions/base>\n",
+			required: "abstractions/base",
+			wantErr:  true,
+		},
+		"include if exists": {
+			profile:  "profile custom.a {\n  include if exists <abstractions/base>\n}\n",
+			required: "abstractions/base",
+			wantErr:  true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			snippet := "deny /proc/sys/** w,"
+			if name == "included by the snippet" {
+				snippet = "include <abstractions/base>"
+			}
+
+			writeTestFile(t, snippetPath, snippet)
+
+			policy, err := loadProfilePolicy(tc.required, snippetPath)
+			ok(t, err)
+
+			rendered, err := policy.render([]byte(tc.profile))
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+
+			if tc.want != "" && string(rendered) != tc.want {
+				t.Errorf("unexpected rendered profile:\n%q", rendered)
+			}
+		})
+	}
+
+	writeTestFile(t, snippetPath, "deny /proc/sys/** w,\n}\n")
+
+	if _, err := loadProfilePolicy("", snippetPath); err == nil {
+		t.Error("expected an unbalanced snippet to be rejected")
+	}
+}
+
+func TestLoadNewProfiles_Policy(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.History = newReconcileHistory()
+
+	snippetPath := filepath.Join(t.TempDir(), "snippet")
+	writeTestFile(t, snippetPath, "deny /proc/sys/** w,\n")
+
+	var err error
+	cfg.Policy, err = loadProfilePolicy("abstractions/base", snippetPath)
+	ok(t, err)
+
+	source := "profile custom.web {\n  include <abstractions/base>\n  file,\n}\n"
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), source)
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.bare"), "profile custom.bare {\n  file,\n}\n")
+
+	loader := &fakeLoader{}
+	cfg.Loader = loader
+
+	_, err = loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	calls := loader.invoked("--replace")
+	if len(calls) != 1 || filepath.Base(calls[0][len(calls[0])-1]) != ".custom.web.rendered" {
+		t.Fatalf("expected only the staged policy version of custom.web to be loaded, got %v", calls)
+	}
+
+	installed, err := os.ReadFile(filepath.Join(cfg.EtcApparmord, "custom.web"))
+	ok(t, err)
+
+	if !strings.Contains(string(installed), "  deny /proc/sys/** w,\n}\n") {
+		t.Errorf("the installed profile lacks the snippet:\n%s", installed)
+	}
+
+	entries, err := os.ReadDir(cfg.EtcApparmord)
+	ok(t, err)
+
+	if len(entries) != 1 {
+		t.Errorf("expected only custom.web to be installed, got %v", entries)
+	}
+
+	// The installed policy version is up to date: nothing is reloaded.
+	writeTestFile(t, cfg.KernelPath, "custom.web (enforce)\n")
+
+	loader = &fakeLoader{}
+	cfg.Loader = loader
+
+	_, err = loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	if calls := loader.invoked("--replace"); len(calls) != 0 {
+		t.Errorf("expected no reload of an unchanged profile, got %v", calls)
+	}
+
+	loaded, sources, _ := nodeInventory(context.Background(), cfg)
+	if loaded["custom.web"] == sha256Of(source) || sources["custom.web"] != sha256Of(source) {
+		t.Errorf("the node status must report the installed and the source digests: %v, %v", loaded, sources)
+	}
+
+	status := collectAgentStatus(context.Background(), cfg)
+
+	for _, p := range status.Profiles {
+		switch p.Name {
+		case "custom.web":
+			if !p.InSync || p.AppliedSourceSHA256 != sha256Of(source) || p.InstalledSHA256 == p.AppliedSourceSHA256 {
+				t.Errorf("custom.web must be in sync with its policy version: %+v", p)
+			}
+		case "custom.bare":
+			if !strings.Contains(p.BlockedReason, "missing required include <abstractions/base>") {
+				t.Errorf("unexpected custom.bare status: %+v", p)
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -43,7 +44,7 @@ func TestPrintLoadedProfiles(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			// Capture logs to verify behavior
-			printLoadedProfiles(tc.profiles)
+			printLoadedProfiles(context.Background(), tc.profiles)
 			// If we get here without panic, the test passes
 			if _, exists := tc.profiles[""]; exists {
 				// Verify empty string was deleted
@@ -93,7 +94,7 @@ func TestShowProfilesDiff(t *testing.T) {
 	testOpenProfileRoots(t, cfg)
 
 	// This should not panic
-	showProfilesDiff(cfg, profileName)
+	showProfilesDiff(context.Background(), cfg, profileName)
 }
 
 // TestCalculateProfileChanges tests the change calculation logic.
@@ -168,7 +169,7 @@ func TestCalculateProfileChanges(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			toApply, toUnload, err := calculateProfileChanges(cfg, tc.newProfiles, tc.customLoadedProfiles)
+			toApply, toUnload, err := calculateProfileChanges(context.Background(), cfg, tc.newProfiles, tc.customLoadedProfiles)
 
 			if tc.shouldErr && err == nil {
 				t.Error("expected error but got nil")
@@ -207,7 +208,7 @@ func TestGetNewProfiles(t *testing.T) {
 		ConfigmapPath: tempDir,
 	}
 
-	readable, profiles := getNewProfiles(cfg)
+	readable, profiles := getNewProfiles(context.Background(), cfg)
 
 	if !readable {
 		t.Error("expected profiles to be readable")
@@ -245,7 +246,7 @@ built-in-profile (enforce)
 		KernelPath: profilesFile,
 	}
 
-	allProfiles, customProfiles, err := getLoadedProfiles(cfg)
+	allProfiles, customProfiles, err := getLoadedProfiles(context.Background(), cfg)
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -275,7 +276,7 @@ built-in-profile (enforce)
 // TestPrintLogSeparator tests the log separator.
 func TestPrintLogSeparator(t *testing.T) {
 	// This should not panic
-	printLogSeparator()
+	printLogSeparator(context.Background())
 }
 
 // TestShowProfilesDiff_WithMissingFile tests diff with missing destination file.
@@ -304,7 +305,7 @@ func TestShowProfilesDiff_WithMissingFile(t *testing.T) {
 	testOpenProfileRoots(t, cfg)
 
 	// Should handle missing destination file gracefully
-	showProfilesDiff(cfg, name)
+	showProfilesDiff(context.Background(), cfg, name)
 }
 
 // TestCalculateProfileChanges_NonexistentProfile tests with missing source file.
@@ -322,7 +323,7 @@ func TestCalculateProfileChanges_NonexistentProfile(t *testing.T) {
 	}
 	customLoadedProfiles := map[string]bool{}
 
-	toApply, toUnload, err := calculateProfileChanges(cfg, newProfiles, customLoadedProfiles)
+	toApply, toUnload, err := calculateProfileChanges(context.Background(), cfg, newProfiles, customLoadedProfiles)
 
 	// Should not apply nonexistent profile - function schedules it but doesn't check existence
 	// This is intentional - error handling happens when exec is called
@@ -345,7 +346,7 @@ func TestGetLoadedProfiles_NonexistentFile(t *testing.T) {
 		KernelPath: "/nonexistent/path/profiles",
 	}
 
-	allProfiles, customProfiles, err := getLoadedProfiles(cfg)
+	allProfiles, customProfiles, err := getLoadedProfiles(context.Background(), cfg)
 
 	if err == nil {
 		t.Error("expected error for nonexistent file")
@@ -385,7 +386,7 @@ func TestExecApparmor_Success(t *testing.T) {
 
 	// Try to execute - will fail if apparmor_parser not available, but that's ok for this test
 	// We're testing the function behavior when it's called
-	err := execApparmor(cfg, "--version")
+	err := execApparmor(context.Background(), cfg, "--version")
 	// Don't assert on error as apparmor_parser might not be available in test env
 	if profileFile != "" {
 		_ = err
@@ -398,7 +399,7 @@ func TestExecApparmor_InvalidPath(t *testing.T) {
 		ProfilerFullPath: "/nonexistent/path/apparmor_parser",
 	}
 
-	err := execApparmor(cfg, "--version")
+	err := execApparmor(context.Background(), cfg, "--version")
 
 	if err == nil {
 		t.Error("expected error with invalid parser path")
@@ -415,7 +416,7 @@ func TestExecApparmor_NoArgs(t *testing.T) {
 		ProfilerFullPath: "echo",
 	}
 
-	err := execApparmor(cfg, "--help")
+	err := execApparmor(context.Background(), cfg, "--help")
 
 	// echo should succeed
 	if err != nil {
@@ -466,7 +467,7 @@ func TestCalculateProfileChanges_IdenticalContent(t *testing.T) {
 		"custom.test": true,
 	}
 
-	toApply, toUnload, err := calculateProfileChanges(cfg, newProfiles, customLoadedProfiles)
+	toApply, toUnload, err := calculateProfileChanges(context.Background(), cfg, newProfiles, customLoadedProfiles)
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -491,7 +492,7 @@ func TestGetProfilesNamesFromFile_EmptyFile(t *testing.T) {
 		t.Fatalf("failed to create empty file: %v", err)
 	}
 
-	allProfiles, customProfiles, err := getProfilesNamesFromFile(emptyFile, ProfileNamePrefix)
+	allProfiles, customProfiles, err := getProfilesNamesFromFile(context.Background(), hostFileSystem{}, emptyFile, ProfileNamePrefix)
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -519,7 +520,7 @@ another invalid line
 		t.Fatalf("failed to create file: %v", err)
 	}
 
-	allProfiles, customProfiles, err := getProfilesNamesFromFile(profileFile, ProfileNamePrefix)
+	allProfiles, customProfiles, err := getProfilesNamesFromFile(context.Background(), hostFileSystem{}, profileFile, ProfileNamePrefix)
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -643,7 +644,7 @@ func TestShowProfilesDiff_T7_NoContentInLogs(t *testing.T) {
 
 	cfg := &AppConfig{ConfigmapPath: configDir, EtcApparmord: dstDir}
 	testOpenProfileRoots(t, cfg)
-	showProfilesDiff(cfg, "custom.secret")
+	showProfilesDiff(context.Background(), cfg, "custom.secret")
 
 	output := buf.String()
 
@@ -693,7 +694,7 @@ func TestShowProfilesDiff_T7_ErrorFieldsPresent(t *testing.T) {
 
 	cfg := &AppConfig{ConfigmapPath: configDir, EtcApparmord: dstDir}
 	testOpenProfileRoots(t, cfg)
-	showProfilesDiff(cfg, "custom.missing")
+	showProfilesDiff(context.Background(), cfg, "custom.missing")
 
 	output := buf.String()
 
@@ -704,3 +705,27 @@ func TestShowProfilesDiff_T7_ErrorFieldsPresent(t *testing.T) {
 		t.Error("expected log output to contain dst_error when dst file is missing")
 	}
 }
+
+// TestGetLoadedProfiles_FileSystem reads the kernel profile list through the injected FileSystem.
+func TestGetLoadedProfiles_FileSystem(t *testing.T) {
+	cfg := &AppConfig{
+		KernelPath: "/sys/kernel/security/apparmor/profiles",
+		FS: newMemFileSystem(map[string]string{
+			"/sys/kernel/security/apparmor/profiles": "custom.web (enforce)\ndocker-default (enforce)\ncustom.db (complain)\n",
+		}),
+	}
+
+	all, custom, err := getLoadedProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	if len(all) != 3 || !custom["custom.web"] || !custom["custom.db"] || custom["docker-default"] {
+		t.Fatalf("unexpected profiles: all=%v custom=%v", all, custom)
+	}
+
+	modes, err := getCustomProfileModes(context.Background(), cfg)
+	ok(t, err)
+
+	if modes["custom.db"] != "complain" || len(modes) != 2 {
+		t.Fatalf("unexpected modes: %v", modes)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
 	"os/exec"
@@ -44,7 +45,7 @@ func TestIsProfileNameCorrect(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := IsProfileNameCorrect(testsDirectory, tt.filename)
+			got := IsProfileNameCorrect(context.Background(), testsDirectory, tt.filename)
 			assertError(t, got, tt.want)
 		})
 	}
@@ -95,7 +96,7 @@ func Test_loadProfile_copies_file_and_calls_parser(t *testing.T) {
 		t.Fatalf("write src: %v", err)
 	}
 
-	err = loadProfile(cfg, src)
+	err = loadProfile(context.Background(), cfg, src)
 	if err != nil {
 		t.Fatalf("loadProfile error: %v", err)
 	}
@@ -118,7 +119,7 @@ func Test_unloadProfile_removes_file(t *testing.T) {
 		t.Fatalf("write etc file: %v", err)
 	}
 
-	err = unloadProfile(cfg, name)
+	err = unloadProfile(context.Background(), cfg, name)
 	if err != nil {
 		t.Fatalf("unloadProfile: %v", err)
 	}
@@ -138,7 +139,7 @@ func Test_unloadAllProfiles_removes_all(t *testing.T) {
 		}
 	}
 
-	err := unloadAllProfiles(cfg)
+	err := unloadAllProfiles(context.Background(), cfg)
 	if err != nil {
 		t.Fatalf("unloadAllProfiles: %v", err)
 	}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunRender(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "custom.web"), statusTestProfile)
+	writeTestFile(t, filepath.Join(dir, ".hidden"), "not a profile")
+
+	var out bytes.Buffer
+
+	ok(t, runRender([]string{"-namespace", "security", dir}, &out))
+
+	// The manifest is read back the way validate and diff read helm template output.
+	sources, err := parseConfigMapManifests("rendered", "kapparmor-profiles", out.Bytes())
+	ok(t, err)
+
+	if len(sources[0].profiles) != 1 || string(sources[0].profiles["custom.web"]) != statusTestProfile {
+		t.Errorf("unexpected rendered profiles %q", sources[0].profiles)
+	}
+
+	out.Reset()
+	ok(t, runRender([]string{"-o", "json", dir}, &out))
+
+	var cm renderedConfigMap
+	ok(t, json.Unmarshal(out.Bytes(), &cm))
+
+	setHash, err := profileSetDigest(&AppConfig{ConfigmapPath: dir})
+	ok(t, err)
+
+	if cm.Metadata.Annotations[annotationProfileSetHash] != setHash {
+		t.Errorf("set hash %s does not match the rollout target hash %s", cm.Metadata.Annotations[annotationProfileSetHash], setHash)
+	}
+
+	want := `{"custom.web":"` + sha256Of(statusTestProfile) + `"}`
+	if got := cm.Metadata.Annotations[annotationProfileDigests]; got != want {
+		t.Errorf("digests annotation %s, want %s", got, want)
+	}
+}
+
+func TestRunRender_InvalidProfile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "custom.web"), statusTestProfile)
+	writeTestFile(t, filepath.Join(dir, "custom.open"), "profile custom.open {\n  file,\n")
+
+	var out bytes.Buffer
+
+	if err := runRender([]string{dir}, &out); !errors.Is(err, errValidationFailed) {
+		t.Fatalf("expected a validation failure, got %v", err)
+	}
+
+	if out.Len() != 0 {
+		t.Errorf("no manifest must be written for invalid profiles:\n%s", out.String())
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseAPI is an in-memory coordination.k8s.io/v1 Lease endpoint for one
+// namespace, serving get and update on its existing ConfigMaps too.
+type fakeLeaseAPI struct {
+	mu         sync.Mutex
+	leases     map[string]leaseObject
+	configMaps map[string]configMapObject
+	version    int
+}
+
+func newFakeLeaseAPI() *fakeLeaseAPI {
+	return &fakeLeaseAPI{leases: map[string]leaseObject{}, configMaps: map[string]configMapObject{}}
+}
+
+func (f *fakeLeaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if name, found := strings.CutPrefix(r.URL.Path, configMapPath("kapparmor", "")); found {
+		f.serveConfigMap(w, r, name)
+
+		return
+	}
+
+	base := leasesPath("kapparmor")
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, base), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		selector := strings.SplitN(r.URL.Query().Get("labelSelector"), "=", 2)
+		list := leaseList{Items: []leaseObject{}}
+
+		for _, l := range f.leases {
+			if len(selector) == 2 && l.Metadata.Labels[selector[0]] == selector[1] {
+				list.Items = append(list.Items, l)
+			}
+		}
+
+		_ = json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodGet:
+		l, found := f.leases[name]
+		if !found {
+			http.Error(w, "not found", http.StatusNotFound)
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(l)
+	case r.Method == http.MethodPost || r.Method == http.MethodPut:
+		var l leaseObject
+		_ = json.NewDecoder(r.Body).Decode(&l)
+
+		current, exists := f.leases[l.Metadata.Name]
+		if r.Method == http.MethodPost && exists {
+			http.Error(w, "already exists", http.StatusConflict)
+
+			return
+		}
+
+		if r.Method == http.MethodPut && (!exists || current.Metadata.ResourceVersion != l.Metadata.ResourceVersion) {
+			http.Error(w, "conflict", http.StatusConflict)
+
+			return
+		}
+
+		f.version++
+		l.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		f.leases[l.Metadata.Name] = l
+		_ = json.NewEncoder(w).Encode(l)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeLeaseAPI) serveConfigMap(w http.ResponseWriter, r *http.Request, name string) {
+	current, exists := f.configMaps[name]
+	if !exists {
+		http.Error(w, "not found", http.StatusNotFound)
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		_ = json.NewEncoder(w).Encode(current)
+	case http.MethodPut:
+		var cm configMapObject
+		_ = json.NewDecoder(r.Body).Decode(&cm)
+
+		if current.Metadata.ResourceVersion != cm.Metadata.ResourceVersion {
+			http.Error(w, "conflict", http.StatusConflict)
+
+			return
+		}
+
+		f.version++
+		cm.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		f.configMaps[name] = cm
+		_ = json.NewEncoder(w).Encode(cm)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeLeaseAPI) annotation(lease, key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.leases[lease].Metadata.Annotations[key]
+}
+
+type rolloutFleet struct {
+	api       *fakeLeaseAPI
+	now       time.Time
+	agents    map[string]*rolloutManager
+	reporters map[string]*nodeStatusReporter
+	configs   map[string]*AppConfig
+}
+
+func newRolloutFleet(t *testing.T, nodes ...string) *rolloutFleet {
+	t.Helper()
+
+	fleet := &rolloutFleet{
+		api:       newFakeLeaseAPI(),
+		now:       time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC),
+		agents:    map[string]*rolloutManager{},
+		reporters: map[string]*nodeStatusReporter{},
+		configs:   map[string]*AppConfig{},
+	}
+
+	// Created by the chart.
+	stableSet := configMapObject{}
+	stableSet.Metadata.Name, stableSet.Metadata.Namespace = rolloutStableConfigMap, "kapparmor"
+	fleet.api.configMaps[rolloutStableConfigMap] = stableSet
+
+	srv := httptest.NewServer(fleet.api)
+	t.Cleanup(srv.Close)
+
+	client := &kubeClient{baseURL: srv.URL, http: srv.Client()}
+	clock := func() time.Time { return fleet.now }
+
+	for _, node := range nodes {
+		fleet.configs[node], _ = preFlightChecksInit(t)
+		fleet.reporters[node] = &nodeStatusReporter{
+			client:    client,
+			namespace: "kapparmor",
+			nodeName:  node,
+			now:       clock,
+			status:    nodeStatus{Node: node},
+		}
+		fleet.agents[node] = &rolloutManager{
+			client:        client,
+			namespace:     "kapparmor",
+			nodeName:      node,
+			canaryPercent: 34,
+			soak:          10 * time.Minute,
+			leaseDuration: 90 * time.Second,
+			now:           clock,
+		}
+	}
+
+	return fleet
+}
+
+// report publishes the node status as reconcileOnce does, without the node inventory.
+func (f *rolloutFleet) report(t *testing.T, node, attemptedHash string, applyErr error) {
+	t.Helper()
+
+	f.reporters[node].observe(attemptedHash, applyErr)
+	ok(t, f.reporters[node].publish(context.Background()))
+}
+
+// cycle runs one reconcile on node, pretending the apply step returns applyErr.
+func (f *rolloutFleet) cycle(t *testing.T, node, desiredHash string, applyErr error) bool {
+	t.Helper()
+
+	if !f.agents[node].beforeReconcile(context.Background(), f.configs[node], desiredHash) {
+		f.report(t, node, "", nil)
+
+		return false
+	}
+
+	f.report(t, node, desiredHash, applyErr)
+
+	return true
+}
+
+func TestRolloutManager_CanaryThenPromotion(t *testing.T) {
+	fleet := newRolloutFleet(t, "node-a", "node-b", "node-c")
+
+	// Initial profile set: nothing to protect, every node applies it.
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		assertBool(t, fleet.cycle(t, node, "v1", nil), true)
+	}
+
+	// New profile set: node-a is the leader and starts the canary phase.
+	fleet.now = fleet.now.Add(30 * time.Second)
+	fleet.cycle(t, "node-a", "v2", nil)
+
+	if phase := fleet.api.annotation(rolloutLeaseName, annotationPhase); phase != rolloutPhaseCanary {
+		t.Fatalf("phase = %q, want %q", phase, rolloutPhaseCanary)
+	}
+
+	canaries := strings.Split(fleet.api.annotation(rolloutLeaseName, annotationCanaries), ",")
+	if len(canaries) != 2 {
+		t.Fatalf("expected 2 canaries (34%% of 3 nodes rounded up), got %v", canaries)
+	}
+
+	applied := map[string]bool{}
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		applied[node] = fleet.cycle(t, node, "v2", nil)
+	}
+
+	for node, ok := range applied {
+		isCanary := strings.Contains(fleet.api.annotation(rolloutLeaseName, annotationCanaries), node)
+		if ok != isCanary {
+			t.Errorf("%s applied=%t, canary=%t", node, ok, isCanary)
+		}
+	}
+
+	// Soak time elapsed without failures: the leader promotes and everyone applies.
+	fleet.now = fleet.now.Add(11 * time.Minute)
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		fleet.report(t, node, "", nil) // keep node leases fresh
+	}
+
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		assertBool(t, fleet.cycle(t, node, "v2", nil), true)
+	}
+
+	if stable := fleet.api.annotation(rolloutLeaseName, annotationStableHash); stable != "v2" {
+		t.Errorf("stable hash = %q, want v2", stable)
+	}
+}
+
+func TestRolloutManager_CanaryFailureHoldsFleet(t *testing.T) {
+	fleet := newRolloutFleet(t, "node-a", "node-b", "node-c")
+	fleet.agents["node-a"].canaryPercent = 1
+
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		fleet.cycle(t, node, "v1", nil)
+	}
+
+	fleet.cycle(t, "node-a", "v2", errors.New("apparmor_parser failed"))
+	canary := fleet.api.annotation(rolloutLeaseName, annotationCanaries)
+
+	// The canary fails to apply the new set.
+	fleet.cycle(t, canary, "v2", errors.New("apparmor_parser failed"))
+	fleet.cycle(t, "node-a", "v2", nil)
+
+	if phase := fleet.api.annotation(rolloutLeaseName, annotationPhase); phase != rolloutPhaseFailed {
+		t.Fatalf("phase = %q, want %q", phase, rolloutPhaseFailed)
+	}
+
+	fleet.now = fleet.now.Add(time.Hour)
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		if node != canary && fleet.cycle(t, node, "v2", nil) {
+			t.Errorf("%s applied a failed rollout", node)
+		}
+	}
+
+	// Reverting the ConfigMap to the stable set is applied everywhere at once.
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		assertBool(t, fleet.cycle(t, node, "v1", nil), true)
+	}
+}
+
+func TestRolloutManager_MissingCanary(t *testing.T) {
+	m := &rolloutManager{nodeName: "node-a", canaryPercent: 50, soak: 10 * time.Minute}
+	start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	healthy := nodeStatus{DesiredHash: "v2", AppliedHash: "v2", ReconcileOK: true}
+	reports := map[string]nodeStatus{"node-a": {AppliedHash: "v1", ReconcileOK: true}, "node-b": healthy}
+
+	// node-gone was drained during the canary phase: the promotion does not wait for it.
+	state := &rolloutState{target: "v2", stable: "v1", phase: rolloutPhaseCanary, canaries: []string{"node-b", "node-gone"}, startedAt: start}
+	m.advance(context.Background(), state, "v2", reports, start.Add(11*time.Minute))
+
+	if state.phase != rolloutPhasePromoted || state.stable != "v2" {
+		t.Errorf("expected the rollout to be promoted without the missing canary, got %+v", state)
+	}
+
+	// Without any canary left, new ones are picked and the soak time starts again.
+	state = &rolloutState{target: "v2", stable: "v1", phase: rolloutPhaseCanary, canaries: []string{"node-gone"}, startedAt: start}
+	m.advance(context.Background(), state, "v2", reports, start.Add(11*time.Minute))
+
+	if state.phase != rolloutPhaseCanary || len(state.canaries) != 1 || state.canaries[0] == "node-gone" ||
+		!state.startedAt.Equal(start.Add(11*time.Minute)) {
+		t.Errorf("expected a new canary phase, got %+v", state)
+	}
+}
+
+func TestRolloutManager_LeaderTakeover(t *testing.T) {
+	fleet := newRolloutFleet(t, "node-a", "node-b")
+
+	fleet.cycle(t, "node-a", "v1", nil)
+	fleet.cycle(t, "node-b", "v1", nil)
+
+	if holder := fleet.api.leases[rolloutLeaseName].Spec.HolderIdentity; holder != "node-a" {
+		t.Fatalf("holder = %q, want node-a", holder)
+	}
+
+	// node-a stops renewing: node-b takes over once the lease expires.
+	fleet.now = fleet.now.Add(2 * time.Minute)
+	fleet.cycle(t, "node-b", "v1", nil)
+
+	if holder := fleet.api.leases[rolloutLeaseName].Spec.HolderIdentity; holder != "node-b" {
+		t.Errorf("holder = %q, want node-b", holder)
+	}
+}
+
+func TestProfileSetDigest(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &AppConfig{ConfigmapPath: dir}
+
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("custom.a", "profile custom.a {}\n")
+	first, err := profileSetDigest(cfg)
+	ok(t, err)
+
+	write(".hidden", "ignored")
+	write("custom.a", "\nprofile custom.a {}\n\n")
+	second, err := profileSetDigest(cfg)
+	ok(t, err)
+
+	if first != second {
+		t.Error("hidden files and surrounding whitespace must not change the digest")
+	}
+
+	write("custom.a", "profile custom.a { deny network, }\n")
+	third, err := profileSetDigest(cfg)
+	ok(t, err)
+
+	if third == first {
+		t.Error("content changes must change the digest")
+	}
+
+	// The policy and the template variables are part of the set, the node labels are not.
+	cfg.Policy, err = loadProfilePolicy("abstractions/base", "")
+	ok(t, err)
+
+	withPolicy, err := profileSetDigest(cfg)
+	ok(t, err)
+
+	cfg.Templater = &profileTemplater{data: templateData{Vars: map[string]string{"log_dir": "/var/log"}}}
+	withVars, err := profileSetDigest(cfg)
+	ok(t, err)
+
+	cfg.Templater.data.Labels = map[string]string{"topology.kubernetes.io/zone": "a"}
+	cfg.Templater.data.Node = "worker-1"
+	withLabels, err := profileSetDigest(cfg)
+	ok(t, err)
+
+	cfg.Templater.data.Vars["log_dir"] = "/data/log"
+	newVars, err := profileSetDigest(cfg)
+	ok(t, err)
+
+	if withPolicy == third || withVars == withPolicy || newVars == withVars {
+		t.Error("policy and template variable changes must change the digest")
+	}
+
+	if withLabels != withVars {
+		t.Error("node labels and names must not change the digest")
+	}
+}
+
+func TestNewRolloutManager_SharesNodeStatusReporter(t *testing.T) {
+	cfg := &AppConfig{RolloutCanaryPercentArg: "10", RolloutSoakArg: "600"}
+
+	if _, err := newRolloutManager(cfg, 30); err == nil {
+		t.Fatal("expected an error without node status reports")
+	}
+
+	cfg.NodeStatus = &nodeStatusReporter{client: &kubeClient{}, namespace: "kapparmor", nodeName: "node-a"}
+
+	m, err := newRolloutManager(cfg, 30)
+	ok(t, err)
+
+	if m.client != cfg.NodeStatus.client || m.namespace != "kapparmor" || m.nodeName != "node-a" || m.leaseDuration != 90*time.Second {
+		t.Errorf("unexpected rollout manager: %+v", m)
+	}
+}
+
+func TestReconcileOnce_HeldNodeStaysReady(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.History = newReconcileHistory()
+	cfg.Loader = &fakeLoader{}
+
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), statusTestProfile)
+	_, err := loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+	writeTestFile(t, cfg.KernelPath, "custom.web (enforce)\n")
+
+	stable, err := profileSetDigest(cfg)
+	ok(t, err)
+
+	// node-a, the only reporting node, is the leader and the canary of the new set.
+	fleet := newRolloutFleet(t, "node-a", "node-b")
+	fleet.cycle(t, "node-a", stable, nil)
+
+	ok(t, os.Remove(filepath.Join(cfg.ConfigmapPath, "custom.web")))
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), "profile custom.web {\n  deny network,\n}\n")
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.new"), "profile custom.new {\n}\n")
+
+	target, err := profileSetDigest(cfg)
+	ok(t, err)
+	assertBool(t, fleet.cycle(t, "node-a", target, nil), true)
+
+	loader := &fakeLoader{}
+	cfg.Loader = loader
+	cfg.Rollout = fleet.agents["node-b"]
+
+	reconcileOnce(context.Background(), cfg)
+
+	if calls := loader.invoked("--replace"); len(calls) != 0 {
+		t.Fatalf("a held node must keep its profiles, got %v", calls)
+	}
+
+	status := cfg.History.latest()
+	if !status.Ready || !status.Held {
+		t.Fatalf("a held node must stay ready: %+v", status)
+	}
+
+	for _, p := range status.Profiles {
+		if !p.Held || !p.InSync {
+			t.Errorf("expected %s to be held and in sync: %+v", p.Name, p)
+		}
+	}
+}
+
+func TestReconcileOnce_RestartedNodeInstallsStableSet(t *testing.T) {
+	fleet := newRolloutFleet(t, "node-a", "node-b")
+	cfg := fleet.configs["node-a"]
+	cfg.Loader = &fakeLoader{}
+
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), statusTestProfile)
+
+	stable, err := profileSetDigest(cfg)
+	ok(t, err)
+
+	// node-a applies the initial set, which becomes the stable one, and stores it.
+	assertBool(t, fleet.cycle(t, "node-a", stable, nil), true)
+
+	if got := fleet.api.configMaps[rolloutStableConfigMap].Metadata.Annotations[annotationStableHash]; got != stable {
+		t.Fatalf("stored stable hash = %q, want %q", got, stable)
+	}
+
+	// node-a is the canary of a new set.
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), "profile custom.web {\n  deny network,\n}\n")
+
+	target, err := profileSetDigest(cfg)
+	ok(t, err)
+	assertBool(t, fleet.cycle(t, "node-a", target, nil), true)
+
+	// node-b restarted: its profiles were unloaded on shutdown, it is held.
+	restarted := fleet.configs["node-b"]
+	restarted.ConfigmapPath = cfg.ConfigmapPath
+	restarted.History = newReconcileHistory()
+	loader := &fakeLoader{}
+	restarted.Loader = loader
+	restarted.Rollout = fleet.agents["node-b"]
+
+	reconcileOnce(context.Background(), restarted)
+
+	if !restarted.History.latest().Held {
+		t.Fatal("node-b must be held by the canary phase")
+	}
+
+	if calls := loader.invoked("--replace"); len(calls) != 1 {
+		t.Fatalf("expected the stable profile to be loaded, got %v", calls)
+	}
+
+	installed, err := os.ReadFile(filepath.Join(restarted.EtcApparmord, "custom.web"))
+	ok(t, err)
+
+	if string(installed) != statusTestProfile {
+		t.Fatalf("installed %q, want the stable version", installed)
+	}
+}
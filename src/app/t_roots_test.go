@@ -31,7 +31,7 @@ func TestReadProfileBytes_viaRootRejectsDotDot(t *testing.T) {
 	}
 	defer r.Close()
 
-	if _, err := readProfileBytes(r, tmp, ".."); err == nil {
+	if _, err := readProfileBytes(hostFileSystem{}, r, tmp, ".."); err == nil {
 		t.Fatal("expected error for path outside root")
 	}
 }
@@ -49,7 +49,7 @@ func TestOpenProfileRoots(t *testing.T) {
 	}
 	defer closeProfileRoots(cfg)
 
-	if _, err := readProfileBytes(cfg.ConfigmapRoot, cfg.ConfigmapPath, "x"); err == nil {
+	if _, err := readProfileBytes(cfg.filesystem(), cfg.ConfigmapRoot, cfg.ConfigmapPath, "x"); err == nil {
 		t.Fatal("expected error for missing file")
 	}
 }
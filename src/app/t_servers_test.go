@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert issues a certificate for 127.0.0.1, self-signed when parent is nil.
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	ok(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	ok(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	ok(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	ok(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ok(t, os.WriteFile(certFile, c.certPEM, 0o600))
+	ok(t, os.WriteFile(keyFile, c.keyPEM, 0o600))
+
+	return certFile, keyFile
+}
+
+func TestNewAgentServer_Validation(t *testing.T) {
+	valid := AppConfig{HTTPPort: "8080", HTTPReadTimeoutArg: "10", HTTPWriteTimeoutArg: "10"}
+
+	for name, mutate := range map[string]func(*AppConfig){
+		"bad port":          func(c *AppConfig) { c.HTTPPort = "70000" },
+		"bad read timeout":  func(c *AppConfig) { c.HTTPReadTimeoutArg = "0" },
+		"bad write timeout": func(c *AppConfig) { c.HTTPWriteTimeoutArg = "x" },
+		"cert without key":  func(c *AppConfig) { c.HTTPTLSCert = "/tmp/tls.crt" },
+		"mtls without tls":  func(c *AppConfig) { c.HTTPMetricsClientCA = "/tmp/ca.crt" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid
+			mutate(&cfg)
+
+			if _, err := newAgentServer(&cfg); err == nil {
+				t.Error("expected a configuration error")
+			}
+		})
+	}
+
+	cfg := valid
+	cfg.HTTPBindAddress = "127.0.0.1"
+
+	srv, err := newAgentServer(&cfg)
+	ok(t, err)
+
+	if srv.Addr != "127.0.0.1:8080" || srv.ReadTimeout != 10*time.Second || srv.TLSConfig != nil {
+		t.Errorf("unexpected server: addr=%s read=%s tls=%v", srv.Addr, srv.ReadTimeout, srv.TLSConfig != nil)
+	}
+}
+
+func TestAgentServer_TLSReloadAndMetricsClientAuth(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "kapparmor-test-ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "first", ca).write(t, dir, "tls")
+
+	cfg := &AppConfig{
+		HTTPPort: "8080", HTTPReadTimeoutArg: "5", HTTPWriteTimeoutArg: "5",
+		HTTPTLSCert: certFile, HTTPTLSKey: keyFile, HTTPMetricsClientCA: caFile,
+	}
+
+	srv, err := newAgentServer(cfg)
+	ok(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	ok(t, err)
+
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	get := func(path string, clientCerts ...tls.Certificate) (*http.Response, string) {
+		t.Helper()
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: clientCerts,
+			MinVersion:   tls.VersionTLS12,
+		}}}
+
+		resp, err := client.Get("https://" + ln.Addr().String() + path)
+		ok(t, err)
+		_ = resp.Body.Close()
+
+		return resp, resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if resp, served := get("/healthz"); resp.StatusCode != http.StatusOK || served != "first" {
+		t.Fatalf("/healthz without client cert: %d, served %q", resp.StatusCode, served)
+	}
+
+	if resp, _ := get("/metrics"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/metrics without client cert: got %d, want 401", resp.StatusCode)
+	}
+
+	client := newTestCert(t, "prometheus", ca)
+	pair, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	ok(t, err)
+
+	if resp, _ := get("/metrics", pair); resp.StatusCode != http.StatusOK {
+		t.Errorf("/metrics with client cert: got %d, want 200", resp.StatusCode)
+	}
+
+	// Rotate the serving certificate: new connections get it without a restart.
+	rotated := newTestCert(t, "second", ca)
+	ok(t, os.WriteFile(certFile, rotated.certPEM, 0o600))
+	ok(t, os.WriteFile(keyFile, rotated.keyPEM, 0o600))
+
+	future := time.Now().Add(time.Minute)
+	ok(t, os.Chtimes(certFile, future, future))
+	ok(t, os.Chtimes(keyFile, future, future))
+
+	if _, served := get("/healthz"); served != "second" {
+		t.Errorf("served certificate %q after rotation, want second", served)
+	}
+}
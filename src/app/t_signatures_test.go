@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writePublicKey writes the PEM encoding of key to dir/name.
+func writePublicKey(t *testing.T, dir, name string, key crypto.PublicKey) {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	ok(t, err)
+	writeTestFile(t, filepath.Join(dir, name), string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+}
+
+func TestLoadNewProfiles_Signatures(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	keys := t.TempDir()
+	writePublicKey(t, keys, "release.pub", public)
+
+	cfg.Verifier, err = loadProfileVerifier(keys)
+	ok(t, err)
+
+	sign := func(name, content string) {
+		writeTestFile(t, filepath.Join(cfg.ConfigmapPath, name), content)
+		writeTestFile(t, filepath.Join(cfg.ConfigmapPath, name+SignatureSuffix),
+			base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(content)))+"\n")
+	}
+
+	sign("custom.web", statusTestProfile)
+
+	loader := &fakeLoader{}
+	cfg.Loader = loader
+
+	_, err = loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	if calls := loader.invoked("--replace"); len(calls) != 1 || filepath.Base(calls[0][len(calls[0])-1]) != ".custom.web.rendered" {
+		t.Fatalf("expected the staged copy of the signed profile to be loaded, got %v", calls)
+	}
+
+	// The ConfigMap is updated after the verification: the verified bytes are loaded.
+	ctx := withVerifiedSources(context.Background(), map[string][]byte{"custom.web": []byte(allowlistTestProfile)}, nil)
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), "profile custom.web {\n  file,\n}\n")
+	ok(t, loadProfile(ctx, cfg, filepath.Join(cfg.ConfigmapPath, "custom.web")))
+
+	if installed, err := os.ReadFile(filepath.Join(cfg.EtcApparmord, "custom.web")); err != nil || string(installed) != allowlistTestProfile {
+		t.Errorf("expected the verified content to be installed, got %q, %v", installed, err)
+	}
+
+	// A rejected profile is blocked, keeping its installed version; the others are still reconciled.
+	writeTestFile(t, cfg.KernelPath, "custom.web (enforce)\n")
+	cfg.History = newReconcileHistory()
+
+	for name, tc := range map[string]struct {
+		tamper  func()
+		loaded  []string
+		blocked string
+		reason  error
+	}{
+		"unsigned profile": {
+			tamper: func() {
+				writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.evil"), "profile custom.evil {\n  file,\n}\n")
+			},
+			loaded:  []string{".custom.web.rendered"},
+			blocked: "custom.evil",
+			reason:  errSignatureMissing,
+		},
+		"modified profile": {
+			tamper: func() {
+				ok(t, os.Remove(filepath.Join(cfg.ConfigmapPath, "custom.web")))
+				writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), "profile custom.web {\n  file,\n}\n")
+			},
+			blocked: "custom.web",
+			reason:  errSignatureInvalid,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeTestFile(t, filepath.Join(cfg.EtcApparmord, "custom.web"), allowlistTestProfile)
+			sign("custom.web", statusTestProfile)
+			ok(t, os.RemoveAll(filepath.Join(cfg.ConfigmapPath, "custom.evil")))
+			tc.tamper()
+
+			loader := &fakeLoader{}
+			cfg.Loader = loader
+
+			_, err := loadNewProfiles(context.Background(), cfg)
+			ok(t, err)
+
+			var loaded []string
+			for _, call := range loader.invoked("--replace") {
+				loaded = append(loaded, filepath.Base(call[len(call)-1]))
+			}
+
+			if !slices.Equal(loaded, tc.loaded) || len(loader.invoked("--remove")) != 0 {
+				t.Fatalf("loaded %v, want %v, calls %v", loaded, tc.loaded, loader.calls)
+			}
+
+			if reason := cfg.History.profile(tc.blocked).blockedReason; !strings.Contains(reason, tc.reason.Error()) {
+				t.Errorf("expected %s to be blocked by %v, got %q", tc.blocked, tc.reason, reason)
+			}
+		})
+	}
+}
+
+func TestProfileVerifier_CosignECDSA(t *testing.T) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+
+	keys := t.TempDir()
+	writePublicKey(t, keys, "cosign.pub", &private.PublicKey)
+
+	verifier, err := loadProfileVerifier(filepath.Join(keys, "cosign.pub"))
+	ok(t, err)
+
+	// cosign sign-blob signs the sha256 of the blob and prints the base64 ASN.1 signature.
+	digest := sha256.Sum256([]byte(statusTestProfile))
+	signature, err := ecdsa.SignASN1(rand.Reader, private, digest[:])
+	ok(t, err)
+
+	encoded := []byte(base64.StdEncoding.EncodeToString(signature))
+
+	ok(t, verifier.verify([]byte(statusTestProfile), encoded))
+
+	if err := verifier.verify([]byte(statusTestProfile+"\n  capability,\n"), encoded); !errors.Is(err, errSignatureInvalid) {
+		t.Errorf("modified content verified: %v", err)
+	}
+}
+
+func TestLoadProfileVerifier_Rejects(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	ok(t, err)
+
+	keys := t.TempDir()
+	writePublicKey(t, keys, "rsa.pub", &rsaKey.PublicKey)
+
+	if _, err := loadProfileVerifier(keys); err == nil {
+		t.Error("RSA keys must be refused")
+	}
+
+	empty := t.TempDir()
+	writeTestFile(t, filepath.Join(empty, "README"), "no keys here")
+
+	if _, err := loadProfileVerifier(empty); err == nil {
+		t.Error("a key directory without keys must be refused")
+	}
+}
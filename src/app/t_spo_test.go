@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const spoTestManifest = `apiVersion: security-profiles-operator.x-k8s.io/v1alpha1
+kind: AppArmorProfile
+metadata:
+  name: web
+spec:
+  complainMode: true
+  abstract:
+    executable:
+      allowedExecutables: [/usr/bin/nginx]
+      allowedLibraries: [/usr/lib/**]
+    filesystem:
+      readOnlyPaths: [/etc/nginx/**]
+      readWritePaths: [/var/cache/nginx/**]
+    network:
+      allowedProtocols:
+        allowTcp: true
+    capability:
+      allowedCapabilities: [net_bind_service]
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+---
+apiVersion: security-profiles-operator.x-k8s.io/v1alpha1
+kind: AppArmorProfile
+metadata:
+  name: custom.raw
+spec:
+  policy: |
+    profile custom.raw flags=(attach_disconnected) {
+      file,
+      deny /etc/** w,
+    }
+`
+
+func TestSPO_ImportExportRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "spo.yaml")
+	profiles := filepath.Join(dir, "profiles")
+	writeTestFile(t, manifest, spoTestManifest)
+
+	var out bytes.Buffer
+
+	ok(t, runSPO([]string{"import", "-out", profiles, manifest}, &out))
+
+	if out.String() != filepath.Join(profiles, "custom.raw")+"\n"+filepath.Join(profiles, "custom.web")+"\n" {
+		t.Fatalf("unexpected imported files:\n%s", out.String())
+	}
+
+	web, err := os.ReadFile(filepath.Join(profiles, "custom.web"))
+	ok(t, err)
+
+	for _, rule := range []string{"flags=(attach_disconnected,complain)", "/usr/bin/nginx ix,", "/usr/lib/** mr,",
+		"/etc/nginx/** r,", "/var/cache/nginx/** rw,", "network inet6 tcp,", "capability net_bind_service,"} {
+		if !strings.Contains(string(web), rule) {
+			t.Errorf("generated profile misses %q:\n%s", rule, web)
+		}
+	}
+
+	out.Reset()
+	ok(t, runSPO([]string{"export", "-namespace", "security", profiles}, &out))
+
+	docs := strings.Split(out.String(), "---\n")
+	if len(docs) != 2 || !strings.Contains(docs[0], "policy: |") || !strings.Contains(docs[1], "namespace: security") {
+		t.Fatalf("unexpected export:\n%s", out.String())
+	}
+
+	// Exporting the generated profile gives back the abstract policy.
+	abstract, complain, found := abstractFromProfile("custom.web", web)
+	if !found || !complain {
+		t.Fatalf("custom.web not exported as abstract policy:\n%s", docs[1])
+	}
+
+	want := &spoAbstract{
+		Executable: &spoExecutableRules{AllowedExecutables: []string{"/usr/bin/nginx"}, AllowedLibraries: []string{"/usr/lib/**"}},
+		Filesystem: &spoFilesystemRules{ReadOnlyPaths: []string{"/etc/nginx/**"}, ReadWritePaths: []string{"/var/cache/nginx/**"}},
+		Network:    &spoNetworkRules{AllowedProtocols: &spoProtocols{AllowTCP: true}},
+		Capability: &spoCapabilityRules{AllowedCapabilities: []string{"net_bind_service"}},
+	}
+	if !reflect.DeepEqual(abstract, want) {
+		t.Errorf("got %+v, want %+v", abstract, want)
+	}
+}
+
+func TestAbstractFromProfile_NotRepresentable(t *testing.T) {
+	base := "#include <tunables/global>\nprofile custom.web flags=(attach_disconnected) {\n  #include <abstractions/base>\n%s}\n"
+
+	for name, rules := range map[string]string{
+		"deny rule":     "  deny /etc/** w,\n",
+		"owner rule":    "  owner /home/** rw,\n",
+		"ipv4 only tcp": "  network inet tcp,\n",
+		"mount rule":    "  mount,\n",
+	} {
+		if _, _, found := abstractFromProfile("custom.web", []byte(strings.Replace(base, "%s", rules, 1))); found {
+			t.Errorf("%s: converted to an abstract policy", name)
+		}
+	}
+}
+
+func TestSPO_ImportRejects(t *testing.T) {
+	for name, spec := range map[string]string{
+		"not a custom profile": "  policy: |\n    profile nginx {\n    }\n",
+		"rule injection":       "  abstract:\n    filesystem:\n      readOnlyPaths: [\"/tmp r,\\n  capability sys_admin\"]\n",
+		"bad capability":       "  abstract:\n    capability:\n      allowedCapabilities: [\"sys_admin, mount\"]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			manifest := filepath.Join(dir, "spo.yaml")
+			writeTestFile(t, manifest, "kind: AppArmorProfile\nmetadata:\n  name: web\nspec:\n"+spec)
+
+			if err := runSPO([]string{"import", "-out", filepath.Join(dir, "out"), manifest}, &bytes.Buffer{}); err == nil {
+				t.Error("expected an error")
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, "out")); !os.IsNotExist(err) {
+				t.Error("nothing must be written on errors")
+			}
+		})
+	}
+}
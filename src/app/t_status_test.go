@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const statusTestProfile = "profile custom.web {\n    file,\n}\n"
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectAgentStatus(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.History = newReconcileHistory()
+
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), statusTestProfile)
+	writeTestFile(t, filepath.Join(cfg.EtcApparmord, "custom.web"), statusTestProfile)
+	writeTestFile(t, cfg.KernelPath, "/usr/bin/man (enforce)\ncustom.web (complain)\n")
+	cfg.History.applied("custom.web", cfg.clock().Now(), nil)
+	cfg.History.reconciled(cfg.clock().Now(), nil)
+
+	status := collectAgentStatus(context.Background(), cfg)
+	if !status.Ready || len(status.Profiles) != 1 {
+		t.Fatalf("expected a ready node with one profile, got %+v", status)
+	}
+
+	web := status.Profiles[0]
+	if web.KernelMode != "complain" || web.LastAppliedTime == nil || !web.InSync {
+		t.Errorf("unexpected custom.web status: %+v", web)
+	}
+
+	if web.SourceSHA256 == "" || web.SourceSHA256 != web.InstalledSHA256 {
+		t.Errorf("source and installed sha256 should match: %q != %q", web.SourceSHA256, web.InstalledSHA256)
+	}
+
+	if status.LastReconcileTime == nil {
+		t.Error("last reconcile time not reported")
+	}
+
+	// Changed ConfigMap, failed apply, an orphan in the kernel and an invalid file.
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), "profile custom.web {\n    deny network,\n}\n")
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.broken"), "profile custom.other {\n}\n")
+	writeTestFile(t, cfg.KernelPath, "custom.web (enforce)\ncustom.old (enforce)\n")
+	cfg.History.applied("custom.web", cfg.clock().Now(), errors.New("apparmor_parser failed"))
+
+	status = collectAgentStatus(context.Background(), cfg)
+	if status.Ready {
+		t.Fatal("node must not be ready")
+	}
+
+	reasons := strings.Join(status.Reasons, "\n")
+	for _, want := range []string{
+		"profile custom.broken is quarantined",
+		"profile custom.old is loaded but no longer in the ConfigMap",
+		"profile custom.web installed file differs from the ConfigMap",
+	} {
+		if !strings.Contains(reasons, want) {
+			t.Errorf("reasons %q do not contain %q", reasons, want)
+		}
+	}
+
+	if web := status.Profiles[2]; web.Name != "custom.web" || web.LastError != "apparmor_parser failed" {
+		t.Errorf("unexpected custom.web status: %+v", web)
+	}
+}
+
+func TestCollectAgentStatus_InjectedClock(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.History = newReconcileHistory()
+	cfg.Loader = &fakeLoader{}
+
+	clock := newFakeClock()
+	cfg.Clock = clock
+
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), statusTestProfile)
+
+	_, err := loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+	cfg.History.reconciled(cfg.clock().Now(), err)
+
+	status := collectAgentStatus(context.Background(), cfg)
+	if len(status.Profiles) != 1 || status.Profiles[0].LastAppliedTime == nil || !status.Profiles[0].LastAppliedTime.Equal(clock.now) {
+		t.Errorf("the apply time must come from the injected clock: %+v", status.Profiles)
+	}
+
+	if !status.GeneratedAt.Equal(clock.now) || status.LastReconcileTime == nil || !status.LastReconcileTime.Equal(clock.now) {
+		t.Errorf("the status times must come from the injected clock: %v, %v", status.GeneratedAt, status.LastReconcileTime)
+	}
+}
+
+func TestWriteReadiness(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.History = newReconcileHistory()
+
+	probe := func() (int, string) {
+		rec := httptest.NewRecorder()
+		writeReadiness(cfg)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, body := probe(); code != http.StatusServiceUnavailable || !strings.Contains(body, errNoStatusYet) {
+		t.Fatalf("before the first snapshot: got %d %q", code, body)
+	}
+
+	refreshAgentStatus(context.Background(), cfg)
+
+	if code, body := probe(); code != http.StatusOK || body != "READY" {
+		t.Fatalf("empty node: got %d %q", code, body)
+	}
+
+	// Probes serve the snapshot: changes are only seen after the next refresh.
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), statusTestProfile)
+
+	if code, _ := probe(); code != http.StatusOK {
+		t.Fatalf("got %d before the refresh, want 200", code)
+	}
+
+	refreshAgentStatus(context.Background(), cfg)
+
+	code, body := probe()
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want 503", code)
+	}
+
+	if body != "NOT_READY\nprofile custom.web is not loaded in the kernel\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestWriteStatus_ServesSnapshot(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.History = newReconcileHistory()
+
+	rec := httptest.NewRecorder()
+	writeStatus(cfg)(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d before the first snapshot, want 503", rec.Code)
+	}
+
+	refreshAgentStatus(context.Background(), cfg)
+
+	// A missing profile source must not reach the probes (it used to exit the process).
+	cfg.ConfigmapPath = filepath.Join(t.TempDir(), "missing")
+
+	rec = httptest.NewRecorder()
+	writeStatus(cfg)(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	var status agentStatus
+	ok(t, json.NewDecoder(rec.Body).Decode(&status))
+
+	if rec.Code != http.StatusOK || !status.Ready {
+		t.Errorf("got %d %+v, want the ready snapshot", rec.Code, status)
+	}
+}
+
+// gatheredValue returns the value of the gauge or counter series of name matching labels from the default registry.
+func gatheredValue(t *testing.T, name string, labels map[string]string) (float64, bool) {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	ok(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+	series:
+		for _, m := range family.GetMetric() {
+			for _, pair := range m.GetLabel() {
+				if want, found := labels[pair.GetName()]; found && want != pair.GetValue() {
+					continue series
+				}
+			}
+
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue(), true
+			}
+
+			return m.GetGauge().GetValue(), true
+		}
+	}
+
+	return 0, false
+}
+
+func TestRecordProfileMetrics_ReplaceAndRestart(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.ProfilerFullPath = "true" // 'true' always succeeds
+
+	source := filepath.Join(cfg.ConfigmapPath, "custom.web")
+	writeTestFile(t, source, statusTestProfile)
+	writeTestFile(t, cfg.KernelPath, "custom.web (enforce)\n")
+
+	// Load, then replace twice after ConfigMap edits.
+	for _, content := range []string{statusTestProfile, "profile custom.web {\n  deny network,\n}\n", statusTestProfile} {
+		writeTestFile(t, source, content)
+		ok(t, loadProfile(context.Background(), cfg, source))
+	}
+
+	refreshAgentStatus(context.Background(), cfg)
+
+	if managed, _ := gatheredValue(t, "kapparmor_profiles_managed", nil); managed != 1 {
+		t.Errorf("profiles_managed after replacements = %v, want 1", managed)
+	}
+
+	if loaded, found := gatheredValue(t, "kapparmor_profile_loaded",
+		map[string]string{"profile": "custom.web", "mode": "enforce"}); !found || loaded != 1 {
+		t.Errorf("profile_loaded{custom.web,enforce} = %v (found %t), want 1", loaded, found)
+	}
+
+	if _, found := gatheredValue(t, "kapparmor_profile_info", map[string]string{
+		"profile_name": "custom.web", "sha256": sha256Of(statusTestProfile), "source_sha256": sha256Of(statusTestProfile),
+		"mode": "enforce", "source": "configmap",
+	}); !found {
+		t.Error("profile_info missing the installed and source sha256 of custom.web")
+	}
+
+	// Restart: a fresh agent finds the profile already installed and loaded, in complain mode.
+	writeTestFile(t, cfg.KernelPath, "custom.web (complain)\n")
+	cfg.History = newReconcileHistory()
+	refreshAgentStatus(context.Background(), cfg)
+
+	if managed, _ := gatheredValue(t, "kapparmor_profiles_managed", nil); managed != 1 {
+		t.Errorf("profiles_managed after restart = %v, want 1", managed)
+	}
+
+	if _, found := gatheredValue(t, "kapparmor_profile_loaded",
+		map[string]string{"profile": "custom.web", "mode": "enforce"}); found {
+		t.Error("stale profile_loaded series for the previous mode")
+	}
+
+	// Profile removed from the kernel and the host.
+	writeTestFile(t, cfg.KernelPath, "")
+	ok(t, os.Remove(filepath.Join(cfg.EtcApparmord, "custom.web")))
+	refreshAgentStatus(context.Background(), cfg)
+
+	if managed, _ := gatheredValue(t, "kapparmor_profiles_managed", nil); managed != 0 {
+		t.Errorf("profiles_managed after removal = %v, want 0", managed)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const templateTestProfile = `profile custom.web {
+  {{ .Vars.log_dir }}/** rw,
+  /srv/{{ index .Labels "topology.kubernetes.io/zone" | lower }}/** r,
+  /etc/{{ .Node }}/{{ default "web" .Vars.app }}.conf r,
+}
+`
+
+// fakeLabeledNode serves GET of the node worker-1 with labels.
+func fakeLabeledNode(t *testing.T, labels map[string]string) *kubeClient {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/api/v1/nodes/worker-1" {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		var node nodeObject
+		node.Metadata.Name = "worker-1"
+		node.Metadata.Labels = labels
+		_ = json.NewEncoder(w).Encode(node)
+	}))
+	t.Cleanup(srv.Close)
+
+	return &kubeClient{baseURL: srv.URL, http: srv.Client()}
+}
+
+func TestProfileTemplater_Render(t *testing.T) {
+	vars := t.TempDir()
+	writeTestFile(t, filepath.Join(vars, "log_dir"), "/var/log/web\n")
+	writeTestFile(t, filepath.Join(vars, "app"), "")
+
+	templater := &profileTemplater{
+		varsDir:  vars,
+		nodeName: "worker-1",
+		client:   fakeLabeledNode(t, map[string]string{"topology.kubernetes.io/zone": "EU-West-1a"}),
+	}
+	ok(t, templater.load(context.Background()))
+
+	rendered, err := templater.render("custom.web", []byte(templateTestProfile))
+	ok(t, err)
+
+	want := "profile custom.web {\n  /var/log/web/** rw,\n  /srv/eu-west-1a/** r,\n  /etc/worker-1/web.conf r,\n}\n"
+	if string(rendered) != want {
+		t.Errorf("unexpected rendered profile:\n%s", rendered)
+	}
+
+	for name, src := range map[string]string{
+		"missing variable": "profile custom.web {\n  {{ .Vars.cache_dir }}/** rw,\n}\n",
+		"call":             "profile custom.web {\n  {{ call .Vars.app }}\n}\n",
+		"syntax":           "profile custom.web {\n  {{ .Vars.app \n}\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := templater.render("custom.web", []byte(src)); err == nil {
+				t.Fatal("expected a render error")
+			}
+		})
+	}
+
+	// Values that could end the rule or add one are refused, the previous values are kept.
+	for name, value := range map[string]string{
+		"newline":     "/var/log/web/** rw,\n  /etc/shadow r,\n  /var/log/web",
+		"comma":       "/var/log/app rw, /** rwx, /x",
+		"alternation": "/var/log/{app,/etc}",
+		"quote":       `/var/log/app" rw, "/x`,
+		"comment":     "/var/log/app#",
+		"escape":      `/var/log/app\,`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeTestFile(t, filepath.Join(vars, "log_dir"), value)
+
+			if err := templater.load(context.Background()); err == nil {
+				t.Fatalf("expected %q to be refused", value)
+			}
+
+			if rendered, err := templater.render("custom.web", []byte(templateTestProfile)); err != nil || string(rendered) != want {
+				t.Errorf("the previous values were dropped: %q, %v", rendered, err)
+			}
+		})
+	}
+}
+
+func TestLoadNewProfiles_Templates(t *testing.T) {
+	cfg, _ := preFlightChecksInit(t)
+	cfg.History = newReconcileHistory()
+
+	vars := t.TempDir()
+	writeTestFile(t, filepath.Join(vars, "log_dir"), "/var/log/web")
+
+	cfg.TemplateVarsPath, cfg.NodeName = vars, "worker-1"
+
+	var err error
+	cfg.Templater, err = newProfileTemplater(context.Background(), cfg)
+	ok(t, err)
+
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), "profile custom.web {\n  {{ .Vars.log_dir }}/** rw,\n}\n")
+
+	loader := &fakeLoader{}
+	cfg.Loader = loader
+
+	_, err = loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	if calls := loader.invoked("--replace"); len(calls) != 1 || filepath.Base(calls[0][len(calls[0])-1]) != ".custom.web.rendered" {
+		t.Fatalf("expected the rendered custom.web to be loaded, got %v", calls)
+	}
+
+	installed, err := os.ReadFile(filepath.Join(cfg.EtcApparmord, "custom.web"))
+	ok(t, err)
+
+	if !strings.Contains(string(installed), "  /var/log/web/** rw,\n") {
+		t.Errorf("the installed profile is not rendered:\n%s", installed)
+	}
+
+	writeTestFile(t, cfg.KernelPath, "custom.web (enforce)\n")
+
+	if status := collectAgentStatus(context.Background(), cfg); !status.Ready {
+		t.Errorf("the rendered profile must be in sync: %v", status.Reasons)
+	}
+
+	// A new value changes the rendered profile, which is replaced on the next cycle.
+	writeTestFile(t, filepath.Join(vars, "log_dir"), "/data/log/web")
+
+	loader = &fakeLoader{}
+	cfg.Loader = loader
+
+	_, err = loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	if calls := loader.invoked("--replace"); len(calls) != 1 {
+		t.Fatalf("expected custom.web to be replaced after the variable changed, got %v", calls)
+	}
+
+	installed, err = os.ReadFile(filepath.Join(cfg.EtcApparmord, "custom.web"))
+	ok(t, err)
+
+	if !strings.Contains(string(installed), "  /data/log/web/** rw,\n") {
+		t.Errorf("the installed profile was not rendered again:\n%s", installed)
+	}
+
+	// A template that fails to render is blocked, keeping the installed version.
+	ok(t, os.Remove(filepath.Join(cfg.ConfigmapPath, "custom.web")))
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), "profile custom.web {\n  {{ .Vars.cache_dir }}/** rw,\n}\n")
+
+	loader = &fakeLoader{}
+	cfg.Loader = loader
+
+	_, err = loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	if calls := append(loader.invoked("--replace"), loader.invoked("--remove")...); len(calls) != 0 {
+		t.Fatalf("a profile that fails to render must be neither loaded nor unloaded, got %v", calls)
+	}
+
+	if reloaded, err := os.ReadFile(filepath.Join(cfg.EtcApparmord, "custom.web")); err != nil || string(reloaded) != string(installed) {
+		t.Errorf("the installed version was replaced: %q, %v", reloaded, err)
+	}
+
+	if value, found := gatheredValue(t, "kapparmor_profile_blocked", map[string]string{"profile": "custom.web"}); !found || value != 1 {
+		t.Errorf("expected custom.web to be reported as blocked, got %v (found %v)", value, found)
+	}
+}
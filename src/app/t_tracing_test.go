@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestLoadNewProfiles_Spans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	cfg, _ := preFlightChecksInit(t)
+	cfg.ProfilerFullPath = "true" // 'true' always succeeds
+
+	writeTestFile(t, filepath.Join(cfg.ConfigmapPath, "custom.web"), statusTestProfile)
+	writeTestFile(t, filepath.Join(cfg.EtcApparmord, "custom.old"), "profile custom.old {\n}\n")
+	writeTestFile(t, cfg.KernelPath, "custom.old (enforce)\n")
+
+	_, err := loadNewProfiles(context.Background(), cfg)
+	ok(t, err)
+
+	spans := exporter.GetSpans()
+	byName := map[string]tracetest.SpanStub{}
+	parserCalls := 0
+
+	for _, span := range spans {
+		byName[span.Name] = span
+		if span.Name == "execApparmor" {
+			parserCalls++
+		}
+	}
+
+	root, found := byName["loadNewProfiles"]
+	if !found {
+		t.Fatalf("no loadNewProfiles span in %d spans", len(spans))
+	}
+
+	for _, name := range []string{"getNewProfiles", "getLoadedProfiles", "calculateProfileChanges", "loadProfile", "unloadProfile"} {
+		span, found := byName[name]
+		if !found {
+			t.Errorf("missing %s span", name)
+
+			continue
+		}
+
+		if span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("%s is not a child of loadNewProfiles", name)
+		}
+	}
+
+	if parserCalls < 2 {
+		t.Errorf("got %d execApparmor spans, want at least one per load and unload", parserCalls)
+	}
+
+	if parser := byName["execApparmor"]; parser.Parent.SpanID() == root.SpanContext.SpanID() {
+		t.Error("execApparmor should be a child of the profile operation span")
+	}
+}
+
+func TestSetupTracing_NoopWithoutEndpoint(t *testing.T) {
+	previous := otel.GetTracerProvider()
+
+	shutdown, err := setupTracing(context.Background(), &AppConfig{})
+	ok(t, err)
+	ok(t, shutdown(context.Background()))
+
+	if otel.GetTracerProvider() != previous {
+		t.Error("the global tracer provider must not change without an OTLP endpoint")
+	}
+}
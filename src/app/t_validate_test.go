@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const validateTestManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kapparmor-settings
+data:
+  POLL_TIME: "30"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kapparmor-profiles
+data:
+  custom.web: |
+    profile custom.web {
+      file,
+    }
+  custom.wrong: |
+    profile custom.other {
+    }
+binaryData:
+  custom.bin: cHJvZmlsZSBjdXN0b20uYmluIHsKfQo=
+`
+
+func TestRunValidate_Directory(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "custom.web"), statusTestProfile)
+	writeTestFile(t, filepath.Join(dir, "custom.open"), "profile custom.open {\n  file,\n")
+	writeTestFile(t, filepath.Join(dir, ".hidden"), "not a profile")
+
+	var out bytes.Buffer
+
+	err := runValidate([]string{dir}, &out)
+	if !errors.Is(err, errValidationFailed) {
+		t.Fatalf("expected a validation failure, got %v", err)
+	}
+
+	want := "OK   custom.web (" + dir + ")"
+	if !strings.Contains(out.String(), want) || !strings.Contains(out.String(), "FAIL custom.open") ||
+		!strings.Contains(out.String(), "2 profiles checked, 1 failed") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestRunValidate_ManifestFormats(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "manifest.yaml")
+	writeTestFile(t, manifest, validateTestManifest)
+
+	var out bytes.Buffer
+
+	if err := runValidate([]string{"-o", "json", manifest}, &out); !errors.Is(err, errValidationFailed) {
+		t.Fatalf("expected a validation failure, got %v", err)
+	}
+
+	var report validationReport
+	ok(t, json.Unmarshal(out.Bytes(), &report))
+
+	if len(report.Results) != 3 || report.Failed != 1 {
+		t.Fatalf("the settings ConfigMap must be ignored: %+v", report)
+	}
+
+	for _, result := range report.Results {
+		if result.Valid == (result.Name == "custom.wrong") {
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+
+	out.Reset()
+
+	_ = runValidate([]string{"-o", "junit", manifest}, &out)
+
+	var suite junitTestSuite
+	ok(t, xml.Unmarshal(out.Bytes(), &suite))
+
+	if suite.Tests != 3 || suite.Failures != 1 || suite.Cases[2].Failure == nil {
+		t.Errorf("unexpected JUnit suite %+v", suite)
+	}
+
+	out.Reset()
+
+	if err := runValidate([]string{"-configmap", "missing", manifest}, &out); err == nil {
+		t.Error("expected an error for a missing ConfigMap")
+	}
+}
+
+func TestRunValidate_ChartProfiles(t *testing.T) {
+	var out bytes.Buffer
+
+	ok(t, runValidate([]string{filepath.Join("..", "..", "charts", "kapparmor", "profiles")}, &out))
+}
+
+func TestRunValidate_PolicyAndTemplates(t *testing.T) {
+	dir, vars := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "custom.web"), "profile custom.web {\n  #include <abstractions/base>\n  {{ .Vars.log_dir }}/** rw,\n}\n")
+	writeTestFile(t, filepath.Join(dir, "custom.open"), "profile custom.open {\n  file,\n}\n")
+	writeTestFile(t, filepath.Join(vars, "log_dir"), "/var/log/web")
+
+	var out bytes.Buffer
+
+	err := runValidate([]string{"-required-includes", "abstractions/base", "-template-vars", vars, dir}, &out)
+	if !errors.Is(err, errValidationFailed) {
+		t.Fatalf("expected a validation failure, got %v", err)
+	}
+
+	if !strings.Contains(out.String(), "OK   custom.web") ||
+		!strings.Contains(out.String(), "FAIL custom.open ("+dir+"): profile policy violation: missing required include <abstractions/base>") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	// Without the flags the template is checked as stored and no include is required.
+	out.Reset()
+	ok(t, runValidate([]string{dir}, &out))
+}
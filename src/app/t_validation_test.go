@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -85,12 +86,12 @@ func Test_HasTheSameContent_WithFS(t *testing.T) {
 		"c": &fstest.MapFile{Data: []byte("world")},
 	}
 
-	eq, err := HasTheSameContent(fs.FS(m), "a", "b")
+	eq, err := HasTheSameContent(context.Background(), fs.FS(m), "a", "b")
 	if err != nil || !eq {
 		t.Fatalf("expected equal, got eq=%v err=%v", eq, err)
 	}
 
-	eq, err = HasTheSameContent(fs.FS(m), "a", "c")
+	eq, err = HasTheSameContent(context.Background(), fs.FS(m), "a", "c")
 	if err != nil || eq {
 		t.Fatalf("expected not equal, got eq=%v err=%v", eq, err)
 	}
@@ -111,7 +112,7 @@ func Test_getProfilesNamesFromFile_parsing(t *testing.T) {
 		t.Fatalf("write profiles list: %v", err)
 	}
 
-	all, custom, err := getProfilesNamesFromFile(profilesFile, "custom.")
+	all, custom, err := getProfilesNamesFromFile(context.Background(), hostFileSystem{}, profilesFile, "custom.")
 	if err != nil {
 		t.Fatalf("getProfilesNamesFromFile: %v", err)
 	}
@@ -128,3 +129,25 @@ func Test_getProfilesNamesFromFile_parsing(t *testing.T) {
 		t.Fatalf("unexpected non-custom in 'custom', \n\ttesting lines: %#v, \n\tcustom map: %#v", lines, custom)
 	}
 }
+
+func Test_lintProfile(t *testing.T) {
+	cases := []struct {
+		name    string
+		profile string
+		ok      bool
+	}{
+		{"balanced", "profile custom.a {\n  /dev/{,u}random r,\n}\n", true},
+		{"braces in comments are ignored", "# }\nprofile custom.a {\n  # {\n}\n", true},
+		{"nested profile", "profile custom.a {\n  profile child {\n  }\n}\n", true},
+		{"unclosed", "profile custom.a {\n", false},
+		{"closing before opening", "}\nprofile custom.a {\n", false},
+		{"NUL byte", "profile custom.a {\x00}\n", false},
+		{"invalid UTF-8", "profile custom.a {\xff}\n", false},
+	}
+	for _, c := range cases {
+		err := lintProfile([]byte(c.profile))
+		if (err == nil) != c.ok {
+			t.Fatalf("lintProfile(%s) error = %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
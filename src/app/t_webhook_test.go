@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const podAdmissionTemplate = `{
+  "apiVersion": "admission.k8s.io/v1",
+  "kind": "AdmissionReview",
+  "request": {
+    "uid": "705ab4f5-6393-11e8-b7cc-42010a800002",
+    "kind": {"group": "", "version": "v1", "kind": "Pod"},
+    "namespace": "default",
+    "operation": "CREATE",
+    "object": %s
+  }
+}`
+
+func postAdmission(t *testing.T, handler http.Handler, body string) (int, *admissionReview) {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("posting AdmissionReview: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+
+	var out admissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decoding AdmissionReview: %v", err)
+	}
+
+	return resp.StatusCode, &out
+}
+
+func podReview(pod string) string {
+	return fmt.Sprintf(podAdmissionTemplate, pod)
+}
+
+func TestReviewPodProfiles(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		pod         string
+		wantAllowed bool
+		wantMessage string
+	}{
+		{
+			name:        "pod without apparmor profiles",
+			policy:      webhookPolicyDeny,
+			pod:         `{"metadata":{"name":"p"},"spec":{"containers":[{"name":"c"}]}}`,
+			wantAllowed: true,
+		},
+		{
+			name:   "known profile in container security context",
+			policy: webhookPolicyDeny,
+			pod: `{"metadata":{"name":"p"},"spec":{"containers":[{"name":"c","securityContext":
+				{"appArmorProfile":{"type":"Localhost","localhostProfile":"custom.myValidProfile"}}}]}}`,
+			wantAllowed: true,
+		},
+		{
+			name:   "non custom localhost profile is ignored",
+			policy: webhookPolicyDeny,
+			pod: `{"metadata":{"name":"p"},"spec":{"securityContext":
+				{"appArmorProfile":{"type":"Localhost","localhostProfile":"k8s-nginx"}}}}`,
+			wantAllowed: true,
+		},
+		{
+			name:   "unknown profile in pod security context is denied",
+			policy: webhookPolicyDeny,
+			pod: `{"metadata":{"name":"p"},"spec":{"securityContext":
+				{"appArmorProfile":{"type":"Localhost","localhostProfile":"custom.typo"}}}}`,
+			wantAllowed: false,
+			wantMessage: `spec.securityContext.appArmorProfile: unknown profile "custom.typo"`,
+		},
+		{
+			name:   "quarantined profile in init container is denied",
+			policy: webhookPolicyDeny,
+			pod: `{"metadata":{"name":"p"},"spec":{"initContainers":[{"name":"init","securityContext":
+				{"appArmorProfile":{"type":"Localhost","localhostProfile":"custom.myNotValidProfile"}}}]}}`,
+			wantAllowed: false,
+			wantMessage: `spec.initContainers[init].securityContext.appArmorProfile: profile "custom.myNotValidProfile" is quarantined`,
+		},
+		{
+			name:   "legacy annotation with unknown profile is denied",
+			policy: webhookPolicyDeny,
+			pod: `{"metadata":{"name":"p","annotations":
+				{"container.apparmor.security.beta.kubernetes.io/c":"localhost/custom.missing"}},"spec":{}}`,
+			wantAllowed: false,
+			wantMessage: `unknown profile "custom.missing"`,
+		},
+		{
+			name:   "invalid profile name is denied",
+			policy: webhookPolicyDeny,
+			pod: `{"metadata":{"name":"p"},"spec":{"containers":[{"name":"c","securityContext":
+				{"appArmorProfile":{"type":"Localhost","localhostProfile":"custom..evil"}}}]}}`,
+			wantAllowed: false,
+			wantMessage: `invalid profile name "custom..evil"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &AppConfig{ConfigmapPath: "profile_test_samples", WebhookPolicy: tc.policy}
+
+			code, review := postAdmission(t, serveAdmission(reviewPodProfiles(cfg)), podReview(tc.pod))
+			if code != http.StatusOK {
+				t.Fatalf("unexpected HTTP status %d", code)
+			}
+
+			if review.Response == nil {
+				t.Fatal("missing response in AdmissionReview")
+			}
+
+			if review.Response.UID != "705ab4f5-6393-11e8-b7cc-42010a800002" {
+				t.Errorf("response UID %q does not match request", review.Response.UID)
+			}
+
+			if review.Response.Allowed != tc.wantAllowed {
+				t.Fatalf("allowed = %t, want %t (status %+v)", review.Response.Allowed, tc.wantAllowed, review.Response.Status)
+			}
+
+			if tc.wantMessage != "" && !strings.Contains(review.Response.Status.Message, tc.wantMessage) {
+				t.Errorf("message %q does not contain %q", review.Response.Status.Message, tc.wantMessage)
+			}
+		})
+	}
+}
+
+func TestReviewPodProfiles_WarnPolicy(t *testing.T) {
+	cfg := &AppConfig{ConfigmapPath: "profile_test_samples", WebhookPolicy: webhookPolicyWarn}
+	pod := `{"metadata":{"name":"p"},"spec":{"containers":[{"name":"c","securityContext":
+		{"appArmorProfile":{"type":"Localhost","localhostProfile":"custom.typo"}}}]}}`
+
+	_, review := postAdmission(t, serveAdmission(reviewPodProfiles(cfg)), podReview(pod))
+
+	if !review.Response.Allowed {
+		t.Fatal("warn policy must allow the pod")
+	}
+
+	if len(review.Response.Warnings) != 1 || !strings.Contains(review.Response.Warnings[0], "custom.typo") {
+		t.Errorf("unexpected warnings %v", review.Response.Warnings)
+	}
+}
+
+func TestServeAdmission_BadRequests(t *testing.T) {
+	handler := serveAdmission(func(context.Context, *admissionRequest) *admissionResponse { return admissionAllowed() })
+
+	if code, _ := postAdmission(t, handler, "not json"); code != http.StatusBadRequest {
+		t.Errorf("invalid JSON: got HTTP %d, want %d", code, http.StatusBadRequest)
+	}
+
+	if code, _ := postAdmission(t, handler, `{"kind":"AdmissionReview"}`); code != http.StatusBadRequest {
+		t.Errorf("missing request: got HTTP %d, want %d", code, http.StatusBadRequest)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/validate/pods", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got HTTP %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestLoadProfileCatalog(t *testing.T) {
+	catalog, err := loadProfileCatalog(context.Background(), "profile_test_samples")
+	ok(t, err)
+
+	for _, name := range []string{"custom.myValidProfile", "custom.deny-network"} {
+		if !catalog.known[name] {
+			t.Errorf("%s should be known", name)
+		}
+	}
+
+	for _, name := range []string{"custom.myNotValidProfile", "custom.bin.foo"} {
+		if _, found := catalog.quarantined[name]; !found {
+			t.Errorf("%s should be quarantined", name)
+		}
+	}
+
+	if catalog.known["positive_tests"] {
+		t.Error("directories must be skipped")
+	}
+}
+
+func configMapReview(t *testing.T, name string, data map[string]string) string {
+	t.Helper()
+
+	object, err := json.Marshal(map[string]any{
+		"metadata": map[string]string{"name": name, "namespace": "security"},
+		"data":     data,
+	})
+	ok(t, err)
+
+	review := strings.Replace(podAdmissionTemplate, `"kind": "Pod"`, `"kind": "ConfigMap"`, 1)
+
+	return fmt.Sprintf(review, object)
+}
+
+func TestReviewProfilesConfigMap(t *testing.T) {
+	cfg := &AppConfig{WebhookProfilesConfigMap: "kapparmor-profiles"}
+	handler := serveAdmission(reviewProfilesConfigMap(cfg))
+
+	tests := []struct {
+		name        string
+		configMap   string
+		data        map[string]string
+		wantAllowed bool
+		wantMessage string
+	}{
+		{
+			name:      "valid profiles",
+			configMap: "kapparmor-profiles",
+			data: map[string]string{
+				"custom.deny-network": "profile custom.deny-network {\n  deny network,\n}\n",
+				"custom.web":          "profile custom.web flags=(attach_disconnected) {\n  /srv/** r,\n}\n",
+			},
+			wantAllowed: true,
+		},
+		{
+			name:        "other configmaps are ignored",
+			configMap:   "kapparmor-settings",
+			data:        map[string]string{"POLL_TIME": "30"},
+			wantAllowed: true,
+		},
+		{
+			name:        "profile name mismatch",
+			configMap:   "kapparmor-profiles",
+			data:        map[string]string{"custom.web": "profile custom.webb {\n}\n"},
+			wantAllowed: false,
+			wantMessage: "custom.web: filename 'custom.web' and profile name 'custom.webb' seems to be different",
+		},
+		{
+			name:        "missing opening brace",
+			configMap:   "kapparmor-profiles",
+			data:        map[string]string{"custom.web": "profile custom.web\n"},
+			wantAllowed: false,
+			wantMessage: "couldn't find a { after 'profile' keyword",
+		},
+		{
+			name:        "unbalanced braces",
+			configMap:   "kapparmor-profiles",
+			data:        map[string]string{"custom.web": "profile custom.web {\n  /srv/** r,\n"},
+			wantAllowed: false,
+			wantMessage: "1 unclosed '{'",
+		},
+		{
+			name:        "invalid key",
+			configMap:   "kapparmor-profiles",
+			data:        map[string]string{"custom--web": "profile custom--web {\n}\n"},
+			wantAllowed: false,
+			wantMessage: "custom--web: rejected suspect filename",
+		},
+		{
+			name:      "oversized profile",
+			configMap: "kapparmor-profiles",
+			data: map[string]string{
+				"custom.big": "profile custom.big {\n" + strings.Repeat("# padding\n", MaxProfileSizeBytes/10) + "}\n",
+			},
+			wantAllowed: false,
+			wantMessage: "the limit is",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, review := postAdmission(t, handler, configMapReview(t, tc.configMap, tc.data))
+			if code != http.StatusOK {
+				t.Fatalf("unexpected HTTP status %d", code)
+			}
+
+			if review.Response.Allowed != tc.wantAllowed {
+				t.Fatalf("allowed = %t, want %t (status %+v)", review.Response.Allowed, tc.wantAllowed, review.Response.Status)
+			}
+
+			if tc.wantMessage != "" && !strings.Contains(review.Response.Status.Message, tc.wantMessage) {
+				t.Errorf("message %q does not contain %q", review.Response.Status.Message, tc.wantMessage)
+			}
+		})
+	}
+}
+
+func TestReviewProfilesConfigMap_PolicyAndTemplates(t *testing.T) {
+	vars := t.TempDir()
+	writeTestFile(t, filepath.Join(vars, "log_dir"), "/var/log/web")
+
+	cfg := &AppConfig{
+		WebhookProfilesConfigMap: "kapparmor-profiles",
+		RequiredIncludes:         "abstractions/base",
+		TemplatesEnabled:         true,
+		TemplateVarsPath:         vars,
+	}
+	ok(t, loadClusterRendering(context.Background(), cfg))
+
+	handler := serveAdmission(reviewProfilesConfigMap(cfg))
+
+	for name, tc := range map[string]struct {
+		profile     string
+		wantMessage string
+	}{
+		"compliant":       {profile: "profile custom.web {\n  #include <abstractions/base>\n  {{ .Vars.log_dir }}/** rw,\n}\n"},
+		"missing include": {profile: "profile custom.web {\n  {{ .Vars.log_dir }}/** rw,\n}\n", wantMessage: "missing required include <abstractions/base>"},
+		"missing variable": {
+			profile:     "profile custom.web {\n  #include <abstractions/base>\n  {{ .Vars.cache_dir }}/** rw,\n}\n",
+			wantMessage: "cache_dir",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, review := postAdmission(t, handler, configMapReview(t, "kapparmor-profiles", map[string]string{"custom.web": tc.profile}))
+
+			if review.Response.Allowed != (tc.wantMessage == "") {
+				t.Fatalf("allowed = %t (status %+v)", review.Response.Allowed, review.Response.Status)
+			}
+
+			if tc.wantMessage != "" && !strings.Contains(review.Response.Status.Message, tc.wantMessage) {
+				t.Errorf("message %q does not contain %q", review.Response.Status.Message, tc.wantMessage)
+			}
+		})
+	}
+}
+
+// writeConfigMapVolume lays out files as the kubelet projects a ConfigMap: in a
+// ..<version> directory, with ..data swapped atomically to point at it.
+func writeConfigMapVolume(t *testing.T, dir, version string, files map[string]string) {
+	t.Helper()
+
+	ok(t, os.MkdirAll(filepath.Join(dir, version), 0o750))
+
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(dir, version, name), content)
+
+		if _, err := os.Lstat(filepath.Join(dir, name)); err != nil {
+			ok(t, os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)))
+		}
+	}
+
+	ok(t, os.Symlink(version, filepath.Join(dir, "..data_tmp")))
+	ok(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+}
+
+func TestReviewPodProfiles_CatalogCache(t *testing.T) {
+	dir := t.TempDir()
+	compliant := "profile custom.web {\n  #include <abstractions/base>\n}\n"
+	writeConfigMapVolume(t, dir, "..v1", map[string]string{"custom.web": compliant})
+
+	cfg := &AppConfig{ConfigmapPath: dir, WebhookPolicy: webhookPolicyDeny, RequiredIncludes: "abstractions/base"}
+	ok(t, loadClusterRendering(context.Background(), cfg))
+
+	handler := serveAdmission(reviewPodProfiles(cfg))
+	pod := podReview(`{"metadata":{"name":"p"},"spec":{"containers":[{"name":"c","securityContext":
+		{"appArmorProfile":{"type":"Localhost","localhostProfile":"custom.web"}}}]}}`)
+
+	if _, review := postAdmission(t, handler, pod); !review.Response.Allowed {
+		t.Fatalf("a compliant profile must be allowed: %+v", review.Response.Status)
+	}
+
+	// The files behind ..data are only read again when the kubelet swaps it.
+	writeTestFile(t, filepath.Join(dir, "..v1", "custom.web"), "profile custom.web {\n}\n")
+
+	if _, review := postAdmission(t, handler, pod); !review.Response.Allowed {
+		t.Fatalf("the cached catalog must be used: %+v", review.Response.Status)
+	}
+
+	writeConfigMapVolume(t, dir, "..v2", map[string]string{"custom.web": "profile custom.web {\n}\n"})
+
+	_, review := postAdmission(t, handler, pod)
+	if review.Response.Allowed || !strings.Contains(review.Response.Status.Message, "missing required include <abstractions/base>") {
+		t.Fatalf("a profile the policy blocks must be quarantined: %+v", review.Response.Status)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+)
+
+// templateFuncs are the string helpers added to the text/template builtins, none
+// of which reads files or the environment. The data only holds strings, and call
+// is disabled, so templates cannot run code.
+var templateFuncs = template.FuncMap{
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+
+		return value
+	},
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    strings.ReplaceAll,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+	"call":       func(any, ...any) (any, error) { return nil, errTemplateCall },
+}
+
+var errTemplateCall = errors.New("call is not available in profile templates")
+
+// templateData is what profile templates see: {{ .Vars.log_dir }},
+// {{ index .Labels "topology.kubernetes.io/zone" }} and {{ .Node }}.
+type templateData struct {
+	Vars   map[string]string
+	Labels map[string]string
+	Node   string
+}
+
+// profileTemplater renders the profile sources as Go templates, with variables
+// read from a mounted settings ConfigMap (one file per key) and the labels of
+// the node. Missing variables are errors, so a profile is never loaded with a
+// hole in one of its paths.
+type profileTemplater struct {
+	varsDir  string
+	nodeName string
+	client   *kubeClient // nil when node labels are not used
+
+	mu   sync.Mutex
+	data templateData
+}
+
+// newProfileTemplater builds the templater from cfg, reading the node labels
+// with the in-cluster credentials when TemplateNodeLabels is set.
+func newProfileTemplater(ctx context.Context, cfg *AppConfig) (*profileTemplater, error) {
+	t := &profileTemplater{varsDir: cfg.TemplateVarsPath, nodeName: cfg.NodeName}
+
+	if cfg.TemplateNodeLabels {
+		if cfg.NodeName == "" {
+			return nil, fmt.Errorf("NODE_NAME must be set to use node labels in profile templates")
+		}
+
+		client, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+
+		t.client = client
+	}
+
+	if err := t.load(ctx); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// loadClusterRendering sets the profile policy and templater of cfg for the modes
+// running without a node, the aggregator and the webhooks: templates see the
+// variables only, the labels and the node name are empty.
+func loadClusterRendering(ctx context.Context, cfg *AppConfig) error {
+	var err error
+
+	if cfg.RequiredIncludes != "" || cfg.PolicySnippetPath != "" {
+		cfg.Policy, err = loadProfilePolicy(cfg.RequiredIncludes, cfg.PolicySnippetPath)
+		if err != nil {
+			return fmt.Errorf("profile policy: %w", err)
+		}
+	}
+
+	if cfg.TemplatesEnabled {
+		cfg.Templater = &profileTemplater{varsDir: cfg.TemplateVarsPath}
+		if err := cfg.Templater.load(ctx); err != nil {
+			return fmt.Errorf("profile templates: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// load reads the variables and the node labels.
+func (t *profileTemplater) load(ctx context.Context) error {
+	data := templateData{Vars: map[string]string{}, Labels: map[string]string{}, Node: t.nodeName}
+
+	if t.varsDir != "" {
+		vars, err := readTemplateVars(t.varsDir)
+		if err != nil {
+			return err
+		}
+
+		data.Vars = vars
+	}
+
+	if t.client != nil {
+		var node nodeObject
+
+		err := t.client.do(ctx, http.MethodGet, "/api/v1/nodes/"+url.PathEscape(t.nodeName), "", nil, &node)
+		if err != nil {
+			return fmt.Errorf("reading the labels of node %s: %w", t.nodeName, err)
+		}
+
+		data.Labels = node.Metadata.Labels
+	}
+
+	for name, value := range mergedTemplateValues(data) {
+		if i := strings.IndexFunc(value, isUnsafeTemplateRune); i >= 0 {
+			return fmt.Errorf("template value %s contains %q, only letters, digits and %s are allowed",
+				name, []rune(value[i:])[0], templateValueSymbols)
+		}
+	}
+
+	t.mu.Lock()
+	t.data = data
+	t.mu.Unlock()
+
+	return nil
+}
+
+// refresh reloads the variables and labels, keeping the previous ones when
+// they cannot be read. A nil templater does nothing.
+func (t *profileTemplater) refresh(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	if err := t.load(ctx); err != nil {
+		loggerFromContext(ctx).Error("Cannot reload the profile template values, keeping the previous ones",
+			slog.Any("error", err))
+	}
+}
+
+// render executes the profile source src as a template. A nil templater
+// returns src unchanged.
+func (t *profileTemplater) render(name string, src []byte) ([]byte, error) {
+	if t == nil {
+		return src, nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("profile template: %w", err)
+	}
+
+	t.mu.Lock()
+	data := t.data
+	t.mu.Unlock()
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, fmt.Errorf("profile template: %w", err)
+	}
+
+	return out.Bytes(), nil
+}
+
+// vars returns the current template variables, nil for a nil templater. The
+// node labels and name differ between nodes and are not part of the profile set hash.
+func (t *profileTemplater) vars() map[string]string {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	vars := maps.Clone(t.data.Vars)
+	if vars == nil {
+		vars = map[string]string{}
+	}
+
+	return vars
+}
+
+// withVars returns a templater rendering with vars instead of the current
+// variables, e.g. the ones of the stable profile set of the staged rollout.
+func (t *profileTemplater) withVars(vars map[string]string) *profileTemplater {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	data := t.data
+	t.mu.Unlock()
+
+	data.Vars = vars
+
+	return &profileTemplater{varsDir: t.varsDir, nodeName: t.nodeName, client: t.client, data: data}
+}
+
+// hashTemplateVars returns the template variables, sorted by name, for the profile set hash.
+func hashTemplateVars(vars map[string]string) []byte {
+	if vars == nil {
+		return nil
+	}
+
+	out := []byte("vars\x00")
+	for _, name := range slices.Sorted(maps.Keys(vars)) {
+		out = fmt.Appendf(out, "%s\x00%s\x00", name, vars[name])
+	}
+
+	return out
+}
+
+// readTemplateVars reads a mounted ConfigMap: every regular, non hidden file
+// is a variable named after it, whose value is the trimmed content.
+func readTemplateVars(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading template variables: %w", err)
+	}
+
+	vars := map[string]string{}
+
+	for _, entry := range entries {
+		// ConfigMap keys are symlinks to the ..data directory.
+		if strings.HasPrefix(entry.Name(), ".") || entry.IsDir() {
+			continue
+		}
+
+		value, err := os.ReadFile(filepath.Join(dir, entry.Name())) // #nosec G304 -- operator-configured PROFILE_TEMPLATE_VARS
+		if err != nil {
+			return nil, fmt.Errorf("reading template variable %s: %w", entry.Name(), err)
+		}
+
+		vars[entry.Name()] = strings.TrimSpace(string(value))
+	}
+
+	return vars, nil
+}
+
+// templateValueSymbols are the characters allowed in template values besides
+// letters and digits: enough for paths, globs and label values. Whitespace,
+// quotes, commas, braces, comments and escapes are refused, so a value stays in
+// the token it is rendered in and cannot end a rule or add one.
+const templateValueSymbols = "/._-:+*?[]~%@"
+
+func isUnsafeTemplateRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(templateValueSymbols, r)
+}
+
+// mergedTemplateValues lists every value of data, by variable or label name.
+func mergedTemplateValues(data templateData) map[string]string {
+	values := maps.Clone(data.Vars)
+	for name, value := range data.Labels {
+		values["label "+name] = value
+	}
+
+	return values
+}
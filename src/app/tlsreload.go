@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a certificate pair from disk and reloads it when the files
+// change, so rotated Secrets are picked up without restarting the agent.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reloadIfChanged loads the pair when the modification time of either file changed.
+func (r *certReloader) reloadIfChanged() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cert != nil && certInfo.ModTime().Equal(r.certTime) && keyInfo.ModTime().Equal(r.keyTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS key pair: %w", err)
+	}
+
+	if r.cert != nil {
+		slog.Default().Info("Reloaded TLS certificate", slog.String("cert", r.certFile))
+	}
+
+	r.cert, r.certTime, r.keyTime = &cert, certInfo.ModTime(), keyInfo.ModTime()
+
+	return nil
+}
+
+// getCertificate is the tls.Config.GetCertificate callback. When the files on disk
+// are being rotated or are invalid, the previous certificate keeps being served.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := r.reloadIfChanged(); err != nil {
+		slog.Default().Warn("cannot reload TLS certificate, serving the previous one", slog.Any("error", err))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.cert, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile) // #nosec G304 -- path from the agent configuration
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no PEM certificate found in " + caFile)
+	}
+
+	return pool, nil
+}
+
+// requireClientCert rejects requests without a client certificate verified against the server ClientCAs.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// Output formats of the validate command.
+const (
+	formatHuman = "human"
+	formatJSON  = "json"
+	formatJUnit = "junit"
+)
+
+var errValidationFailed = errors.New("profile validation failed")
+
+// profileValidation is the result of the node agent checks on one profile.
+type profileValidation struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Valid  bool   `json:"valid"`
+	Error  string `json:"error,omitempty"`
+}
+
+type validationReport struct {
+	Results []profileValidation `json:"results"`
+	Failed  int                 `json:"failed"`
+}
+
+// runValidate checks a profiles directory or ConfigMap manifests offline with the
+// node agent rules and prints one result per profile. It returns errValidationFailed
+// when at least one profile is invalid.
+//
+// The profiles are rendered with the policy and the template variables given, as
+// on the nodes; node labels and names are empty.
+//
+//	kapparmor validate [-o human|json|junit] [-configmap name] [-required-includes list] [-policy-snippet file]
+//	    [-template-vars dir] <directory|manifest.yaml>...
+func runValidate(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	output := flags.String("o", formatHuman, "output format: human, json or junit")
+	configMap := flags.String("configmap", "kapparmor-profiles", "name of the profiles ConfigMap in manifest files, empty for all")
+	requiredIncludes := flags.String("required-includes", "", "comma separated includes required in every profile, as PROFILE_REQUIRED_INCLUDES")
+	policySnippet := flags.String("policy-snippet", "", "file of the snippet injected in every profile, as PROFILE_POLICY_SNIPPET")
+	templateVars := flags.String("template-vars", "", "render the profiles as templates with the variables of this directory, as PROFILE_TEMPLATE_VARS")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return errors.New("usage: kapparmor validate [-o human|json|junit] [-configmap name] [-required-includes list] " +
+			"[-policy-snippet file] [-template-vars dir] <directory|manifest.yaml>...")
+	}
+
+	ctx := context.Background()
+	cfg := &AppConfig{
+		RequiredIncludes:  *requiredIncludes,
+		PolicySnippetPath: *policySnippet,
+		TemplatesEnabled:  *templateVars != "",
+		TemplateVarsPath:  *templateVars,
+	}
+
+	if err := loadClusterRendering(ctx, cfg); err != nil {
+		return err
+	}
+
+	report := &validationReport{Results: []profileValidation{}}
+
+	for _, source := range flags.Args() {
+		sets, err := loadProfileSources(source, *configMap)
+		if err != nil {
+			return err
+		}
+
+		for _, set := range sets {
+			report.add(ctx, cfg, set.source, set.profiles)
+		}
+	}
+
+	var err error
+
+	switch *output {
+	case formatHuman:
+		err = report.writeHuman(stdout)
+	case formatJSON:
+		err = writeJSONIndent(stdout, report)
+	case formatJUnit:
+		err = report.writeJUnit(stdout)
+	default:
+		return fmt.Errorf("unknown output format %q (available: human, json, junit)", *output)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%w: %d of %d profiles", errValidationFailed, report.Failed, len(report.Results))
+	}
+
+	return nil
+}
+
+// add validates profiles as the node agent does: hidden entries and signatures are skipped.
+func (r *validationReport) add(ctx context.Context, cfg *AppConfig, source string, profiles map[string][]byte) {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		if isProfileEntry(name) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		result := profileValidation{Name: name, Source: source, Valid: true}
+
+		if err := validateDesiredProfile(ctx, cfg, name, profiles[name]); err != nil {
+			result.Valid, result.Error = false, err.Error()
+			r.Failed++
+		}
+
+		r.Results = append(r.Results, result)
+	}
+}
+
+func (r *validationReport) writeHuman(w io.Writer) error {
+	for _, result := range r.Results {
+		status := "OK  "
+		if !result.Valid {
+			status = "FAIL"
+		}
+
+		line := fmt.Sprintf("%s %s (%s)", status, result.Name, result.Source)
+		if result.Error != "" {
+			line += ": " + result.Error
+		}
+
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%d profiles checked, %d failed\n", len(r.Results), r.Failed)
+
+	return err
+}
+
+// Subset of the JUnit XML schema understood by CI systems.
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func (r *validationReport) writeJUnit(w io.Writer) error {
+	suite := junitTestSuite{Name: "kapparmor validate", Tests: len(r.Results), Failures: r.Failed}
+
+	for _, result := range r.Results {
+		tc := junitTestCase{Name: result.Name, ClassName: result.Source}
+		if !result.Valid {
+			tc.Failure = &junitFailure{Message: result.Error, Text: result.Error}
+		}
+
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+
+	if err := encoder.Encode(suite); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+
+	return err
+}
+
+func writeJSONIndent(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(v)
+}
+
+type profileSource struct {
+	source   string
+	profiles map[string][]byte
+}
+
+// loadProfileSources reads the profiles of a directory, as mounted from the
+// ConfigMap, or of the ConfigMaps named configMap (all when empty) in a YAML or
+// JSON manifest file.
+func loadProfileSources(path, configMap string) ([]profileSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		profiles, err := readProfileDirectory(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return []profileSource{{source: path, profiles: profiles}}, nil
+	}
+
+	data, err := os.ReadFile(path) // #nosec G304 -- path given by the operator
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfigMapManifests(path, configMap, data)
+}
+
+// readProfileDirectory reads the regular files of dir; subdirectories are skipped as the node agent does.
+func readProfileDirectory(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := map[string][]byte{}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name())) // #nosec G304 -- entry of the given directory
+		if err != nil {
+			return nil, err
+		}
+
+		profiles[entry.Name()] = data
+	}
+
+	return profiles, nil
+}
+
+// yamlConfigMap is the YAML form of configMapObject; binaryData is base64 encoded.
+type yamlConfigMap struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Data       map[string]string `yaml:"data"`
+	BinaryData map[string]string `yaml:"binaryData"`
+}
+
+// parseConfigMapManifests returns the profiles of each ConfigMap named configMap
+// (all when empty) in a multi-document manifest, such as the output of helm template.
+// Other objects are ignored.
+func parseConfigMapManifests(path, configMap string, data []byte) ([]profileSource, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+
+	var sources []profileSource
+
+	for {
+		var doc yamlConfigMap
+
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if doc.Kind != "ConfigMap" || (configMap != "" && doc.Metadata.Name != configMap) {
+			continue
+		}
+
+		cm := &configMapObject{Data: doc.Data, BinaryData: map[string][]byte{}}
+
+		for key, value := range doc.BinaryData {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: ConfigMap %s binaryData %s: %w", path, doc.Metadata.Name, key, err)
+			}
+
+			cm.BinaryData[key] = decoded
+		}
+
+		sources = append(sources, profileSource{
+			source:   path + ":" + doc.Metadata.Name,
+			profiles: profileSetFromConfigMap(cm),
+		})
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("%s: no ConfigMap %q found", path, configMap)
+	}
+
+	return sources, nil
+}
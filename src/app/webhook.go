@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	webhookPolicyDeny = "deny"
+	webhookPolicyWarn = "warn"
+)
+
+// profileCatalog is the set of profiles offered by a profile source directory.
+// Files failing the agent validation are quarantined: the node agent would never load them.
+type profileCatalog struct {
+	known       map[string]bool
+	quarantined map[string]string // profile name -> reason
+}
+
+// loadProfileCatalog reads dir with the same rules used by areProfilesReadable,
+// without exiting on invalid files.
+func loadProfileCatalog(ctx context.Context, dir string) (*profileCatalog, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading profile source %s: %w", dir, err)
+	}
+
+	catalog := &profileCatalog{known: map[string]bool{}, quarantined: map[string]string{}}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isProfileEntry(name) {
+			continue
+		}
+
+		if err := IsProfileNameCorrect(ctx, dir, name); err != nil {
+			catalog.quarantined[name] = err.Error()
+
+			continue
+		}
+
+		catalog.known[name] = true
+	}
+
+	return catalog, nil
+}
+
+// loadDesiredProfileCatalog is loadProfileCatalog with the checks of the
+// ConfigMap webhook (see validateDesiredProfile): the profiles the nodes would
+// block for the policy or the templates of cfg are quarantined too.
+func loadDesiredProfileCatalog(ctx context.Context, cfg *AppConfig) (*profileCatalog, error) {
+	entries, err := os.ReadDir(cfg.ConfigmapPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading profile source %s: %w", cfg.ConfigmapPath, err)
+	}
+
+	catalog := &profileCatalog{known: map[string]bool{}, quarantined: map[string]string{}}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isProfileEntry(name) {
+			continue
+		}
+
+		data, err := readProfileBytes(cfg.filesystem(), nil, cfg.ConfigmapPath, name)
+		if err == nil {
+			err = validateDesiredProfile(ctx, cfg, name, data)
+		}
+
+		if err != nil {
+			catalog.quarantined[name] = err.Error()
+
+			continue
+		}
+
+		catalog.known[name] = true
+	}
+
+	return catalog, nil
+}
+
+// profileSourceVersion identifies the content of the profile source dir: the
+// target of the ..data symlink the kubelet swaps on each ConfigMap update, or
+// the names, sizes and modification times of a plain directory and its files.
+func profileSourceVersion(dir string) (string, error) {
+	if target, err := os.Readlink(filepath.Join(dir, "..data")); err == nil {
+		return "data:" + target, nil
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00", info.ModTime().UnixNano())
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+
+	return fmt.Sprintf("dir:%x", h.Sum(nil)), nil
+}
+
+// runWebhookServer serves the validating admission webhooks over TLS until
+// ctx is canceled or a stop signal is received.
+func runWebhookServer(ctx context.Context, cfg *AppConfig) error {
+	if cfg.WebhookPolicy != webhookPolicyDeny && cfg.WebhookPolicy != webhookPolicyWarn {
+		return fmt.Errorf("invalid WEBHOOK_POLICY %q: expected %q or %q",
+			cfg.WebhookPolicy, webhookPolicyDeny, webhookPolicyWarn)
+	}
+
+	// The ConfigMap review blocks what the nodes would block.
+	if err := loadClusterRendering(ctx, cfg); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/validate/pods", serveAdmission(reviewPodProfiles(cfg)))
+	mux.Handle("/validate/configmaps", serveAdmission(reviewProfilesConfigMap(cfg)))
+	mux.HandleFunc("/healthz", writeHealthz)
+
+	srv := newModeServer(cfg.WebhookAddr, mux)
+
+	cfg.Logger.Info("Starting admission webhook server",
+		slog.String("addr", cfg.WebhookAddr),
+		slog.String("policy", cfg.WebhookPolicy),
+		slog.String("profiles_dir", cfg.ConfigmapPath))
+
+	return serveUntilStopped(ctx, "webhook", srv, func() error {
+		return srv.ListenAndServeTLS(cfg.WebhookTLSCert, cfg.WebhookTLSKey)
+	})
+}
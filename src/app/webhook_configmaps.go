@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Subset of core/v1 ConfigMap.
+type configMapObject struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Metadata   struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace,omitempty"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+		Annotations     map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+	BinaryData map[string][]byte `json:"binaryData,omitempty"`
+}
+
+// reviewProfilesConfigMap runs the node agent validation on every key of the
+// profiles ConfigMap, so a broken profile is refused before reaching any node.
+func reviewProfilesConfigMap(cfg *AppConfig) admissionReviewer {
+	return func(ctx context.Context, req *admissionRequest) *admissionResponse {
+		if req.Kind.Kind != "ConfigMap" || len(req.Object) == 0 {
+			return admissionAllowed()
+		}
+
+		var cm configMapObject
+		if err := json.Unmarshal(req.Object, &cm); err != nil {
+			return admissionDenied(http.StatusBadRequest, fmt.Sprintf("decoding ConfigMap: %v", err))
+		}
+
+		if cm.Metadata.Name != cfg.WebhookProfilesConfigMap {
+			return admissionAllowed()
+		}
+
+		cfg.Templater.refresh(ctx)
+
+		problems := validateProfileSet(ctx, cfg, profileSetFromConfigMap(&cm))
+		if len(problems) == 0 {
+			return admissionAllowed()
+		}
+
+		loggerFromContext(ctx).Warn("Rejecting invalid profiles ConfigMap",
+			slog.String("namespace", req.Namespace),
+			slog.String("configmap", cm.Metadata.Name),
+			slog.String("operation", req.Operation),
+			slog.Any("problems", problems))
+
+		return admissionDenied(http.StatusUnprocessableEntity, strings.Join(problems, "; "))
+	}
+}
+
+// profileSetFromConfigMap merges data and binaryData keys, as the kubelet does
+// when projecting the ConfigMap into the profiles volume.
+func profileSetFromConfigMap(cm *configMapObject) map[string][]byte {
+	profiles := make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+
+	for key, value := range cm.Data {
+		profiles[key] = []byte(value)
+	}
+
+	for key, value := range cm.BinaryData {
+		profiles[key] = value
+	}
+
+	return profiles
+}
+
+// validateProfileSet applies the areProfilesReadable rules and the policy and
+// templates of cfg to in-memory profiles, and returns one problem per invalid
+// entry, sorted by name.
+func validateProfileSet(ctx context.Context, cfg *AppConfig, profiles map[string][]byte) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var problems []string
+
+	for _, name := range names {
+		// Hidden files and signatures are skipped by the node agent.
+		if !isProfileEntry(name) {
+			continue
+		}
+
+		if err := validateDesiredProfile(ctx, cfg, name, profiles[name]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	return problems
+}
+
+// validateProfileEntry runs the IsProfileNameCorrect checks on an in-memory
+// profile: file name rules, then the content checks.
+func validateProfileEntry(ctx context.Context, name string, data []byte) error {
+	if ok, err := isValidFilename(name); !ok {
+		return err
+	}
+
+	return validateProfileContent(ctx, name, data)
+}
+
+// validateDesiredProfile runs the validateProfileEntry checks, then renders the
+// profile with the templates and the policy of cfg as the node agent does, so a
+// profile the nodes would block is reported.
+func validateDesiredProfile(ctx context.Context, cfg *AppConfig, name string, data []byte) error {
+	if err := validateProfileEntry(ctx, name, data); err != nil {
+		return err
+	}
+
+	_, err := renderProfile(ctx, cfg, name, data)
+
+	return err
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	appArmorTypeLocalhost    = "Localhost"
+	appArmorAnnotationPrefix = "container.apparmor.security.beta.kubernetes.io/"
+	appArmorAnnotationLocal  = "localhost/"
+)
+
+// Subset of core/v1 Pod carrying the AppArmor profile references.
+type appArmorProfileRef struct {
+	Type             string  `json:"type"`
+	LocalhostProfile *string `json:"localhostProfile,omitempty"`
+}
+
+type securityContextRef struct {
+	AppArmorProfile *appArmorProfileRef `json:"appArmorProfile,omitempty"`
+}
+
+type podContainerRef struct {
+	Name            string              `json:"name"`
+	SecurityContext *securityContextRef `json:"securityContext,omitempty"`
+}
+
+type podObject struct {
+	Metadata struct {
+		Name         string            `json:"name,omitempty"`
+		GenerateName string            `json:"generateName,omitempty"`
+		Annotations  map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		SecurityContext     *securityContextRef `json:"securityContext,omitempty"`
+		Containers          []podContainerRef   `json:"containers,omitempty"`
+		InitContainers      []podContainerRef   `json:"initContainers,omitempty"`
+		EphemeralContainers []podContainerRef   `json:"ephemeralContainers,omitempty"`
+	} `json:"spec"`
+}
+
+// profileReference is a localhost profile requested somewhere in a Pod spec.
+type profileReference struct {
+	field   string
+	profile string
+}
+
+// podProfileCatalog caches the catalog of the profile source, rebuilt only when
+// the source (see profileSourceVersion) or the template variables change.
+type podProfileCatalog struct {
+	cfg *AppConfig
+
+	mu      sync.Mutex
+	version string
+	catalog *profileCatalog
+}
+
+func (c *podProfileCatalog) get(ctx context.Context) (*profileCatalog, error) {
+	c.cfg.Templater.refresh(ctx)
+
+	version, err := profileSourceVersion(c.cfg.ConfigmapPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading profile source %s: %w", c.cfg.ConfigmapPath, err)
+	}
+
+	version += string(hashTemplateVars(c.cfg.Templater.vars()))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.catalog != nil && c.version == version {
+		return c.catalog, nil
+	}
+
+	catalog, err := loadDesiredProfileCatalog(ctx, c.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c.catalog, c.version = catalog, version
+
+	return catalog, nil
+}
+
+// reviewPodProfiles checks that every custom profile referenced by a Pod is
+// offered by the profile source and would be accepted by the node agent,
+// policy and templates included.
+func reviewPodProfiles(cfg *AppConfig) admissionReviewer {
+	catalogs := &podProfileCatalog{cfg: cfg}
+
+	return func(ctx context.Context, req *admissionRequest) *admissionResponse {
+		if req.Kind.Kind != "Pod" || len(req.Object) == 0 {
+			return admissionAllowed()
+		}
+
+		var pod podObject
+		if err := json.Unmarshal(req.Object, &pod); err != nil {
+			return admissionDenied(http.StatusBadRequest, fmt.Sprintf("decoding Pod: %v", err))
+		}
+
+		refs := customProfileReferences(&pod)
+		if len(refs) == 0 {
+			return admissionAllowed()
+		}
+
+		catalog, err := catalogs.get(ctx)
+		if err != nil {
+			loggerFromContext(ctx).Error("cannot load profile catalog", slog.Any("error", err))
+
+			return admissionDenied(http.StatusInternalServerError, err.Error())
+		}
+
+		problems := catalog.checkReferences(refs)
+		if len(problems) == 0 {
+			return admissionAllowed()
+		}
+
+		podName := pod.Metadata.Name
+		if podName == "" {
+			podName = pod.Metadata.GenerateName
+		}
+
+		loggerFromContext(ctx).Warn("Pod references unavailable AppArmor profiles",
+			slog.String("namespace", req.Namespace),
+			slog.String("pod", podName),
+			slog.String("policy", cfg.WebhookPolicy),
+			slog.Any("problems", problems))
+
+		if cfg.WebhookPolicy == webhookPolicyWarn {
+			return admissionAllowed(problems...)
+		}
+
+		return admissionDenied(http.StatusForbidden, strings.Join(problems, "; "))
+	}
+}
+
+// customProfileReferences collects the custom localhost profiles requested by the
+// pod and container security contexts and by the legacy beta annotations.
+func customProfileReferences(pod *podObject) []profileReference {
+	var refs []profileReference
+
+	addFromContext := func(field string, sc *securityContextRef) {
+		if sc == nil || sc.AppArmorProfile == nil || sc.AppArmorProfile.Type != appArmorTypeLocalhost {
+			return
+		}
+
+		if p := sc.AppArmorProfile.LocalhostProfile; p != nil && strings.HasPrefix(*p, ProfileNamePrefix) {
+			refs = append(refs, profileReference{field: field + ".securityContext.appArmorProfile", profile: *p})
+		}
+	}
+
+	addFromContext("spec", pod.Spec.SecurityContext)
+
+	for kind, containers := range map[string][]podContainerRef{
+		"containers":          pod.Spec.Containers,
+		"initContainers":      pod.Spec.InitContainers,
+		"ephemeralContainers": pod.Spec.EphemeralContainers,
+	} {
+		for _, c := range containers {
+			addFromContext(fmt.Sprintf("spec.%s[%s]", kind, c.Name), c.SecurityContext)
+		}
+	}
+
+	for key, value := range pod.Metadata.Annotations {
+		if !strings.HasPrefix(key, appArmorAnnotationPrefix) {
+			continue
+		}
+
+		profile, isLocal := strings.CutPrefix(value, appArmorAnnotationLocal)
+		if isLocal && strings.HasPrefix(profile, ProfileNamePrefix) {
+			refs = append(refs, profileReference{field: "metadata.annotations[" + key + "]", profile: profile})
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool { return refs[i].field < refs[j].field })
+
+	return refs
+}
+
+// checkReferences returns a human readable problem for each unusable reference.
+func (c *profileCatalog) checkReferences(refs []profileReference) []string {
+	var problems []string
+
+	for _, ref := range refs {
+		if ok, err := isValidFilename(ref.profile); !ok {
+			problems = append(problems, fmt.Sprintf("%s: invalid profile name %q: %v", ref.field, ref.profile, err))
+
+			continue
+		}
+
+		if reason, found := c.quarantined[ref.profile]; found {
+			problems = append(problems, fmt.Sprintf("%s: profile %q is quarantined: %s", ref.field, ref.profile, reason))
+
+			continue
+		}
+
+		if !c.known[ref.profile] {
+			problems = append(problems, fmt.Sprintf("%s: unknown profile %q", ref.field, ref.profile))
+		}
+	}
+
+	return problems
+}